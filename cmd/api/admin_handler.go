@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/labstack/echo/v4"
 	"net/http"
@@ -119,3 +120,32 @@ func (app *Application) CreateEventType(c echo.Context) error {
 	}
 	return c.JSON(http.StatusOK, eventType)
 }
+
+func (app *Application) SetPurchaseLimit(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	_, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+	req := internal.PurchaseLimit{}
+	err = c.Bind(&req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "bad request")
+	}
+
+	err = app.models.limits.SetPurchaseLimit(&req)
+	if err != nil {
+		switch {
+		case errors.Is(err, internal.ErrInvalidPurchaseLimit):
+			return c.JSON(http.StatusBadRequest, "set exactly one of eventId, eventDayId, ticketTypeId, seatedEventDayId and shahTicketTypeId")
+		case errors.Is(err, internal.ErrLimitTargetNotFound):
+			return c.JSON(http.StatusNotFound, "limit target not found")
+		}
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, req)
+}
@@ -1,30 +1,56 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"github.com/labstack/echo/v4"
+	"os"
+	"strconv"
 	"tap2go/internal"
+	"time"
 )
 
 type Models struct {
-	user    *internal.UserRepo
-	sector  *internal.SectorRepo
-	seat    *internal.SeatRepo
-	venue   *internal.VenueRepo
-	event   *internal.EventRepo
-	tickets *internal.TicketRepo
-	admin   *internal.AdminRepo
-	news    *internal.NewsRepo
+	user        *internal.UserRepo
+	sector      *internal.SectorRepo
+	seat        *internal.SeatRepo
+	venue       *internal.VenueRepo
+	event       *internal.EventRepo
+	tickets     *internal.TicketRepo
+	admin       *internal.AdminRepo
+	news        *internal.NewsRepo
+	holds       *internal.HoldRepo
+	orders      *internal.OrderRepo
+	payments    *internal.PaymentRepo
+	refunds     *internal.RefundRepo
+	checkIns    *internal.CheckInRepo
+	transfers   *internal.TransferRepo
+	promos      *internal.PromoRepo
+	limits      *internal.PurchaseLimitRepo
+	waitlist    *internal.WaitlistRepo
+	seatMaps    *internal.SeatMapRepo
+	reports     *internal.ReportRepo
+	idempotency *internal.IdempotencyRepo
+	schedules   *internal.ScheduleRepo
 }
 
 type Config struct {
-	dsn  *string
-	port *string
+	dsn            *string
+	port           *string
+	holdTTL        time.Duration
+	transferCutoff time.Duration
+	dev            bool
 }
 
 type Application struct {
-	server *echo.Echo
-	models Models
-	config Config
+	server       *echo.Echo
+	models       Models
+	config       Config
+	payments     internal.PaymentProvider
+	signer       *internal.TicketSigner
+	availability *internal.AvailabilityBroker
 }
 
 func NewApp(dsn, port *string) (*Application, error) {
@@ -35,6 +61,9 @@ func NewApp(dsn, port *string) (*Application, error) {
 	app.AddRoutes()
 	app.config.port = port
 	app.config.dsn = dsn
+	app.config.holdTTL = internal.DefaultHoldTTL
+	app.config.transferCutoff = internal.DefaultTransferCutoff
+	app.config.dev = devMode()
 	pool, err := ConnectPgPoolConfigured(app.config.dsn)
 	if err != nil {
 		return nil, err
@@ -47,5 +76,100 @@ func NewApp(dsn, port *string) (*Application, error) {
 	app.models.tickets = &internal.TicketRepo{DB: pool}
 	app.models.admin = &internal.AdminRepo{DB: pool}
 	app.models.news = &internal.NewsRepo{DB: pool}
+	app.models.holds = &internal.HoldRepo{DB: pool}
+	app.models.orders = &internal.OrderRepo{DB: pool}
+	app.models.payments = &internal.PaymentRepo{DB: pool}
+	app.models.refunds = &internal.RefundRepo{DB: pool}
+	app.models.checkIns = &internal.CheckInRepo{DB: pool}
+	app.models.transfers = &internal.TransferRepo{DB: pool}
+	app.models.promos = &internal.PromoRepo{DB: pool}
+	app.models.limits = &internal.PurchaseLimitRepo{DB: pool}
+	app.models.waitlist = &internal.WaitlistRepo{DB: pool}
+	app.models.seatMaps = &internal.SeatMapRepo{DB: pool}
+	app.models.reports = &internal.ReportRepo{DB: pool}
+	app.models.idempotency = &internal.IdempotencyRepo{DB: pool}
+	app.models.schedules = &internal.ScheduleRepo{DB: pool}
+	app.payments, err = newPaymentProvider(app.config.dev, *port)
+	if err != nil {
+		return nil, err
+	}
+	app.signer, err = newTicketSigner(app.config.dev)
+	if err != nil {
+		return nil, err
+	}
+	app.availability = &internal.AvailabilityBroker{DB: pool}
+	go app.availability.Listen(context.Background(), func(err error) {
+		app.server.Logger.Error(err)
+	})
+	go app.sweepHolds()
+	go app.sweepIdempotencyKeys()
+	go app.offerWaitlists()
+	go app.retryRefunds()
+	go app.publishScheduledEvents()
+	go app.extendSchedules()
 	return &app, nil
 }
+
+// devMode reports whether TAP2GO_DEV=true allows settings that are only safe
+// on a development machine.
+func devMode() bool {
+	dev, _ := strconv.ParseBool(os.Getenv("TAP2GO_DEV"))
+	return dev
+}
+
+// newPaymentProvider picks the gateway named by PAYMENT_PROVIDER. The fake
+// gateway hands out tickets without money, it is only available in dev mode.
+func newPaymentProvider(dev bool, port string) (internal.PaymentProvider, error) {
+	switch name := os.Getenv("PAYMENT_PROVIDER"); name {
+	case "fake":
+		if !dev {
+			return nil, errors.New("the fake payment provider needs TAP2GO_DEV=true")
+		}
+		return newFakePaymentProvider(port)
+	case "":
+		return nil, errors.New("PAYMENT_PROVIDER is not set")
+	default:
+		return nil, fmt.Errorf("unknown payment provider %q", name)
+	}
+}
+
+// newFakePaymentProvider configures the built-in gateway from the environment:
+// FAKE_PAYMENT_SECRET signs callbacks, FAKE_PAYMENT_AUTO_SETTLE=true settles
+// every payment on its own, FAKE_PAYMENT_FAIL=true makes those fail and
+// FAKE_PAYMENT_DELAY sets how long settling takes.
+func newFakePaymentProvider(port string) (*internal.FakeProvider, error) {
+	secret := os.Getenv("FAKE_PAYMENT_SECRET")
+	if secret == "" {
+		return nil, errors.New("FAKE_PAYMENT_SECRET is not set")
+	}
+	provider := internal.NewFakeProvider([]byte(secret), "http://localhost"+port+"/api/v1/payment/webhook/fake")
+	if settle, err := strconv.ParseBool(os.Getenv("FAKE_PAYMENT_AUTO_SETTLE")); err == nil {
+		provider.AutoSettle = settle
+	}
+	if fail, err := strconv.ParseBool(os.Getenv("FAKE_PAYMENT_FAIL")); err == nil {
+		provider.Succeed = !fail
+	}
+	if delay, err := time.ParseDuration(os.Getenv("FAKE_PAYMENT_DELAY")); err == nil {
+		provider.Delay = delay
+	}
+	return provider, nil
+}
+
+// newTicketSigner loads the ticket signing key from TICKET_SIGNING_SEED, a
+// base64 encoded 32 byte seed. Only dev mode runs without it, on a temporary
+// key every code signed with stops verifying after a restart.
+func newTicketSigner(dev bool) (*internal.TicketSigner, error) {
+	encoded := os.Getenv("TICKET_SIGNING_SEED")
+	if encoded == "" {
+		if !dev {
+			return nil, errors.New("TICKET_SIGNING_SEED is not set")
+		}
+		fmt.Println("TICKET_SIGNING_SEED is not set, using a temporary ticket signing key")
+		return internal.NewTicketSigner(nil)
+	}
+	seed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewTicketSigner(seed)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const availabilityHeartbeat = 15 * time.Second
+
+// StreamAvailabilityNoShah pushes the remaining counts of a GA event day as
+// Server-Sent Events.
+func (app *Application) StreamAvailabilityNoShah(c echo.Context) error {
+	return app.streamAvailability(c, false)
+}
+
+// StreamAvailabilityShah pushes seat state changes of a seated event day as
+// Server-Sent Events.
+func (app *Application) StreamAvailabilityShah(c echo.Context) error {
+	return app.streamAvailability(c, true)
+}
+
+// streamAvailability sends a snapshot of the day first and then every
+// change to it. Changes made while the snapshot is read are sent after it,
+// so the client ends up with the latest state either way.
+func (app *Application) streamAvailability(c echo.Context, seated bool) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid id")
+	}
+
+	changes, unsubscribe := app.availability.Subscribe(seated, id)
+	defer unsubscribe()
+
+	var snapshot interface{}
+	if seated {
+		snapshot, err = app.models.tickets.GetSeatsForEventDay(&id)
+	} else {
+		snapshot, err = app.models.tickets.GetTypesForDate(&id)
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set(echo.HeaderConnection, "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if err := writeEvent(w, "snapshot", snapshot); err != nil {
+		return nil
+	}
+
+	heartbeat := time.NewTicker(availabilityHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case change := <-changes:
+			if err := writeEvent(w, "change", change); err != nil {
+				return nil
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return nil
+			}
+			w.Flush()
+		}
+	}
+}
+
+func writeEvent(w *echo.Response, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+	if err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"time"
+)
+
+const holdSweepInterval = 30 * time.Second
+
+// sweepHolds periodically releases holds that were neither converted nor
+// released before their TTL ran out.
+func (app *Application) sweepHolds() {
+	ticker := time.NewTicker(holdSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		n, err := app.models.holds.ReleaseExpiredHolds()
+		if err != nil {
+			app.server.Logger.Error(err)
+		}
+		if n > 0 {
+			app.server.Logger.Infof("released %d expired holds", n)
+		}
+	}
+}
+
+const publishSweepInterval = time.Minute
+
+// publishScheduledEvents takes scheduled events live once their publish
+// time has come.
+func (app *Application) publishScheduledEvents() {
+	ticker := time.NewTicker(publishSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		n, err := app.models.event.PublishScheduledEvents()
+		if err != nil {
+			app.server.Logger.Error(err)
+			continue
+		}
+		if n > 0 {
+			app.server.Logger.Infof("published %d scheduled events", n)
+		}
+	}
+}
+
+const scheduleSweepInterval = 6 * time.Hour
+
+// extendSchedules keeps generating days of recurring schedules as time goes
+// by.
+func (app *Application) extendSchedules() {
+	ticker := time.NewTicker(scheduleSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		n, err := app.models.schedules.ExtendSchedules()
+		if err != nil {
+			app.server.Logger.Error(err)
+		}
+		if n > 0 {
+			app.server.Logger.Infof("generated %d scheduled event days", n)
+		}
+	}
+}
+
+const waitlistSweepInterval = time.Minute
+
+// offerWaitlists offers inventory whose waitlist offer was put off.
+func (app *Application) offerWaitlists() {
+	ticker := time.NewTicker(waitlistSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := app.models.waitlist.OfferWaitlists()
+		if err != nil {
+			app.server.Logger.Error(err)
+		}
+	}
+}
+
+const refundRetryInterval = 5 * time.Minute
+
+// retryRefunds sends again the refunds the payment provider failed to take.
+func (app *Application) retryRefunds() {
+	ticker := time.NewTicker(refundRetryInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		n, err := app.models.refunds.RetryPendingRefunds(app.payments)
+		if err != nil {
+			app.server.Logger.Error(err)
+		}
+		if n > 0 {
+			app.server.Logger.Infof("sent %d pending refunds", n)
+		}
+	}
+}
+
+const idempotencySweepInterval = time.Hour
+
+// sweepIdempotencyKeys drops stored responses past their TTL.
+func (app *Application) sweepIdempotencyKeys() {
+	ticker := time.NewTicker(idempotencySweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		n, err := app.models.idempotency.DeleteExpiredKeys()
+		if err != nil {
+			app.server.Logger.Error(err)
+			continue
+		}
+		if n > 0 {
+			app.server.Logger.Infof("deleted %d expired idempotency keys", n)
+		}
+	}
+}
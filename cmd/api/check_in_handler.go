@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+	"tap2go/internal"
+)
+
+func (app *Application) ScanTicket(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	adminId, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+
+	req := internal.CheckInRequest{}
+	err = c.Bind(&req)
+	if err != nil || req.Code == nil || req.EventId == nil {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+	req.AdminId = adminId
+
+	code, err := internal.VerifyTicketCode(app.signer.Public, *req.Code)
+	if err != nil {
+		if errors.Is(err, internal.ErrInvalidTicketCode) {
+			return c.JSON(http.StatusOK, internal.CheckInResult{Status: internal.CheckInInvalid})
+		}
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+
+	result, err := app.models.checkIns.CheckIn(code, &req)
+	if err != nil {
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+func (app *Application) GetAttendance(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	_, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+	eventId, err := strconv.Atoi(c.Param("eventId"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid id")
+	}
+
+	attendance, err := app.models.checkIns.GetAttendance(&eventId)
+	if err != nil {
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, attendance)
+}
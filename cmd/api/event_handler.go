@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
@@ -16,20 +17,26 @@ import (
 
 func (app *Application) CreateEvent(c echo.Context) error {
 	req := struct {
-		ID             *int                   `json:"id"`
-		Title          *string                `json:"title"`
-		Type           []*internal.EventType  `json:"eventType"`
-		Description    map[string]interface{} `json:"description"`
-		BriefDesc      *string                `json:"briefDesc"`
-		Genres         []*string              `json:"genres"`
-		Venues         []*internal.Venue      `json:"venues"`
-		StartTime      *time.Time             `json:"startTime"`
-		EndTime        *time.Time             `json:"endTime"`
-		Price          *float64               `json:"price"`
-		AgeRestriction *int                   `json:"ageRestriction"`
-		Rating         *float64               `json:"rating"`
-		CreatedAt      *time.Time             `json:"createdAt"`
-		UpdatedAt      *time.Time             `json:"updatedAt"`
+		ID                  *int                   `json:"id"`
+		Title               *string                `json:"title"`
+		Type                []*internal.EventType  `json:"eventType"`
+		Description         map[string]interface{} `json:"description"`
+		BriefDesc           *string                `json:"briefDesc"`
+		Genres              []*string              `json:"genres"`
+		Venues              []*internal.Venue      `json:"venues"`
+		StartTime           *time.Time             `json:"startTime"`
+		EndTime             *time.Time             `json:"endTime"`
+		Price               *internal.Money        `json:"price"`
+		Currency            *string                `json:"currency"`
+		AgeRestriction      *int                   `json:"ageRestriction"`
+		Rating              *float64               `json:"rating"`
+		CreatedAt           *time.Time             `json:"createdAt"`
+		UpdatedAt           *time.Time             `json:"updatedAt"`
+		RefundWindowHours   *int                   `json:"refundWindowHours"`
+		TransferCutoffHours *int                   `json:"transferCutoffHours"`
+		MaxTicketsPerUser   *int                   `json:"maxTicketsPerUser"`
+		Status              *string                `json:"status"`
+		PublishAt           *time.Time             `json:"publishAt"`
 	}{}
 	err := c.Bind(&req)
 	if err != nil {
@@ -65,24 +72,33 @@ func (app *Application) CreateEvent(c echo.Context) error {
 	}
 	timestamp := time.Now()
 	event := internal.Event{
-		ID:             req.ID,
-		Title:          req.Title,
-		Type:           req.Type,
-		Description:    &jsonString,
-		BriefDesc:      req.BriefDesc,
-		Genres:         req.Genres,
-		Venues:         req.Venues,
-		StartTime:      req.StartTime,
-		EndTime:        req.EndTime,
-		Price:          req.Price,
-		AgeRestriction: req.AgeRestriction,
-		Rating:         req.Rating,
-		CreatedAt:      &timestamp,
-		UpdatedAt:      &timestamp,
+		ID:                  req.ID,
+		Title:               req.Title,
+		Type:                req.Type,
+		Description:         &jsonString,
+		BriefDesc:           req.BriefDesc,
+		Genres:              req.Genres,
+		Venues:              req.Venues,
+		StartTime:           req.StartTime,
+		EndTime:             req.EndTime,
+		Price:               req.Price,
+		Currency:            req.Currency,
+		AgeRestriction:      req.AgeRestriction,
+		Rating:              req.Rating,
+		CreatedAt:           &timestamp,
+		UpdatedAt:           &timestamp,
+		RefundWindowHours:   req.RefundWindowHours,
+		TransferCutoffHours: req.TransferCutoffHours,
+		MaxTicketsPerUser:   req.MaxTicketsPerUser,
+		Status:              req.Status,
+		PublishAt:           req.PublishAt,
 	}
 
 	id, err := app.models.event.CreateEvent(&event)
 	if err != nil {
+		if isMoneyError(err) || isEventStatusError(err) {
+			return c.JSON(http.StatusBadRequest, err.Error())
+		}
 		fmt.Println(err.Error())
 		return c.JSON(http.StatusInternalServerError, "internal server error")
 	}
@@ -137,7 +153,34 @@ func (app *Application) GetEventPagination(c echo.Context) error {
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, "invalid page")
 	}
-	events, totalPages, err := app.models.event.GetEventsPage(&page)
+	events, totalPages, err := app.models.event.GetEventsPage(&page, internal.ListedEventStatuses)
+	if err != nil {
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"events": events, "totalPages": totalPages})
+}
+
+// GetAdminEventPagination lists events in any status, optionally only the
+// ones in the status query param.
+func (app *Application) GetAdminEventPagination(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	_, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+	page, err := strconv.Atoi(c.QueryParam("page"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid page")
+	}
+	var statuses []string
+	if status := c.QueryParam("status"); status != "" {
+		statuses = []string{status}
+	}
+	events, totalPages, err := app.models.event.GetEventsPage(&page, statuses)
 	if err != nil {
 		fmt.Println(err.Error())
 		return c.JSON(http.StatusInternalServerError, "internal server error")
@@ -145,6 +188,46 @@ func (app *Application) GetEventPagination(c echo.Context) error {
 	return c.JSON(http.StatusOK, map[string]interface{}{"events": events, "totalPages": totalPages})
 }
 
+// SetEventStatus moves an event through its lifecycle. A scheduled event
+// needs publishAt and goes live on its own at that time.
+func (app *Application) SetEventStatus(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	_, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid id")
+	}
+	req := struct {
+		Status    *string    `json:"status"`
+		PublishAt *time.Time `json:"publishAt"`
+	}{}
+	err = c.Bind(&req)
+	if err != nil || req.Status == nil {
+		return c.JSON(http.StatusBadRequest, "invalid JSON")
+	}
+
+	err = app.models.event.SetEventStatus(&id, *req.Status, req.PublishAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, internal.ErrEventNotFound):
+			return c.JSON(http.StatusNotFound, "event not found")
+		case errors.Is(err, internal.ErrEventStatusTransition):
+			return c.JSON(http.StatusConflict, err.Error())
+		case isEventStatusError(err):
+			return c.JSON(http.StatusBadRequest, err.Error())
+		}
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, "success")
+}
+
 func (app *Application) GetEventImages(c echo.Context) error {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
@@ -172,11 +255,159 @@ func (app *Application) GetEventById(c echo.Context) error {
 	}
 	event, err := app.models.event.GetEventById(&id)
 	if err != nil {
+		if errors.Is(err, internal.ErrEventNotFound) {
+			return c.JSON(http.StatusNotFound, "event not found")
+		}
 		return c.JSON(http.StatusInternalServerError, "internal server error")
 	}
 	return c.JSON(http.StatusOK, event)
 }
 
+// UpdateEvent changes the fields present in the body, clear lists optional
+// fields to empty. eventType and venues replace the links of the event when
+// given, entries without an id are created like in CreateEvent.
+func (app *Application) UpdateEvent(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	_, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid id")
+	}
+	req := struct {
+		Title               *string                `json:"title"`
+		Type                []*internal.EventType  `json:"eventType"`
+		Description         map[string]interface{} `json:"description"`
+		BriefDesc           *string                `json:"briefDesc"`
+		Genres              []*string              `json:"genres"`
+		Venues              []*internal.Venue      `json:"venues"`
+		StartTime           *time.Time             `json:"startTime"`
+		EndTime             *time.Time             `json:"endTime"`
+		Price               *internal.Money        `json:"price"`
+		Currency            *string                `json:"currency"`
+		AgeRestriction      *int                   `json:"ageRestriction"`
+		Rating              *float64               `json:"rating"`
+		Duration            *string                `json:"duration"`
+		RefundWindowHours   *int                   `json:"refundWindowHours"`
+		TransferCutoffHours *int                   `json:"transferCutoffHours"`
+		MaxTicketsPerUser   *int                   `json:"maxTicketsPerUser"`
+		Clear               []string               `json:"clear"`
+	}{}
+	err = c.Bind(&req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid JSON")
+	}
+
+	update := internal.EventUpdate{
+		Title:               req.Title,
+		BriefDesc:           req.BriefDesc,
+		Genres:              req.Genres,
+		StartTime:           req.StartTime,
+		EndTime:             req.EndTime,
+		Price:               req.Price,
+		Currency:            req.Currency,
+		AgeRestriction:      req.AgeRestriction,
+		Rating:              req.Rating,
+		Duration:            req.Duration,
+		RefundWindowHours:   req.RefundWindowHours,
+		TransferCutoffHours: req.TransferCutoffHours,
+		MaxTicketsPerUser:   req.MaxTicketsPerUser,
+		Clear:               req.Clear,
+		Types:               req.Type,
+		Venues:              req.Venues,
+	}
+	if req.Description != nil {
+		jsonBytes, err := json.Marshal(req.Description)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, "invalid JSON")
+		}
+		jsonString := string(jsonBytes)
+		update.Description = &jsonString
+	}
+	if req.StartTime != nil && req.EndTime != nil && req.EndTime.Before(*req.StartTime) {
+		return c.JSON(http.StatusBadRequest, "endTime is before startTime")
+	}
+
+	err = app.models.event.UpdateEvent(&id, &update)
+	if err != nil {
+		switch {
+		case errors.Is(err, internal.ErrEventNotFound):
+			return c.JSON(http.StatusNotFound, "event not found")
+		case errors.Is(err, internal.ErrEventCurrencyLocked):
+			return c.JSON(http.StatusConflict, err.Error())
+		case isMoneyError(err), errors.Is(err, internal.ErrEventFieldNotClear), errors.Is(err, internal.ErrInvalidEventLink):
+			return c.JSON(http.StatusBadRequest, err.Error())
+		}
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, "success")
+}
+
+// DeleteEvent soft deletes an event, with hard=true it is removed for good
+// unless tickets were ever issued for it.
+func (app *Application) DeleteEvent(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	_, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid id")
+	}
+	hard, _ := strconv.ParseBool(c.QueryParam("hard"))
+
+	if hard {
+		err = app.models.event.DeleteEvent(&id)
+	} else {
+		err = app.models.event.SoftDeleteEvent(&id)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, internal.ErrEventNotFound):
+			return c.JSON(http.StatusNotFound, "event not found")
+		case errors.Is(err, internal.ErrEventHasTickets):
+			return c.JSON(http.StatusConflict, "event has tickets, it can only be soft deleted")
+		}
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, "success")
+}
+
+func (app *Application) RestoreEvent(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	_, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid id")
+	}
+	err = app.models.event.RestoreEvent(&id)
+	if err != nil {
+		if errors.Is(err, internal.ErrEventNotFound) {
+			return c.JSON(http.StatusNotFound, "event not found")
+		}
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, "success")
+}
+
 func (app *Application) UploadImages(c echo.Context) error {
 	form, err := c.MultipartForm()
 	if err != nil {
@@ -281,6 +512,49 @@ func (app *Application) UploadTicketsNoShah(c echo.Context) error {
 	}
 	err = app.models.tickets.CreateTicketsNoSham(req.EventId, req.VenueId, req.Days)
 	if err != nil {
+		switch {
+		case errors.Is(err, internal.ErrInvalidPriceTier):
+			return c.JSON(http.StatusBadRequest, "invalid price tier")
+		case errors.Is(err, internal.ErrEventNotFound):
+			return c.JSON(http.StatusNotFound, err.Error())
+		case isMoneyError(err):
+			return c.JSON(http.StatusBadRequest, err.Error())
+		}
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, "success")
+}
+
+// SetPriceTiers replaces the price schedule of a GA ticket type.
+func (app *Application) SetPriceTiers(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	_, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+	req := struct {
+		TicketTypeId *int                  `json:"ticketTypeId"`
+		Tiers        []*internal.PriceTier `json:"tiers"`
+	}{}
+	err = c.Bind(&req)
+	if err != nil || req.TicketTypeId == nil {
+		return c.JSON(http.StatusBadRequest, "invalid JSON")
+	}
+
+	err = app.models.tickets.SetPriceTiers(req.TicketTypeId, req.Tiers)
+	if err != nil {
+		switch {
+		case errors.Is(err, internal.ErrTicketTypeNotFound):
+			return c.JSON(http.StatusNotFound, "ticket type not found")
+		case errors.Is(err, internal.ErrInvalidPriceTier):
+			return c.JSON(http.StatusBadRequest, "invalid price tier")
+		case isMoneyError(err):
+			return c.JSON(http.StatusBadRequest, err.Error())
+		}
 		fmt.Println(err.Error())
 		return c.JSON(http.StatusInternalServerError, "internal server error")
 	}
@@ -289,9 +563,11 @@ func (app *Application) UploadTicketsNoShah(c echo.Context) error {
 
 func (app *Application) UploadTicketsWithShah(c echo.Context) error {
 	req := struct {
-		VenueId *int               `json:"venueId"`
-		EventId *int               `json:"eventId"`
-		Seats   [][]*internal.Seat `json:"seats"`
+		VenueId     *int               `json:"venueId"`
+		EventId     *int               `json:"eventId"`
+		Dates       []*time.Time       `json:"dates"`
+		Seats       [][]*internal.Seat `json:"seats"`
+		EventDayIds []int              `json:"eventDayIds"`
 	}{}
 
 	err := c.Bind(&req)
@@ -299,11 +575,22 @@ func (app *Application) UploadTicketsWithShah(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, "invalid JSON")
 	}
 
-	err = app.models.tickets.CreateTicketsWithSham(req.EventId, req.VenueId, req.Seats)
+	dayIds, err := app.models.tickets.CreateTicketsWithSham(req.EventId, req.VenueId, req.Dates, req.Seats)
 	if err != nil {
+		switch {
+		case errors.Is(err, internal.ErrSeatMapDateRequired):
+			return c.JSON(http.StatusBadRequest, "every day needs a date, send dates for an event without a start time")
+		case errors.Is(err, internal.ErrSeatMapInUse):
+			return c.JSON(http.StatusConflict, "tickets were already issued for this event day")
+		case errors.Is(err, internal.ErrEventNotFound):
+			return c.JSON(http.StatusNotFound, err.Error())
+		case isMoneyError(err):
+			return c.JSON(http.StatusBadRequest, err.Error())
+		}
 		fmt.Println(err.Error())
 		return c.JSON(http.StatusInternalServerError, "internal server error")
 	}
+	req.EventDayIds = dayIds
 	return c.JSON(http.StatusOK, req)
 }
 
@@ -395,3 +682,12 @@ func (app *Application) UploadDecorWithShah(c echo.Context) error {
 
 	return c.JSON(http.StatusOK, req)
 }
+
+// isMoneyError reports whether err rejects a price or currency of the request.
+func isMoneyError(err error) bool {
+	return errors.Is(err, internal.ErrUnsupportedCurrency) || errors.Is(err, internal.ErrCurrencyMismatch) || errors.Is(err, internal.ErrInvalidAmount)
+}
+
+func isEventStatusError(err error) bool {
+	return errors.Is(err, internal.ErrInvalidEventStatus) || errors.Is(err, internal.ErrEventStatusTransition) || errors.Is(err, internal.ErrPublishTimeRequired)
+}
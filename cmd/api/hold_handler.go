@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"tap2go/internal"
+)
+
+func (app *Application) CreateHold(c echo.Context) error {
+	req := struct {
+		UserToken string                   `json:"userToken"`
+		Items     []*internal.HoldItem     `json:"items"`
+		Seats     []*internal.SeatPurchase `json:"seats"`
+	}{}
+
+	err := c.Bind(&req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+	if req.UserToken == "" || (len(req.Items) == 0 && len(req.Seats) == 0) {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+
+	u, err := app.models.user.GetUserBySession(&req.UserToken)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.JSON(http.StatusUnauthorized, "not authorized")
+		}
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+
+	hold, err := app.models.holds.CreateHold(u.Id, &req.UserToken, req.Items, req.Seats, app.config.holdTTL)
+	if err != nil {
+		return app.purchaseError(c, err)
+	}
+	return c.JSON(http.StatusOK, hold)
+}
+
+func (app *Application) ConfirmHold(c echo.Context) error {
+	req := struct {
+		UserToken string  `json:"userToken"`
+		HoldId    *int    `json:"holdId"`
+		PromoCode *string `json:"promoCode"`
+	}{}
+
+	err := c.Bind(&req)
+	if err != nil || req.UserToken == "" || req.HoldId == nil {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+
+	u, err := app.models.user.GetUserBySession(&req.UserToken)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.JSON(http.StatusUnauthorized, "not authorized")
+		}
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+
+	order, err := app.models.orders.CreateOrderFromHold(req.HoldId, u.Id, &req.UserToken, req.PromoCode)
+	if err != nil {
+		return app.purchaseError(c, err)
+	}
+	return app.checkout(c, order)
+}
+
+func (app *Application) ReleaseHold(c echo.Context) error {
+	req := struct {
+		UserToken string `json:"userToken"`
+		HoldId    *int   `json:"holdId"`
+	}{}
+
+	err := c.Bind(&req)
+	if err != nil || req.UserToken == "" || req.HoldId == nil {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+
+	u, err := app.models.user.GetUserBySession(&req.UserToken)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.JSON(http.StatusUnauthorized, "not authorized")
+		}
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+
+	err = app.models.holds.ReleaseHold(req.HoldId, u.Id, &req.UserToken)
+	if err != nil {
+		return app.purchaseError(c, err)
+	}
+	return c.JSON(http.StatusOK, "ok")
+}
@@ -1,7 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"io"
+	"net/http"
+	"strconv"
+	"tap2go/internal"
 )
 
 func (app *Application) AddMiddleware() {
@@ -20,3 +31,128 @@ func (app *Application) AddMiddleware() {
 	app.server.Use(middleware.Secure())
 
 }
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyWriter keeps a copy of the response so it can be stored.
+type idempotencyWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *idempotencyWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// Idempotent makes retries of a request carrying an Idempotency-Key header
+// safe. The first response for a key and sender is stored and replayed to
+// retries, the same key with another request is rejected. Requests without
+// the header, or whose sender isn't signed in, pass through untouched.
+func (app *Application) Idempotent(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			return next(c)
+		}
+		if len(key) > 255 {
+			return c.JSON(http.StatusBadRequest, "invalid idempotency key")
+		}
+
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, "invalid request")
+		}
+		c.Request().Body = io.NopCloser(bytes.NewReader(body))
+
+		scope := app.idempotencyScope(c, body)
+		if scope == "" {
+			return next(c)
+		}
+
+		res, err := app.models.idempotency.Claim(scope, key, requestHash(c.Request(), body))
+		if err != nil {
+			switch {
+			case errors.Is(err, internal.ErrIdempotencyKeyReused):
+				return c.JSON(http.StatusUnprocessableEntity, err.Error())
+			case errors.Is(err, internal.ErrIdempotencyKeyInProgress):
+				return c.JSON(http.StatusConflict, err.Error())
+			}
+			fmt.Println(err.Error())
+			return c.JSON(http.StatusInternalServerError, "internal server error")
+		}
+		if res != nil {
+			c.Response().Header().Set("Idempotent-Replayed", "true")
+			return c.Blob(res.StatusCode, res.ContentType, res.Body)
+		}
+
+		// A panicking handler must not leave the key in progress until it expires
+		defer func() {
+			if p := recover(); p != nil {
+				app.models.idempotency.Forget(scope, key)
+				panic(p)
+			}
+		}()
+
+		w := &idempotencyWriter{ResponseWriter: c.Response().Writer}
+		c.Response().Writer = w
+		err = next(c)
+		if err != nil {
+			c.Error(err)
+		}
+
+		// Server errors didn't change anything the client can rely on, the
+		// retry runs the request again
+		status := c.Response().Status
+		if status >= http.StatusInternalServerError {
+			err = app.models.idempotency.Forget(scope, key)
+		} else {
+			err = app.models.idempotency.Save(scope, key, &internal.StoredResponse{
+				StatusCode:  status,
+				ContentType: c.Response().Header().Get(echo.HeaderContentType),
+				Body:        w.body.Bytes(),
+			})
+		}
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+		return nil
+	}
+}
+
+// idempotencyScope identifies the sender by the userToken of the body or
+// the admin token of the query.
+func (app *Application) idempotencyScope(c echo.Context, body []byte) string {
+	req := struct {
+		UserToken string `json:"userToken"`
+	}{}
+	if json.Unmarshal(body, &req) == nil && req.UserToken != "" {
+		u, err := app.models.user.GetUserBySession(&req.UserToken)
+		if err == nil && u.Id != nil {
+			return "user:" + strconv.Itoa(*u.Id)
+		}
+		return ""
+	}
+	if token := c.QueryParam("token"); token != "" {
+		adminId, err := app.models.admin.EnsureSession(&token)
+		if err == nil && adminId != nil {
+			return "admin:" + strconv.Itoa(*adminId)
+		}
+	}
+	return ""
+}
+
+// requestHash fingerprints the method, path and body. JSON bodies are
+// compared by content, key order and whitespace don't matter.
+func requestHash(r *http.Request, body []byte) string {
+	var v interface{}
+	if json.Unmarshal(body, &v) == nil {
+		if canonical, err := json.Marshal(v); err == nil {
+			body = canonical
+		}
+	}
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+	"tap2go/internal"
+)
+
+func (app *Application) CreateOrder(c echo.Context) error {
+	req := struct {
+		UserToken string                   `json:"userToken"`
+		Items     []*internal.HoldItem     `json:"items"`
+		Seats     []*internal.SeatPurchase `json:"seats"`
+		PromoCode *string                  `json:"promoCode"`
+	}{}
+
+	err := c.Bind(&req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+	if req.UserToken == "" || (len(req.Items) == 0 && len(req.Seats) == 0) {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+
+	u, err := app.models.user.GetUserBySession(&req.UserToken)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.JSON(http.StatusUnauthorized, "not authorized")
+		}
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+
+	order, err := app.models.orders.CreateOrder(u.Id, &req.UserToken, req.Items, req.Seats, req.PromoCode, app.config.holdTTL)
+	if err != nil {
+		return app.purchaseError(c, err)
+	}
+
+	return app.checkout(c, order)
+}
+
+func (app *Application) GetOrder(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid id")
+	}
+	token := c.QueryParam("token")
+	if token == "" {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+
+	u, err := app.models.user.GetUserBySession(&token)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.JSON(http.StatusUnauthorized, "not authorized")
+		}
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+
+	order, err := app.models.orders.GetOrder(&id)
+	if err != nil {
+		if errors.Is(err, internal.ErrOrderNotFound) {
+			return c.JSON(http.StatusNotFound, "order not found")
+		}
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	if *order.UserId != *u.Id {
+		return c.JSON(http.StatusNotFound, "order not found")
+	}
+	return c.JSON(http.StatusOK, order)
+}
+
+func (app *Application) GetUserOrders(c echo.Context) error {
+	token := c.QueryParam("token")
+	if token == "" {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+
+	u, err := app.models.user.GetUserBySession(&token)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.JSON(http.StatusUnauthorized, "not authorized")
+		}
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+
+	orders, err := app.models.orders.GetOrdersByUser(u.Id)
+	if err != nil {
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, orders)
+}
+
+// QuoteOrder returns the price breakdown of an order with a promo code
+// applied, nothing is reserved.
+func (app *Application) QuoteOrder(c echo.Context) error {
+	req := struct {
+		UserToken string                   `json:"userToken"`
+		Items     []*internal.HoldItem     `json:"items"`
+		Seats     []*internal.SeatPurchase `json:"seats"`
+		PromoCode *string                  `json:"promoCode"`
+	}{}
+
+	err := c.Bind(&req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+	if req.UserToken == "" || (len(req.Items) == 0 && len(req.Seats) == 0) {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+
+	u, err := app.models.user.GetUserBySession(&req.UserToken)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.JSON(http.StatusUnauthorized, "not authorized")
+		}
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+
+	quote, err := app.models.orders.QuoteOrder(u.Id, req.Items, req.Seats, req.PromoCode)
+	if err != nil {
+		return app.purchaseError(c, err)
+	}
+	return c.JSON(http.StatusOK, quote)
+}
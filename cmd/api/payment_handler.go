@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"io"
+	"net/http"
+	"tap2go/internal"
+)
+
+// settler is implemented by providers that settle an intent on their own once
+// its payment is stored, like the fake gateway.
+type settler interface {
+	Settle(intentId string)
+}
+
+// checkout opens a payment intent for a freshly placed order. The order stays
+// pending until the provider confirms the payment through the webhook.
+func (app *Application) checkout(c echo.Context, order *internal.Order) error {
+	intent, err := app.payments.CreateIntent(*order.Id, *order.Total)
+	if err != nil {
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusBadGateway, "payment provider error")
+	}
+	payment, err := app.models.payments.CreatePayment(intent)
+	if err != nil {
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	if s, ok := app.payments.(settler); ok {
+		s.Settle(*intent.Id)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"order": order, "payment": payment, "intent": intent})
+}
+
+func (app *Application) PaymentWebhook(c echo.Context) error {
+	provider := c.Param("provider")
+	if provider != app.payments.Name() {
+		return c.JSON(http.StatusNotFound, "unknown provider")
+	}
+	payload, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+	event, err := app.payments.VerifyWebhook(payload, c.Request().Header)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "invalid signature")
+	}
+
+	switch event.Status {
+	case internal.PaymentStatusSucceeded:
+		err = app.payments.Capture(event.IntentId)
+		if err != nil {
+			fmt.Println(err.Error())
+			return c.JSON(http.StatusBadGateway, "payment provider error")
+		}
+		payment, err := app.models.payments.CompletePayment(&provider, &event.IntentId)
+		if err != nil {
+			return app.paymentError(c, err)
+		}
+		if *payment.Status == internal.PaymentStatusRefundDue {
+			// The order expired or was cancelled before the money arrived, a
+			// failed refund is retried with the next callback
+			_, err = app.models.payments.RefundUnpaidPayment(app.payments, &event.IntentId)
+			if err != nil {
+				fmt.Println(err.Error())
+				return c.JSON(http.StatusBadGateway, "payment provider error")
+			}
+		}
+	case internal.PaymentStatusFailed:
+		_, err = app.models.payments.FailPayment(&provider, &event.IntentId)
+		if err != nil {
+			return app.paymentError(c, err)
+		}
+	default:
+		return c.JSON(http.StatusBadRequest, internal.ErrUnknownPaymentEvent.Error())
+	}
+	return c.JSON(http.StatusOK, "ok")
+}
+
+func (app *Application) paymentError(c echo.Context, err error) error {
+	if errors.Is(err, internal.ErrPaymentNotFound) {
+		return c.JSON(http.StatusNotFound, "payment not found")
+	}
+	fmt.Println(err.Error())
+	return c.JSON(http.StatusInternalServerError, "internal server error")
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"tap2go/internal"
+)
+
+func (app *Application) CreatePromoCode(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	adminId, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+
+	req := internal.PromoCode{}
+	err = c.Bind(&req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+	req.AdminId = adminId
+
+	promo, err := app.models.promos.CreatePromoCode(&req)
+	if err != nil {
+		switch {
+		case errors.Is(err, internal.ErrPromoInvalid), isMoneyError(err):
+			return c.JSON(http.StatusBadRequest, err.Error())
+		case errors.Is(err, internal.ErrPromoCodeTaken):
+			return c.JSON(http.StatusConflict, err.Error())
+		}
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, promo)
+}
+
+func (app *Application) GetPromoCodes(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	_, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+
+	codes, err := app.models.promos.GetPromoCodes()
+	if err != nil {
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, codes)
+}
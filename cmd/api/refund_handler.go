@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+	"tap2go/internal"
+)
+
+func (app *Application) RefundOrder(c echo.Context) error {
+	req := struct {
+		UserToken string `json:"userToken"`
+		internal.RefundRequest
+	}{}
+
+	err := c.Bind(&req)
+	if err != nil || req.UserToken == "" || req.OrderId == nil {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+
+	u, err := app.models.user.GetUserBySession(&req.UserToken)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.JSON(http.StatusUnauthorized, "not authorized")
+		}
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+
+	req.RefundRequest.UserId = u.Id
+	refund, err := app.models.refunds.RefundOrder(&req.RefundRequest, app.payments)
+	return app.refundResponse(c, refund, err)
+}
+
+func (app *Application) AdminRefundOrder(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	adminId, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+
+	req := internal.RefundRequest{}
+	err = c.Bind(&req)
+	if err != nil || req.OrderId == nil {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+
+	req.AdminId = adminId
+	refund, err := app.models.refunds.RefundOrder(&req, app.payments)
+	return app.refundResponse(c, refund, err)
+}
+
+func (app *Application) GetOrderRefunds(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid id")
+	}
+	token := c.QueryParam("token")
+	if token == "" {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+
+	u, err := app.models.user.GetUserBySession(&token)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.JSON(http.StatusUnauthorized, "not authorized")
+		}
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+
+	order, err := app.models.orders.GetOrder(&id)
+	if err != nil {
+		if errors.Is(err, internal.ErrOrderNotFound) {
+			return c.JSON(http.StatusNotFound, "order not found")
+		}
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	if *order.UserId != *u.Id {
+		return c.JSON(http.StatusNotFound, "order not found")
+	}
+
+	refunds, err := app.models.refunds.GetRefundsByOrder(&id)
+	if err != nil {
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, refunds)
+}
+
+// refundResponse answers a refund request. A refund recorded while the
+// provider failed is accepted, it is sent again in the background.
+func (app *Application) refundResponse(c echo.Context, refund *internal.Refund, err error) error {
+	if err != nil {
+		if refund != nil {
+			fmt.Println(err.Error())
+			return c.JSON(http.StatusAccepted, refund)
+		}
+		return app.refundError(c, err)
+	}
+	return c.JSON(http.StatusOK, refund)
+}
+
+func (app *Application) refundError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, internal.ErrOrderNotFound):
+		return c.JSON(http.StatusNotFound, "order not found")
+	case errors.Is(err, internal.ErrRefundReasonRequired):
+		return c.JSON(http.StatusBadRequest, "refund reason is required")
+	case errors.Is(err, internal.ErrRefundTicketsRequired), errors.Is(err, internal.ErrTicketNotRefundable):
+		return c.JSON(http.StatusBadRequest, "tickets can't be refunded")
+	case errors.Is(err, internal.ErrOrderNotPaid):
+		return c.JSON(http.StatusConflict, "order is not paid")
+	case errors.Is(err, internal.ErrRefundsNotAllowed):
+		return c.JSON(http.StatusForbidden, "event doesn't allow refunds")
+	case errors.Is(err, internal.ErrRefundWindowClosed):
+		return c.JSON(http.StatusForbidden, "refund window is closed")
+	case errors.Is(err, internal.ErrPaymentNotRefundable):
+		return c.JSON(http.StatusConflict, "order has no refundable payment")
+	}
+	fmt.Println(err.Error())
+	return c.JSON(http.StatusInternalServerError, "internal server error")
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+	"tap2go/internal"
+	"time"
+)
+
+var errInvalidReportFilter = errors.New("invalid report filter")
+
+func (app *Application) GetSalesReport(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	_, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+	f, err := reportFilter(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	report, err := app.models.reports.GetSalesReport(f)
+	if err != nil {
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+// GetDailySales returns the daily series, days are counted in the tz query
+// parameter, UTC by default.
+func (app *Application) GetDailySales(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	_, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+	f, err := reportFilter(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	loc := time.UTC
+	if tz := c.QueryParam("tz"); tz != "" {
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, "invalid tz")
+		}
+	}
+
+	series, err := app.models.reports.GetDailySales(f, loc)
+	if err != nil {
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, series)
+}
+
+func (app *Application) ExportTicketsCSV(c echo.Context) error {
+	return app.exportTickets(c, "csv")
+}
+
+func (app *Application) ExportTicketsXLSX(c echo.Context) error {
+	return app.exportTickets(c, "xlsx")
+}
+
+func (app *Application) exportTickets(c echo.Context, format string) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	_, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+	f, err := reportFilter(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	tickets, err := app.models.reports.GetReportTickets(f)
+	if err != nil {
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+
+	var body []byte
+	var contentType string
+	switch format {
+	case "csv":
+		var buf bytes.Buffer
+		// A BOM makes Excel read the file as UTF-8
+		buf.WriteString("\ufeff")
+		err = internal.WriteTicketsCSV(&buf, tickets)
+		body, contentType = buf.Bytes(), "text/csv; charset=utf-8"
+	default:
+		body, err = internal.TicketsXLSX(tickets)
+		contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="tickets.%s"`, format))
+	return c.Blob(http.StatusOK, contentType, body)
+}
+
+// reportFilter reads from, to, eventId and venueId from the query. Dates are
+// RFC 3339 or plain days, a plain to day is included.
+func reportFilter(c echo.Context) (*internal.ReportFilter, error) {
+	f := internal.ReportFilter{}
+	for _, p := range []struct {
+		name string
+		dst  **time.Time
+		day  int
+	}{{"from", &f.From, 0}, {"to", &f.To, 1}} {
+		v := c.QueryParam(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			t, err = time.Parse("2006-01-02", v)
+			if err != nil {
+				return nil, errInvalidReportFilter
+			}
+			t = t.AddDate(0, 0, p.day)
+		}
+		*p.dst = &t
+	}
+	for _, p := range []struct {
+		name string
+		dst  **int
+	}{{"eventId", &f.EventId}, {"venueId", &f.VenueId}} {
+		v := c.QueryParam(p.name)
+		if v == "" {
+			continue
+		}
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errInvalidReportFilter
+		}
+		*p.dst = &id
+	}
+	return &f, nil
+}
@@ -20,6 +20,30 @@ func (app *Application) AddRoutes() {
 	adminRoutes.DELETE("/logout", app.AdminLogout)
 	adminRoutes.GET("/user-admin/:token", app.GetAdmin)
 	adminRoutes.POST("/type/create", app.CreateEventType)
+	adminRoutes.POST("/order/refund", app.AdminRefundOrder, app.Idempotent)
+	adminRoutes.POST("/checkin/scan", app.ScanTicket)
+	adminRoutes.GET("/checkin/attendance/:eventId", app.GetAttendance)
+	adminRoutes.POST("/promo", app.CreatePromoCode)
+	adminRoutes.GET("/promo", app.GetPromoCodes)
+	adminRoutes.POST("/purchase-limit", app.SetPurchaseLimit)
+	adminRoutes.POST("/ticket-type/:id/amount", app.SetTicketTypeAmount)
+	adminRoutes.POST("/seat-map", app.CreateSeatMapTemplate)
+	adminRoutes.GET("/seat-map/venue/:venueId", app.GetSeatMapTemplatesByVenue)
+	adminRoutes.GET("/seat-map/:id", app.GetSeatMapTemplate)
+	adminRoutes.POST("/seat-map/:id/event-days", app.CreateEventDaysFromTemplate)
+	adminRoutes.GET("/report/sales", app.GetSalesReport)
+	adminRoutes.GET("/report/sales/daily", app.GetDailySales)
+	adminRoutes.GET("/report/tickets.csv", app.ExportTicketsCSV)
+	adminRoutes.GET("/report/tickets.xlsx", app.ExportTicketsXLSX)
+	adminRoutes.PATCH("/event/:id", app.UpdateEvent)
+	adminRoutes.DELETE("/event/:id", app.DeleteEvent)
+	adminRoutes.POST("/event/:id/restore", app.RestoreEvent)
+	adminRoutes.POST("/event/:id/status", app.SetEventStatus)
+	adminRoutes.GET("/event/page", app.GetAdminEventPagination)
+	adminRoutes.POST("/schedule", app.CreateSchedule)
+	adminRoutes.GET("/schedule/event/:eventId", app.GetSchedulesByEvent)
+	adminRoutes.POST("/schedule/:id/extend", app.ExtendSchedule)
+	adminRoutes.POST("/schedule/:id/exdates", app.AddScheduleExceptionDates)
 
 	usersRoutes := version.Group("/user")
 	usersRoutes.POST("/register", app.CreateUser)
@@ -32,6 +56,8 @@ func (app *Application) AddRoutes() {
 
 	eventRoutes := version.Group("/event")
 	eventRoutes.GET("/page", app.GetEventPagination)
+	eventRoutes.GET("/search", app.SearchEvents)
+	eventRoutes.GET("/autocomplete", app.Autocomplete)
 	eventRoutes.POST("/create", app.CreateEvent)
 	eventRoutes.POST("/images/upload", app.UploadImages)
 
@@ -61,11 +87,41 @@ func (app *Application) AddRoutes() {
 	newsRoutes.POST("", app.CreateNews)
 
 	eventRoutes.POST("/tickets/upload", app.UploadTicketsNoShah)
+	eventRoutes.POST("/tickets/tiers", app.SetPriceTiers)
 	eventRoutes.POST("/tickets-shah/upload", app.UploadTicketsWithShah)
 	eventRoutes.POST("/tickets-shah/decor", app.UploadDecorWithShah)
 
 	ticketRoutes := version.Group("/ticket")
-	ticketRoutes.POST("/buy", app.BuyTicketNoShah)
+	ticketRoutes.POST("/buy", app.BuyTicketNoShah, app.Idempotent)
+	ticketRoutes.POST("/buy-shah", app.BuySeatsShah, app.Idempotent)
+	ticketRoutes.POST("/hold", app.CreateHold, app.Idempotent)
+	ticketRoutes.POST("/hold/confirm", app.ConfirmHold, app.Idempotent)
+	ticketRoutes.POST("/hold/release", app.ReleaseHold)
 	ticketRoutes.POST("/venue/dates", app.ReadDatesForEventVenue)
 	ticketRoutes.POST("/venue/dates-shah", app.ReadDatesForEventVenueShah)
+	ticketRoutes.GET("/day-shah/:id/seats", app.ReadSeatsForEventDayShah)
+	ticketRoutes.GET("/day-shah/:id/stream", app.StreamAvailabilityShah)
+	ticketRoutes.GET("/day/:id/stream", app.StreamAvailabilityNoShah)
+	ticketRoutes.POST("/waitlist", app.JoinWaitlist)
+	ticketRoutes.POST("/waitlist/leave", app.LeaveWaitlist)
+	ticketRoutes.GET("/waitlist", app.GetUserWaitlist)
+	ticketRoutes.POST("/transfer", app.TransferTicket)
+	ticketRoutes.GET("/transfers", app.GetUserTransfers)
+	ticketRoutes.GET("/public-key", app.GetTicketPublicKey)
+	ticketRoutes.GET("/:kind/:id/code", app.GetTicketCode)
+	ticketRoutes.GET("/:kind/:id/qr.png", app.GetTicketQRPNG)
+	ticketRoutes.GET("/:kind/:id/qr.svg", app.GetTicketQRSVG)
+	ticketRoutes.GET("/:kind/:id/ticket.pdf", app.GetTicketPDF)
+
+	orderRoutes := version.Group("/order")
+	orderRoutes.POST("", app.CreateOrder, app.Idempotent)
+	orderRoutes.POST("/quote", app.QuoteOrder)
+	orderRoutes.GET("/user", app.GetUserOrders)
+	orderRoutes.POST("/refund", app.RefundOrder, app.Idempotent)
+	orderRoutes.GET("/:id", app.GetOrder)
+	orderRoutes.GET("/:id/refunds", app.GetOrderRefunds)
+	orderRoutes.GET("/:id/tickets.pdf", app.GetOrderTicketsPDF)
+
+	paymentRoutes := version.Group("/payment")
+	paymentRoutes.POST("/webhook/:provider", app.PaymentWebhook)
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+	"tap2go/internal"
+	"time"
+)
+
+// CreateSchedule saves a recurring schedule of GA days for an event and
+// venue and generates its days up to until, three months ahead by default.
+func (app *Application) CreateSchedule(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	_, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+	req := struct {
+		internal.EventSchedule
+		Until *time.Time `json:"until"`
+	}{}
+	err = c.Bind(&req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+
+	schedule, dayIds, err := app.models.schedules.CreateSchedule(&req.EventSchedule, req.Until)
+	if err != nil {
+		return app.scheduleError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"schedule": schedule, "dayIds": dayIds})
+}
+
+func (app *Application) GetSchedulesByEvent(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	_, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+	eventId, err := strconv.Atoi(c.Param("eventId"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid id")
+	}
+
+	schedules, err := app.models.schedules.GetSchedulesByEvent(&eventId)
+	if err != nil {
+		return app.scheduleError(c, err)
+	}
+	return c.JSON(http.StatusOK, schedules)
+}
+
+// ExtendSchedule generates the days of a schedule up to until.
+func (app *Application) ExtendSchedule(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	_, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid id")
+	}
+	req := struct {
+		Until *time.Time `json:"until"`
+	}{}
+	err = c.Bind(&req)
+	if err != nil || req.Until == nil {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+
+	dayIds, err := app.models.schedules.ExtendSchedule(&id, *req.Until)
+	if err != nil {
+		return app.scheduleError(c, err)
+	}
+	return c.JSON(http.StatusOK, dayIds)
+}
+
+// AddScheduleExceptionDates skips local days ("2006-01-02") in a schedule,
+// removing the days already generated on them.
+func (app *Application) AddScheduleExceptionDates(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	_, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid id")
+	}
+	req := struct {
+		Dates []string `json:"dates"`
+	}{}
+	err = c.Bind(&req)
+	if err != nil || len(req.Dates) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+
+	err = app.models.schedules.AddExceptionDates(&id, req.Dates)
+	if err != nil {
+		return app.scheduleError(c, err)
+	}
+	return c.JSON(http.StatusOK, "success")
+}
+
+func (app *Application) scheduleError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, internal.ErrScheduleNotFound), errors.Is(err, internal.ErrEventNotFound):
+		return c.JSON(http.StatusNotFound, err.Error())
+	case errors.Is(err, internal.ErrInvalidSchedule), errors.Is(err, internal.ErrInvalidRRule), isMoneyError(err):
+		return c.JSON(http.StatusBadRequest, err.Error())
+	case errors.Is(err, internal.ErrScheduleDayHasTickets):
+		return c.JSON(http.StatusConflict, err.Error())
+	}
+	fmt.Println(err.Error())
+	return c.JSON(http.StatusInternalServerError, "internal server error")
+}
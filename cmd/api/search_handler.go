@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+	"tap2go/internal"
+	"time"
+)
+
+var (
+	errInvalidSearchFilter        = errors.New("invalid search filter")
+	errSearchPriceWithoutCurrency = errors.New("currency is required with minPrice or maxPrice")
+)
+
+// SearchEvents is the catalog search. q is the text to look for, genre,
+// typeId and venueId may repeat and match any of the given values, from and
+// to take RFC 3339 times or plain days, minPrice and maxPrice bound the
+// lowest current ticket price in minor units of currency, which they require,
+// and maxAge keeps events with at most that age restriction.
+func (app *Application) SearchEvents(c echo.Context) error {
+	s, err := eventSearch(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	result, err := app.models.event.SearchEvents(s)
+	if err != nil {
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+func eventSearch(c echo.Context) (*internal.EventSearch, error) {
+	s := internal.EventSearch{Page: 1}
+	if q := c.QueryParam("q"); q != "" {
+		s.Query = &q
+	}
+	params := c.QueryParams()
+	s.Genres = params["genre"]
+	for _, p := range []struct {
+		name string
+		dst  *[]int
+	}{{"typeId", &s.TypeIds}, {"venueId", &s.VenueIds}} {
+		for _, v := range params[p.name] {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, errInvalidSearchFilter
+			}
+			*p.dst = append(*p.dst, id)
+		}
+	}
+	for _, p := range []struct {
+		name string
+		dst  **time.Time
+		day  int
+	}{{"from", &s.From, 0}, {"to", &s.To, 1}} {
+		v := c.QueryParam(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			t, err = time.Parse("2006-01-02", v)
+			if err != nil {
+				return nil, errInvalidSearchFilter
+			}
+			t = t.AddDate(0, 0, p.day)
+		}
+		*p.dst = &t
+	}
+	for _, p := range []struct {
+		name string
+		dst  **int64
+	}{{"minPrice", &s.MinPrice}, {"maxPrice", &s.MaxPrice}} {
+		v := c.QueryParam(p.name)
+		if v == "" {
+			continue
+		}
+		amount, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || amount < 0 {
+			return nil, errInvalidSearchFilter
+		}
+		*p.dst = &amount
+	}
+	if currency := c.QueryParam("currency"); currency != "" {
+		if !internal.ValidCurrency(currency) {
+			return nil, internal.ErrUnsupportedCurrency
+		}
+		s.Currency = &currency
+	}
+	if (s.MinPrice != nil || s.MaxPrice != nil) && s.Currency == nil {
+		return nil, errSearchPriceWithoutCurrency
+	}
+	if v := c.QueryParam("maxAge"); v != "" {
+		age, err := strconv.Atoi(v)
+		if err != nil || age < 0 {
+			return nil, errInvalidSearchFilter
+		}
+		s.MaxAgeRestriction = &age
+	}
+	if v := c.QueryParam("page"); v != "" {
+		page, err := strconv.Atoi(v)
+		if err != nil || page < 1 {
+			return nil, errInvalidSearchFilter
+		}
+		s.Page = page
+	}
+	return &s, nil
+}
+
+const (
+	autocompleteDefaultLimit = 10
+	autocompleteMaxLimit     = 20
+)
+
+// Autocomplete suggests events, venues, genres and event types for the text
+// in q. Fewer than two characters suggest nothing.
+func (app *Application) Autocomplete(c echo.Context) error {
+	limit := autocompleteDefaultLimit
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return c.JSON(http.StatusBadRequest, "invalid limit")
+		}
+		limit = min(n, autocompleteMaxLimit)
+	}
+	suggestions, err := app.models.event.Autocomplete(c.QueryParam("q"), limit)
+	if err != nil {
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, suggestions)
+}
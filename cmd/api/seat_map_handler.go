@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+	"tap2go/internal"
+	"time"
+)
+
+func (app *Application) CreateSeatMapTemplate(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	adminId, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+
+	req := internal.SeatMapTemplate{}
+	err = c.Bind(&req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+	req.AdminId = adminId
+
+	template, err := app.models.seatMaps.CreateTemplate(&req)
+	if err != nil {
+		return app.seatMapError(c, err)
+	}
+	return c.JSON(http.StatusOK, template)
+}
+
+func (app *Application) GetSeatMapTemplatesByVenue(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	_, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+	venueId, err := strconv.Atoi(c.Param("venueId"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid id")
+	}
+
+	templates, err := app.models.seatMaps.GetTemplatesByVenue(&venueId)
+	if err != nil {
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, templates)
+}
+
+func (app *Application) GetSeatMapTemplate(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	_, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid id")
+	}
+
+	template, err := app.models.seatMaps.GetTemplate(&id)
+	if err != nil {
+		return app.seatMapError(c, err)
+	}
+	return c.JSON(http.StatusOK, template)
+}
+
+// CreateEventDaysFromTemplate creates seated days of an event from a venue
+// template, optionally with event specific sector prices.
+func (app *Application) CreateEventDaysFromTemplate(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	_, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid id")
+	}
+	req := struct {
+		EventId *int                    `json:"eventId"`
+		Dates   []*time.Time            `json:"dates"`
+		Prices  []*internal.SectorPrice `json:"prices"`
+	}{}
+	err = c.Bind(&req)
+	if err != nil || req.EventId == nil {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+
+	dayIds, err := app.models.seatMaps.CreateEventDaysFromTemplate(req.EventId, &id, req.Dates, req.Prices)
+	if err != nil {
+		return app.seatMapError(c, err)
+	}
+	return c.JSON(http.StatusOK, dayIds)
+}
+
+func (app *Application) seatMapError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, internal.ErrSeatMapTemplateNotFound):
+		return c.JSON(http.StatusNotFound, "seat map template not found")
+	case errors.Is(err, internal.ErrInvalidSeatMapTemplate), errors.Is(err, internal.ErrUnknownSector),
+		errors.Is(err, internal.ErrSeatMapDateRequired):
+		return c.JSON(http.StatusBadRequest, err.Error())
+	case isMoneyError(err):
+		return c.JSON(http.StatusBadRequest, err.Error())
+	case errors.Is(err, internal.ErrEventNotFound):
+		return c.JSON(http.StatusNotFound, err.Error())
+	case errors.Is(err, internal.ErrSeatMapInUse):
+		return c.JSON(http.StatusConflict, err.Error())
+	}
+	fmt.Println(err.Error())
+	return c.JSON(http.StatusInternalServerError, "internal server error")
+}
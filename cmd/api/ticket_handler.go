@@ -1,15 +1,22 @@
 package main
 
 import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
 	"github.com/labstack/echo/v4"
 	"net/http"
+	"strconv"
+	"tap2go/internal"
 )
 
 func (app *Application) BuyTicketNoShah(c echo.Context) error {
 	req := struct {
-		UserToken    string `json:"userToken"`
-		TicketTypeId *int   `json:"ticketTypeId"`
-		Count        *int   `json:"count"`
+		UserToken    string  `json:"userToken"`
+		TicketTypeId *int    `json:"ticketTypeId"`
+		Count        *int    `json:"count"`
+		PromoCode    *string `json:"promoCode"`
 	}{}
 
 	err := c.Bind(&req)
@@ -17,21 +24,55 @@ func (app *Application) BuyTicketNoShah(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, "invalid request")
 	}
 
-	if req.UserToken == "" || req.TicketTypeId == nil || req.Count == nil {
+	if req.UserToken == "" || req.TicketTypeId == nil || req.Count == nil || *req.Count <= 0 {
 		return c.JSON(http.StatusBadRequest, "invalid request")
 	}
 
 	u, err := app.models.user.GetUserBySession(&req.UserToken)
 	if err != nil {
-
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.JSON(http.StatusUnauthorized, "not authorized")
+		}
 		return c.JSON(http.StatusInternalServerError, "internal server error")
 	}
 
-	result, err := app.models.tickets.BuyTicketNoShah(req.TicketTypeId, u.Id, req.Count)
+	items := []*internal.HoldItem{{TicketTypeId: req.TicketTypeId, Count: req.Count}}
+	order, err := app.models.orders.CreateOrder(u.Id, &req.UserToken, items, nil, req.PromoCode, app.config.holdTTL)
+	if err != nil {
+		return app.purchaseError(c, err)
+	}
+	return app.checkout(c, order)
+}
+
+func (app *Application) BuySeatsShah(c echo.Context) error {
+	req := struct {
+		UserToken string                   `json:"userToken"`
+		Seats     []*internal.SeatPurchase `json:"seats"`
+		PromoCode *string                  `json:"promoCode"`
+	}{}
+
+	err := c.Bind(&req)
 	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+
+	if req.UserToken == "" || len(req.Seats) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+
+	u, err := app.models.user.GetUserBySession(&req.UserToken)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.JSON(http.StatusUnauthorized, "not authorized")
+		}
 		return c.JSON(http.StatusInternalServerError, "internal server error")
 	}
-	return c.JSON(http.StatusOK, result)
+
+	order, err := app.models.orders.CreateOrder(u.Id, &req.UserToken, nil, req.Seats, req.PromoCode, app.config.holdTTL)
+	if err != nil {
+		return app.purchaseError(c, err)
+	}
+	return app.checkout(c, order)
 }
 
 func (app *Application) ReadDatesForEventVenue(c echo.Context) error {
@@ -67,3 +108,208 @@ func (app *Application) ReadDatesForEventVenueShah(c echo.Context) error {
 	}
 	return c.JSON(http.StatusOK, result)
 }
+
+func (app *Application) ReadSeatsForEventDayShah(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid id")
+	}
+	result, err := app.models.tickets.GetSeatsForEventDay(&id)
+	if err != nil {
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+func (app *Application) purchaseError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, internal.ErrInvalidTicketsCount):
+		return c.JSON(http.StatusBadRequest, "invalid items")
+	case errors.Is(err, internal.ErrTicketTypeNotFound):
+		return c.JSON(http.StatusNotFound, "ticket type not found")
+	case errors.Is(err, internal.ErrNoTicketsAvailable):
+		return c.JSON(http.StatusConflict, "no tickets available")
+	case errors.Is(err, internal.ErrEventNotOnSale):
+		return c.JSON(http.StatusConflict, "event is not on sale")
+	case errors.Is(err, internal.ErrSeatNotFound):
+		return c.JSON(http.StatusNotFound, "seat not found")
+	case errors.Is(err, internal.ErrSeatTypeMismatch):
+		return c.JSON(http.StatusBadRequest, "ticket type is not available for seat")
+	case errors.Is(err, internal.ErrSeatAlreadySold):
+		return c.JSON(http.StatusConflict, "seat already sold")
+	case errors.Is(err, internal.ErrSeatHeld):
+		return c.JSON(http.StatusConflict, "seat is held by another buyer")
+	case errors.Is(err, internal.ErrHoldNotFound):
+		return c.JSON(http.StatusNotFound, "hold not found")
+	case errors.Is(err, internal.ErrHoldNotActive):
+		return c.JSON(http.StatusConflict, "hold is not active")
+	case errors.Is(err, internal.ErrHoldExpired):
+		return c.JSON(http.StatusGone, "hold expired")
+	case errors.Is(err, internal.ErrOrderNotFound):
+		return c.JSON(http.StatusNotFound, "order not found")
+	case errors.Is(err, internal.ErrOrderNotPending):
+		return c.JSON(http.StatusConflict, "order is not pending")
+	case errors.Is(err, internal.ErrOrderMixedEvents):
+		return c.JSON(http.StatusBadRequest, "order items belong to different events")
+	case errors.Is(err, internal.ErrPurchaseLimitExceeded):
+		return c.JSON(http.StatusConflict, "purchase limit exceeded")
+	case errors.Is(err, internal.ErrPromoNotFound):
+		return c.JSON(http.StatusNotFound, "promo code not found")
+	case errors.Is(err, internal.ErrPromoNotActive), errors.Is(err, internal.ErrPromoNotApplicable):
+		return c.JSON(http.StatusBadRequest, err.Error())
+	case errors.Is(err, internal.ErrPromoExhausted), errors.Is(err, internal.ErrPromoUserLimit):
+		return c.JSON(http.StatusConflict, err.Error())
+	}
+	fmt.Println(err.Error())
+	return c.JSON(http.StatusInternalServerError, "internal server error")
+}
+
+func (app *Application) GetTicketPublicKey(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"algorithm": "Ed25519",
+		"publicKey": base64.StdEncoding.EncodeToString(app.signer.Public),
+	})
+}
+
+func (app *Application) GetTicketCode(c echo.Context) error {
+	code, ok, err := app.ticketCode(c)
+	if !ok {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"code": code})
+}
+
+func (app *Application) GetTicketQRPNG(c echo.Context) error {
+	code, ok, err := app.ticketCode(c)
+	if !ok {
+		return err
+	}
+	png, err := internal.TicketQRPNG(code)
+	if err != nil {
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.Blob(http.StatusOK, "image/png", png)
+}
+
+func (app *Application) GetTicketQRSVG(c echo.Context) error {
+	code, ok, err := app.ticketCode(c)
+	if !ok {
+		return err
+	}
+	svg, err := internal.TicketQRSVG(code)
+	if err != nil {
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.Blob(http.StatusOK, "image/svg+xml", svg)
+}
+
+// ticketCode signs the code of the ticket in the path for its owner. When ok
+// is false the error response is already written and err is the result of
+// writing it, the caller must return it without writing anything else.
+func (app *Application) ticketCode(c echo.Context) (code string, ok bool, err error) {
+	kind := c.Param("kind")
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return "", false, c.JSON(http.StatusBadRequest, "invalid id")
+	}
+	token := c.QueryParam("token")
+	if token == "" {
+		return "", false, c.JSON(http.StatusBadRequest, "invalid token")
+	}
+
+	u, err := app.models.user.GetUserBySession(&token)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", false, c.JSON(http.StatusUnauthorized, "not authorized")
+		}
+		return "", false, c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+
+	raw, err := app.models.tickets.GetTicketCode(kind, &id, u.Id)
+	if err != nil {
+		switch {
+		case errors.Is(err, internal.ErrInvalidTicketKind):
+			return "", false, c.JSON(http.StatusBadRequest, "invalid ticket kind")
+		case errors.Is(err, internal.ErrTicketNotFound):
+			return "", false, c.JSON(http.StatusNotFound, "ticket not found")
+		}
+		fmt.Println(err.Error())
+		return "", false, c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return app.signer.Sign(raw), true, nil
+}
+
+func (app *Application) GetTicketPDF(c echo.Context) error {
+	kind := c.Param("kind")
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid id")
+	}
+	token := c.QueryParam("token")
+	if token == "" {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+
+	u, err := app.models.user.GetUserBySession(&token)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.JSON(http.StatusUnauthorized, "not authorized")
+		}
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+
+	ticket, err := app.models.tickets.GetPrintableTicket(kind, &id, u.Id)
+	if err != nil {
+		switch {
+		case errors.Is(err, internal.ErrInvalidTicketKind):
+			return c.JSON(http.StatusBadRequest, "invalid ticket kind")
+		case errors.Is(err, internal.ErrTicketNotFound):
+			return c.JSON(http.StatusNotFound, "ticket not found")
+		}
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return app.ticketsPDF(c, fmt.Sprintf("ticket-%s-%d.pdf", kind, id), []*internal.PrintableTicket{ticket})
+}
+
+func (app *Application) GetOrderTicketsPDF(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid id")
+	}
+	token := c.QueryParam("token")
+	if token == "" {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+
+	u, err := app.models.user.GetUserBySession(&token)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.JSON(http.StatusUnauthorized, "not authorized")
+		}
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+
+	tickets, err := app.models.tickets.GetPrintableOrderTickets(&id, u.Id)
+	if err != nil {
+		if errors.Is(err, internal.ErrTicketNotFound) {
+			return c.JSON(http.StatusNotFound, "order has no issued tickets")
+		}
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return app.ticketsPDF(c, fmt.Sprintf("order-%d-tickets.pdf", id), tickets)
+}
+
+func (app *Application) ticketsPDF(c echo.Context, filename string, tickets []*internal.PrintableTicket) error {
+	pdf, err := internal.TicketsPDF(tickets, app.signer)
+	if err != nil {
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s"`, filename))
+	return c.Blob(http.StatusOK, "application/pdf", pdf)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"tap2go/internal"
+)
+
+func (app *Application) TransferTicket(c echo.Context) error {
+	req := struct {
+		UserToken string `json:"userToken"`
+		internal.TicketTransferRequest
+	}{}
+
+	err := c.Bind(&req)
+	if err != nil || req.UserToken == "" || req.TicketId == nil {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+
+	u, err := app.models.user.GetUserBySession(&req.UserToken)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.JSON(http.StatusUnauthorized, "not authorized")
+		}
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+
+	req.FromUserId = u.Id
+	transfer, err := app.models.transfers.TransferTicket(&req.TicketTransferRequest, app.config.transferCutoff)
+	if err != nil {
+		switch {
+		case errors.Is(err, internal.ErrRecipientRequired), errors.Is(err, internal.ErrInvalidTicketKind):
+			return c.JSON(http.StatusBadRequest, err.Error())
+		case errors.Is(err, internal.ErrRecipientNotFound), errors.Is(err, internal.ErrTicketNotFound):
+			return c.JSON(http.StatusNotFound, err.Error())
+		case errors.Is(err, internal.ErrTransferToSelf), errors.Is(err, internal.ErrTicketCheckedIn), errors.Is(err, internal.ErrTransferCutoffPast):
+			return c.JSON(http.StatusConflict, err.Error())
+		}
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, transfer)
+}
+
+func (app *Application) GetUserTransfers(c echo.Context) error {
+	token := c.QueryParam("token")
+	if token == "" {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+
+	u, err := app.models.user.GetUserBySession(&token)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.JSON(http.StatusUnauthorized, "not authorized")
+		}
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+
+	transfers, err := app.models.transfers.GetTransfersByUser(u.Id)
+	if err != nil {
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, transfers)
+}
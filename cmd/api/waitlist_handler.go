@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+	"tap2go/internal"
+)
+
+func (app *Application) JoinWaitlist(c echo.Context) error {
+	req := struct {
+		UserToken        string `json:"userToken"`
+		TicketTypeId     *int   `json:"ticketTypeId"`
+		SeatedEventDayId *int   `json:"seatedEventDayId"`
+		Count            *int   `json:"count"`
+	}{}
+
+	err := c.Bind(&req)
+	if err != nil || req.UserToken == "" {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+	count := 1
+	if req.Count != nil {
+		count = *req.Count
+	}
+
+	u, err := app.models.user.GetUserBySession(&req.UserToken)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.JSON(http.StatusUnauthorized, "not authorized")
+		}
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+
+	entry, err := app.models.waitlist.JoinWaitlist(u.Id, req.TicketTypeId, req.SeatedEventDayId, count)
+	if err != nil {
+		switch {
+		case errors.Is(err, internal.ErrWaitlistTarget), errors.Is(err, internal.ErrInvalidTicketsCount):
+			return c.JSON(http.StatusBadRequest, err.Error())
+		case errors.Is(err, internal.ErrTicketTypeNotFound):
+			return c.JSON(http.StatusNotFound, "ticket type not found")
+		case errors.Is(err, internal.ErrEventDayNotFound):
+			return c.JSON(http.StatusNotFound, "event day not found")
+		case errors.Is(err, internal.ErrTicketsStillAvailable), errors.Is(err, internal.ErrAlreadyWaitlisted):
+			return c.JSON(http.StatusConflict, err.Error())
+		}
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, entry)
+}
+
+func (app *Application) LeaveWaitlist(c echo.Context) error {
+	req := struct {
+		UserToken string `json:"userToken"`
+		EntryId   *int   `json:"entryId"`
+	}{}
+
+	err := c.Bind(&req)
+	if err != nil || req.UserToken == "" || req.EntryId == nil {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+
+	u, err := app.models.user.GetUserBySession(&req.UserToken)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.JSON(http.StatusUnauthorized, "not authorized")
+		}
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+
+	err = app.models.waitlist.LeaveWaitlist(req.EntryId, u.Id)
+	if err != nil {
+		if errors.Is(err, internal.ErrWaitlistEntryNotFound) {
+			return c.JSON(http.StatusNotFound, "waitlist entry not found")
+		}
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, "success")
+}
+
+func (app *Application) GetUserWaitlist(c echo.Context) error {
+	token := c.QueryParam("token")
+	if token == "" {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+
+	u, err := app.models.user.GetUserBySession(&token)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.JSON(http.StatusUnauthorized, "not authorized")
+		}
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+
+	entries, err := app.models.waitlist.GetWaitlistByUser(u.Id)
+	if err != nil {
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, entries)
+}
+
+// SetTicketTypeAmount changes the capacity of a GA ticket type, extra
+// tickets are offered to its waitlist first.
+func (app *Application) SetTicketTypeAmount(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return c.JSON(http.StatusBadRequest, "invalid token")
+	}
+	_, err := app.models.admin.EnsureSession(&token)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, "not authorized")
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, "invalid id")
+	}
+	req := struct {
+		Amount *int `json:"amount"`
+	}{}
+	err = c.Bind(&req)
+	if err != nil || req.Amount == nil {
+		return c.JSON(http.StatusBadRequest, "invalid request")
+	}
+
+	err = app.models.tickets.SetTicketTypeAmount(&id, *req.Amount)
+	if err != nil {
+		switch {
+		case errors.Is(err, internal.ErrTicketTypeNotFound):
+			return c.JSON(http.StatusNotFound, "ticket type not found")
+		case errors.Is(err, internal.ErrEventDayNotFound):
+			return c.JSON(http.StatusNotFound, "event day not found")
+		case errors.Is(err, internal.ErrInvalidTicketsCount):
+			return c.JSON(http.StatusBadRequest, "amount is below the number of sold tickets")
+		}
+		fmt.Println(err.Error())
+		return c.JSON(http.StatusInternalServerError, "internal server error")
+	}
+	return c.JSON(http.StatusOK, "success")
+}
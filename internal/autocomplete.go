@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"context"
+	"github.com/essentialkaos/translit/v2"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	SuggestionEvent = "event"
+	SuggestionVenue = "venue"
+	SuggestionGenre = "genre"
+	SuggestionType  = "type"
+)
+
+// AutocompleteMinLength is the number of characters typed before anything
+// is suggested.
+const AutocompleteMinLength = 2
+
+// Suggestion is one autocomplete entry. Id is empty for genres.
+type Suggestion struct {
+	Kind  string  `json:"kind"`
+	Id    *int    `json:"id,omitempty"`
+	Text  *string `json:"text"`
+	Score float64 `json:"score"`
+}
+
+// kazakhLatin covers the Kazakh letters translit doesn't know.
+var kazakhLatin = strings.NewReplacer("ә", "a", "ғ", "g", "қ", "k", "ң", "n", "ө", "o", "ұ", "u", "ү", "u", "һ", "h", "і", "i")
+
+// latinCyrillic reverses the ICAO transliteration, longer letter groups
+// first. Letters without a Russian counterpart get the closest one.
+var latinCyrillic = strings.NewReplacer(
+	"shch", "щ", "zh", "ж", "kh", "х", "ts", "ц", "ch", "ч", "sh", "ш", "iu", "ю", "yu", "ю", "ia", "я", "ya", "я", "yo", "ё",
+	"a", "а", "b", "б", "c", "к", "d", "д", "e", "е", "f", "ф", "g", "г", "h", "х", "i", "и", "j", "й", "k", "к", "l", "л",
+	"m", "м", "n", "н", "o", "о", "p", "п", "q", "к", "r", "р", "s", "с", "t", "т", "u", "у", "v", "в", "w", "в", "x", "кс",
+	"y", "ы", "z", "з",
+)
+
+// queryVariants returns the lowercased query as typed, in Latin and in
+// Cyrillic letters, so either script finds text written in the other.
+func queryVariants(q string) [3]string {
+	q = strings.ToLower(strings.TrimSpace(q))
+	latin := translit.ICAO(kazakhLatin.Replace(q))
+	return [3]string{q, latin, latinCyrillic.Replace(latin)}
+}
+
+// escapeLike makes s match itself in a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// A column matches when it contains a variant or one of its words is close
+// to one by trigrams. Prefix matches rank above the rest.
+const (
+	suggestMatch = `({col} %> $1 OR {col} %> $2 OR {col} %> $3 OR {col} LIKE $4 OR {col} LIKE $5 OR {col} LIKE $6)`
+	suggestScore = `(GREATEST(word_similarity($1, {col}), word_similarity($2, {col}), word_similarity($3, {col}))
+		+ CASE WHEN {col} LIKE $7 OR {col} LIKE $8 OR {col} LIKE $9 THEN 1 WHEN {col} LIKE $4 OR {col} LIKE $5 OR {col} LIKE $6 THEN 0.5 ELSE 0 END)::float8`
+)
+
+func suggestOn(fragment, col string) string {
+	return strings.ReplaceAll(fragment, "{col}", col)
+}
+
+// Autocomplete suggests event titles, venues, genres and event types for
+// the text typed so far, best matches first. Only listed events and their
+// genres are suggested.
+func (m *EventRepo) Autocomplete(q string, limit int) ([]*Suggestion, error) {
+	suggestions := make([]*Suggestion, 0)
+	if utf8.RuneCountInString(strings.TrimSpace(q)) < AutocompleteMinLength {
+		return suggestions, nil
+	}
+	ctx := context.Background()
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// The default threshold of 0.6 drops most one letter typos in short words
+	_, err = tx.Exec(ctx, `SET LOCAL pg_trgm.word_similarity_threshold = 0.3`)
+	if err != nil {
+		return nil, err
+	}
+
+	variants := queryVariants(q)
+	args := make([]any, 0, 11)
+	for _, v := range variants {
+		args = append(args, v)
+	}
+	for _, v := range variants {
+		args = append(args, "%"+escapeLike(v)+"%")
+	}
+	for _, v := range variants {
+		args = append(args, escapeLike(v)+"%")
+	}
+	args = append(args, ListedEventStatuses, limit)
+
+	title, venue, genre := `lower(e.title)`, `lower(v.name)`, `lower(g.genre)`
+	name, translated := `lower(t.name)`, `lower(t.translated_name)`
+	rows, err := tx.Query(ctx, `SELECT kind, id, text, score FROM (
+			SELECT '`+SuggestionEvent+`' AS kind, e.id, e.title AS text, `+suggestOn(suggestScore, title)+` AS score
+			FROM events e WHERE e.deleted_at IS NULL AND e.status = ANY($10) AND `+suggestOn(suggestMatch, title)+`
+			UNION ALL
+			SELECT '`+SuggestionVenue+`', v.id, v.name, `+suggestOn(suggestScore, venue)+`
+			FROM venues v WHERE `+suggestOn(suggestMatch, venue)+`
+			UNION ALL
+			SELECT '`+SuggestionType+`', t.id, t.name, GREATEST(`+suggestOn(suggestScore, name)+`, `+suggestOn(suggestScore, translated)+`)
+			FROM types t WHERE `+suggestOn(suggestMatch, name)+` OR `+suggestOn(suggestMatch, translated)+`
+			UNION ALL
+			SELECT '`+SuggestionGenre+`', NULL, g.genre, `+suggestOn(suggestScore, genre)+`
+			FROM (SELECT DISTINCT unnest(genre) AS genre FROM events WHERE deleted_at IS NULL AND status = ANY($10)) g
+			WHERE `+suggestOn(suggestMatch, genre)+`
+		) s ORDER BY score DESC, length(text), text LIMIT $11`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s Suggestion
+		err = rows.Scan(&s.Kind, &s.Id, &s.Text, &s.Score)
+		if err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, &s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return suggestions, tx.Commit(ctx)
+}
@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"sync"
+	"time"
+)
+
+// AvailabilityChannel is the Postgres channel inventory changes are
+// published on. Notifications are only delivered once the transaction that
+// made the change commits, so subscribers never see rolled back purchases.
+const AvailabilityChannel = "availability"
+
+const (
+	SeatStateHeld     = "held"
+	SeatStateReleased = "released"
+	SeatStateSold     = "sold"
+)
+
+// AvailabilityChange is one update of an event day. Seated days report the
+// new state of a seat, GA days the remaining count of a ticket type.
+type AvailabilityChange struct {
+	EventDayId   int     `json:"eventDayId"`
+	Seated       bool    `json:"seated"`
+	SeatId       *int    `json:"seatId,omitempty"`
+	State        *string `json:"state,omitempty"`
+	TicketTypeId *int    `json:"ticketTypeId,omitempty"`
+	Remaining    *int    `json:"remaining,omitempty"`
+}
+
+// notifySeats publishes the new state of the seats.
+func notifySeats(ctx context.Context, tx pgx.Tx, seatIds []int, state string) error {
+	if len(seatIds) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(ctx, `SELECT pg_notify($1, json_build_object('eventDayId', event_day_id, 'seated', true, 'seatId', id, 'state', $3::text)::text)
+		FROM shah_seats WHERE id = ANY($2) AND event_day_id IS NOT NULL`, AvailabilityChannel, seatIds, state)
+	return err
+}
+
+// notifyTicketTypes publishes the remaining count of the GA ticket types.
+func notifyTicketTypes(ctx context.Context, tx pgx.Tx, ticketTypeIds []int) error {
+	if len(ticketTypeIds) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(ctx, `SELECT pg_notify($1, json_build_object('eventDayId', event_day_id, 'seated', false, 'ticketTypeId', id, 'remaining', amount - sold_count)::text)
+		FROM ticket_types_no_shah WHERE id = ANY($2)`, AvailabilityChannel, ticketTypeIds)
+	return err
+}
+
+type availabilityKey struct {
+	seated bool
+	dayId  int
+}
+
+// AvailabilityBroker fans the availability notifications out to the
+// subscribers of every event day.
+type AvailabilityBroker struct {
+	DB *pgxpool.Pool
+
+	mu          sync.Mutex
+	subscribers map[availabilityKey]map[chan AvailabilityChange]struct{}
+}
+
+// Subscribe registers for the changes of an event day. The channel is
+// buffered, a subscriber that falls behind misses changes rather than
+// stalling everyone else. The returned func unsubscribes.
+func (b *AvailabilityBroker) Subscribe(seated bool, dayId int) (<-chan AvailabilityChange, func()) {
+	key := availabilityKey{seated, dayId}
+	ch := make(chan AvailabilityChange, 64)
+	b.mu.Lock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[availabilityKey]map[chan AvailabilityChange]struct{})
+	}
+	if b.subscribers[key] == nil {
+		b.subscribers[key] = make(map[chan AvailabilityChange]struct{})
+	}
+	b.subscribers[key][ch] = struct{}{}
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subscribers[key], ch)
+		if len(b.subscribers[key]) == 0 {
+			delete(b.subscribers, key)
+		}
+		b.mu.Unlock()
+	}
+}
+
+func (b *AvailabilityBroker) publish(c AvailabilityChange) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers[availabilityKey{c.Seated, c.EventDayId}] {
+		select {
+		case ch <- c:
+		default:
+		}
+	}
+}
+
+// Listen receives the availability notifications until ctx is done. The
+// connection is acquired again after an error.
+func (b *AvailabilityBroker) Listen(ctx context.Context, onError func(error)) {
+	for ctx.Err() == nil {
+		err := b.listen(ctx)
+		if err != nil && ctx.Err() == nil {
+			onError(err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+func (b *AvailabilityBroker) listen(ctx context.Context) error {
+	conn, err := b.DB.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	_, err = conn.Exec(ctx, `LISTEN `+AvailabilityChannel)
+	if err != nil {
+		return err
+	}
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			// The connection may still be listening, don't hand it back to the pool
+			conn.Hijack().Close(context.Background())
+			return err
+		}
+		var c AvailabilityChange
+		if err := json.Unmarshal([]byte(n.Payload), &c); err != nil {
+			continue
+		}
+		b.publish(c)
+	}
+}
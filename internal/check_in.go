@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+const (
+	CheckInValid       = "valid"
+	CheckInAlreadyUsed = "already_used"
+	CheckInWrongEvent  = "wrong_event"
+	CheckInRefunded    = "refunded"
+	CheckInInvalid     = "invalid"
+)
+
+type CheckInRepo struct {
+	DB *pgxpool.Pool
+}
+
+// CheckInRequest is one scan at the door. EventDayId narrows general
+// admission tickets down to a single day, SeatedEventDayId seated tickets.
+type CheckInRequest struct {
+	Code             *string `json:"code"`
+	Gate             *string `json:"gate"`
+	EventId          *int    `json:"eventId"`
+	EventDayId       *int    `json:"eventDayId"`
+	SeatedEventDayId *int    `json:"seatedEventDayId"`
+	AdminId          *int    `json:"-"`
+}
+
+// CheckInResult is the outcome of a scan. EventDayId is a seated day for
+// seat tickets.
+type CheckInResult struct {
+	Status     string     `json:"status"`
+	Kind       string     `json:"kind,omitempty"`
+	TicketId   int        `json:"ticketId,omitempty"`
+	EventId    *int       `json:"eventId,omitempty"`
+	EventDayId *int       `json:"eventDayId,omitempty"`
+	ScannedAt  *time.Time `json:"scannedAt,omitempty"`
+	Gate       *string    `json:"gate,omitempty"`
+}
+
+type Attendance struct {
+	EventDayId *int       `json:"eventDayId"`
+	Date       *time.Time `json:"date"`
+	Seated     bool       `json:"seated"`
+	Sold       int        `json:"sold"`
+	CheckedIn  int        `json:"checkedIn"`
+}
+
+// CheckIn admits a verified ticket code. The ticket row is locked and the
+// check-in is unique per ticket, so two gates scanning the same ticket at once
+// can't both admit it. For an already used ticket the first scan is returned.
+func (r *CheckInRepo) CheckIn(code *TicketCode, req *CheckInRequest) (*CheckInResult, error) {
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	result := CheckInResult{Kind: code.Kind, TicketId: code.TicketId}
+	var nonce string
+	var reserved bool
+	var refundedAt *time.Time
+	var query, column, dayColumn string
+	var dayId *int
+	switch code.Kind {
+	case TicketKindGA:
+		column, dayColumn, dayId = "ticket_id", "event_day_id", req.EventDayId
+		query = `SELECT t.code_nonce::text, t.is_reserved, t.refunded_at, d.event_id, d.id
+			FROM tickets_no_shah t
+			JOIN ticket_types_no_shah tt ON tt.id = t.ticket_type_id
+			JOIN event_days_no_shah d ON d.id = tt.event_day_id
+			WHERE t.id = $1 FOR UPDATE OF t`
+	case TicketKindSeat:
+		column, dayColumn, dayId = "seat_ticket_id", "seat_event_day_id", req.SeatedEventDayId
+		query = `SELECT t.code_nonce::text, t.is_reserved, t.refunded_at, s.event_id, s.event_day_id
+			FROM tickets_shah t
+			JOIN shah_seats s ON s.id = t.seat_id
+			WHERE t.id = $1 FOR UPDATE OF t`
+	default:
+		return &CheckInResult{Status: CheckInInvalid}, nil
+	}
+	err = tx.QueryRow(ctx, query, code.TicketId).Scan(&nonce, &reserved, &refundedAt, &result.EventId, &result.EventDayId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return &CheckInResult{Status: CheckInInvalid}, nil
+		}
+		return nil, err
+	}
+	// A different nonce means the ticket was issued again and this code revoked
+	if nonce != code.Nonce || reserved {
+		return &CheckInResult{Status: CheckInInvalid}, nil
+	}
+	if refundedAt != nil {
+		result.Status = CheckInRefunded
+		return &result, nil
+	}
+	if result.EventId == nil || req.EventId == nil || *result.EventId != *req.EventId ||
+		(dayId != nil && (result.EventDayId == nil || *result.EventDayId != *dayId)) {
+		result.Status = CheckInWrongEvent
+		return &result, nil
+	}
+
+	err = tx.QueryRow(ctx, `INSERT INTO check_ins (`+column+`, event_id, `+dayColumn+`, gate, admin_id)
+		VALUES ($1, $2, $3, $4, $5) ON CONFLICT (`+column+`) DO NOTHING RETURNING scanned_at, gate`,
+		code.TicketId, result.EventId, result.EventDayId, req.Gate, req.AdminId).Scan(&result.ScannedAt, &result.Gate)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return nil, err
+		}
+		err = tx.QueryRow(ctx, `SELECT scanned_at, gate FROM check_ins WHERE `+column+` = $1`, code.TicketId).Scan(&result.ScannedAt, &result.Gate)
+		if err != nil {
+			return nil, err
+		}
+		result.Status = CheckInAlreadyUsed
+		return &result, nil
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	result.Status = CheckInValid
+	return &result, nil
+}
+
+// GetAttendance counts sold and admitted tickets of an event per general
+// admission and seated day.
+func (r *CheckInRepo) GetAttendance(eventId *int) ([]*Attendance, error) {
+	tx, err := r.DB.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+	rows, err := tx.Query(context.Background(), `
+		SELECT d.id, d.date, false,
+		       count(t.id) FILTER (WHERE NOT t.is_reserved AND t.refunded_at IS NULL),
+		       count(c.id)
+		FROM event_days_no_shah d
+		LEFT JOIN ticket_types_no_shah tt ON tt.event_day_id = d.id
+		LEFT JOIN tickets_no_shah t ON t.ticket_type_id = tt.id
+		LEFT JOIN check_ins c ON c.ticket_id = t.id
+		WHERE d.event_id = $1
+		GROUP BY d.id, d.date
+		UNION ALL
+		SELECT d.id, d.date, true,
+		       count(t.id) FILTER (WHERE NOT t.is_reserved AND t.refunded_at IS NULL),
+		       count(c.id)
+		FROM event_days_shah d
+		LEFT JOIN shah_seats s ON s.event_day_id = d.id
+		LEFT JOIN tickets_shah t ON t.seat_id = s.id
+		LEFT JOIN check_ins c ON c.seat_ticket_id = t.id
+		WHERE d.event_id = $1
+		GROUP BY d.id, d.date
+		ORDER BY 2
+	`, eventId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	attendance := make([]*Attendance, 0)
+	for rows.Next() {
+		var a Attendance
+		err = rows.Scan(&a.EventDayId, &a.Date, &a.Seated, &a.Sold, &a.CheckedIn)
+		if err != nil {
+			return nil, err
+		}
+		attendance = append(attendance, &a)
+	}
+	err = tx.Commit(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return attendance, nil
+}
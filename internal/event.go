@@ -6,9 +6,18 @@ import (
 	"github.com/essentialkaos/translit/v2"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"strings"
 	"time"
 )
 
+var (
+	ErrEventNotFound       = errors.New("event not found")
+	ErrEventHasTickets     = errors.New("event has tickets")
+	ErrEventCurrencyLocked = errors.New("currency can't change once tickets were created")
+	ErrEventFieldNotClear  = errors.New("field can't be cleared")
+	ErrInvalidEventLink    = errors.New("new venues and event types need a name")
+)
+
 type Decor struct {
 	Id       *int    `json:"id"`
 	Name     *string `form:"name" json:"name"`
@@ -28,21 +37,68 @@ type EventDescription struct {
 }
 
 type Event struct {
-	ID             *int         `json:"id"`
-	Title          *string      `json:"title"`
-	Type           []*EventType `json:"eventType"`
-	Description    *string      `json:"description"`
-	BriefDesc      *string      `json:"brief_desc"`
-	Genres         []*string    `json:"genres"`
-	Venues         []*Venue     `json:"venues"`
-	StartTime      *time.Time   `json:"startTime"`
-	EndTime        *time.Time   `json:"endTime"`
-	Price          *float64     `json:"price"`
-	AgeRestriction *int         `json:"ageRestriction"`
-	Rating         *float64     `json:"rating"`
-	CreatedAt      *time.Time   `json:"createdAt"`
-	UpdatedAt      *time.Time   `json:"updatedAt"`
-	Duration       *string      `json:"duration"`
+	ID                  *int         `json:"id"`
+	Title               *string      `json:"title"`
+	Type                []*EventType `json:"eventType"`
+	Description         *string      `json:"description"`
+	BriefDesc           *string      `json:"brief_desc"`
+	Genres              []*string    `json:"genres"`
+	Venues              []*Venue     `json:"venues"`
+	StartTime           *time.Time   `json:"startTime"`
+	EndTime             *time.Time   `json:"endTime"`
+	Price               *Money       `json:"price"`
+	Currency            *string      `json:"currency"`
+	AgeRestriction      *int         `json:"ageRestriction"`
+	Rating              *float64     `json:"rating"`
+	CreatedAt           *time.Time   `json:"createdAt"`
+	UpdatedAt           *time.Time   `json:"updatedAt"`
+	Duration            *string      `json:"duration"`
+	RefundWindowHours   *int         `json:"refundWindowHours"`
+	TransferCutoffHours *int         `json:"transferCutoffHours"`
+	MaxTicketsPerUser   *int         `json:"maxTicketsPerUser"`
+	Status              *string      `json:"status"`
+	PublishAt           *time.Time   `json:"publishAt"`
+	DeletedAt           *time.Time   `json:"deletedAt"`
+}
+
+// EventUpdate holds the fields of an event to change, nil fields keep their
+// value. Clear names optional fields, by their JSON name, to set to null.
+// Non-nil Types and Venues replace every link of the event, entries without
+// an id are created.
+type EventUpdate struct {
+	Title               *string
+	Description         *string
+	BriefDesc           *string
+	Genres              []*string
+	StartTime           *time.Time
+	EndTime             *time.Time
+	Price               *Money
+	Currency            *string
+	AgeRestriction      *int
+	Rating              *float64
+	Duration            *string
+	RefundWindowHours   *int
+	TransferCutoffHours *int
+	MaxTicketsPerUser   *int
+	Clear               []string
+	Types               []*EventType
+	Venues              []*Venue
+}
+
+// clearableEventColumns maps the optional event fields EventUpdate.Clear
+// accepts to their columns.
+var clearableEventColumns = map[string]string{
+	"description":         "description",
+	"briefDesc":           "brief_desc",
+	"genres":              "genre",
+	"endTime":             "end_time",
+	"price":               "price",
+	"ageRestriction":      "age_restriction",
+	"rating":              "rating",
+	"duration":            "duration",
+	"refundWindowHours":   "refund_window_hours",
+	"transferCutoffHours": "transfer_cutoff_hours",
+	"maxTicketsPerUser":   "max_tickets_per_user",
 }
 
 type EventImages struct {
@@ -60,7 +116,7 @@ type EventType struct {
 type SeatType struct {
 	ID    *int    `json:"id"`
 	Name  *string `json:"name"`
-	Price *int    `json:"price"`
+	Price *Money  `json:"price"`
 }
 
 func (m *EventRepo) CreateEvent(event *Event) (*int, error) {
@@ -69,35 +125,275 @@ func (m *EventRepo) CreateEvent(event *Event) (*int, error) {
 		return nil, err
 	}
 	defer tx.Rollback(context.Background())
+	currency := DefaultCurrency
+	if event.Currency != nil {
+		currency = *event.Currency
+	}
+	if !ValidCurrency(currency) {
+		return nil, ErrUnsupportedCurrency
+	}
+	var price *int64
+	if event.Price != nil {
+		err = checkPrice(event.Price, currency)
+		if err != nil {
+			return nil, err
+		}
+		price = &event.Price.Amount
+	}
+	status, err := checkInitialStatus(event.Status, event.PublishAt)
+	if err != nil {
+		return nil, err
+	}
+	publishAt := event.PublishAt
+	if status != EventStatusScheduled {
+		publishAt = nil
+	}
 	var id int
-	row := tx.QueryRow(context.Background(), `INSERT INTO events VALUES(default, $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`,
-		event.Title, event.Description, event.BriefDesc, event.Genres, event.StartTime, event.EndTime, event.Price, event.AgeRestriction, event.Rating, event.CreatedAt, event.UpdatedAt)
+	row := tx.QueryRow(context.Background(), `INSERT INTO events(id, title, description, brief_desc, genre, start_time, end_time, price, currency, age_restriction, rating, created_at, updated_at, refund_window_hours, transfer_cutoff_hours, max_tickets_per_user, status, publish_at)
+		VALUES(default, $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17) RETURNING id`,
+		event.Title, event.Description, event.BriefDesc, event.Genres, event.StartTime, event.EndTime, price, currency, event.AgeRestriction, event.Rating, event.CreatedAt, event.UpdatedAt, event.RefundWindowHours, event.TransferCutoffHours, event.MaxTicketsPerUser, status, publishAt)
 
 	err = row.Scan(&id)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, venue := range event.Venues {
-		_, err := tx.Exec(context.Background(), `INSERT INTO event_venues(id, event_id, venue_id) VALUES(default, $1, $2)`, id, venue.ID)
+	err = insertEventLinks(context.Background(), tx, id, event.Type, event.Venues)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return &id, nil
+}
+
+func insertEventLinks(ctx context.Context, tx pgx.Tx, eventId int, types []*EventType, venues []*Venue) error {
+	for _, venue := range venues {
+		_, err := tx.Exec(ctx, `INSERT INTO event_venues(id, event_id, venue_id) VALUES(default, $1, $2)`, eventId, venue.ID)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	for _, t := range event.Type {
-		_, err := tx.Exec(context.Background(), `INSERT INTO event_types VALUES($1, $2)`, id, t.ID)
+	for _, t := range types {
+		_, err := tx.Exec(ctx, `INSERT INTO event_types VALUES($1, $2) ON CONFLICT DO NOTHING`, eventId, t.ID)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
+	return nil
+}
 
-	err = tx.Commit(context.Background())
+// checkEventLinks makes sure the event types and venues without an id can be
+// created.
+func checkEventLinks(types []*EventType, venues []*Venue) error {
+	for _, t := range types {
+		if t == nil || (t.ID == nil && (t.Name == nil || *t.Name == "")) {
+			return ErrInvalidEventLink
+		}
+	}
+	for _, venue := range venues {
+		if venue == nil || (venue.ID == nil && (venue.Name == nil || *venue.Name == "")) {
+			return ErrInvalidEventLink
+		}
+	}
+	return nil
+}
+
+// UpdateEvent changes the given fields of an event and bumps updated_at.
+// The currency can only change before any ticket type was created, prices
+// of existing inventory are in the old one.
+func (m *EventRepo) UpdateEvent(id *int, u *EventUpdate) error {
+	err := checkEventLinks(u.Types, u.Venues)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	ctx := context.Background()
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
 
-	return &id, nil
+	var currency string
+	err = tx.QueryRow(ctx, `SELECT currency FROM events WHERE id = $1 FOR UPDATE`, id).Scan(&currency)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrEventNotFound
+		}
+		return err
+	}
+	if u.Currency != nil && *u.Currency != currency {
+		if !ValidCurrency(*u.Currency) {
+			return ErrUnsupportedCurrency
+		}
+		var stocked bool
+		err = tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM event_days_no_shah WHERE event_id = $1)
+			OR EXISTS(SELECT 1 FROM event_days_shah WHERE event_id = $1)`, id).Scan(&stocked)
+		if err != nil {
+			return err
+		}
+		if stocked {
+			return ErrEventCurrencyLocked
+		}
+		currency = *u.Currency
+	}
+	var price *int64
+	if u.Price != nil {
+		err = checkPrice(u.Price, currency)
+		if err != nil {
+			return err
+		}
+		price = &u.Price.Amount
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE events SET title = COALESCE($2, title), description = COALESCE($3, description),
+			brief_desc = COALESCE($4, brief_desc), genre = COALESCE($5, genre), start_time = COALESCE($6, start_time),
+			end_time = COALESCE($7, end_time), price = COALESCE($8, price), currency = $9,
+			age_restriction = COALESCE($10, age_restriction), rating = COALESCE($11, rating), duration = COALESCE($12, duration),
+			refund_window_hours = COALESCE($13, refund_window_hours), transfer_cutoff_hours = COALESCE($14, transfer_cutoff_hours),
+			max_tickets_per_user = COALESCE($15, max_tickets_per_user), updated_at = $16
+		WHERE id = $1`,
+		id, u.Title, u.Description, u.BriefDesc, u.Genres, u.StartTime, u.EndTime, price, currency,
+		u.AgeRestriction, u.Rating, u.Duration, u.RefundWindowHours, u.TransferCutoffHours, u.MaxTicketsPerUser, time.Now())
+	if err != nil {
+		return err
+	}
+	if len(u.Clear) > 0 {
+		columns := make([]string, 0, len(u.Clear))
+		for _, field := range u.Clear {
+			column, ok := clearableEventColumns[field]
+			if !ok {
+				return ErrEventFieldNotClear
+			}
+			columns = append(columns, column+" = NULL")
+		}
+		_, err = tx.Exec(ctx, `UPDATE events SET `+strings.Join(columns, ", ")+` WHERE id = $1`, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, t := range u.Types {
+		if t.ID == nil {
+			u.Types[i], err = insertEventType(ctx, tx, t.Name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, venue := range u.Venues {
+		if venue.ID == nil {
+			err = insertVenue(ctx, tx, venue)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if u.Types != nil {
+		_, err = tx.Exec(ctx, `DELETE FROM event_types WHERE event_id = $1`, id)
+		if err != nil {
+			return err
+		}
+	}
+	if u.Venues != nil {
+		_, err = tx.Exec(ctx, `DELETE FROM event_venues WHERE event_id = $1`, id)
+		if err != nil {
+			return err
+		}
+	}
+	err = insertEventLinks(ctx, tx, *id, u.Types, u.Venues)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// SoftDeleteEvent hides an event from every listing. Its orders and tickets
+// stay valid and RestoreEvent brings it back.
+func (m *EventRepo) SoftDeleteEvent(id *int) error {
+	return m.setDeleted(id, true)
+}
+
+func (m *EventRepo) RestoreEvent(id *int) error {
+	return m.setDeleted(id, false)
+}
+
+func (m *EventRepo) setDeleted(id *int, deleted bool) error {
+	tx, err := m.DB.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+	tag, err := tx.Exec(context.Background(), `UPDATE events SET deleted_at = CASE WHEN $2 THEN COALESCE(deleted_at, now()) END, updated_at = $3
+		WHERE id = $1`, id, deleted, time.Now())
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrEventNotFound
+	}
+	return tx.Commit(context.Background())
+}
+
+// DeleteEvent removes an event with its days, inventory and links. Events
+// that ever had a ticket or an order can only be soft deleted.
+func (m *EventRepo) DeleteEvent(id *int) error {
+	ctx := context.Background()
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var exists bool
+	err = tx.QueryRow(ctx, `SELECT true FROM events WHERE id = $1 FOR UPDATE`, id).Scan(&exists)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrEventNotFound
+		}
+		return err
+	}
+	var used bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM orders WHERE event_id = $1)
+		OR EXISTS(SELECT 1 FROM tickets_no_shah t
+		          JOIN ticket_types_no_shah tt ON tt.id = t.ticket_type_id
+		          JOIN event_days_no_shah d ON d.id = tt.event_day_id
+		          WHERE d.event_id = $1)
+		OR EXISTS(SELECT 1 FROM tickets_shah t JOIN shah_seats s ON s.id = t.seat_id WHERE s.event_id = $1)`, id).Scan(&used)
+	if err != nil {
+		return err
+	}
+	if used {
+		return ErrEventHasTickets
+	}
+
+	statements := []string{
+		`DELETE FROM waitlist_entries WHERE event_id = $1 OR ticket_type_id IN (
+			SELECT tt.id FROM ticket_types_no_shah tt JOIN event_days_no_shah d ON d.id = tt.event_day_id WHERE d.event_id = $1)`,
+		`DELETE FROM promo_codes WHERE event_id = $1
+			OR ticket_type_id IN (SELECT tt.id FROM ticket_types_no_shah tt JOIN event_days_no_shah d ON d.id = tt.event_day_id WHERE d.event_id = $1)
+			OR shah_ticket_type_id IN (SELECT tt.id FROM shah_ticket_types tt JOIN event_days_shah d ON d.id = tt.event_day_id WHERE d.event_id = $1)`,
+		`DELETE FROM ticket_types_no_shah WHERE event_day_id IN (SELECT id FROM event_days_no_shah WHERE event_id = $1)`,
+		`DELETE FROM event_days_no_shah WHERE event_id = $1`,
+		`DELETE FROM event_schedules WHERE event_id = $1`,
+		`DELETE FROM shah_seats WHERE event_id = $1`,
+		`DELETE FROM event_days_shah WHERE event_id = $1`,
+		`DELETE FROM event_venues WHERE event_id = $1`,
+		`DELETE FROM event_images WHERE event_id = $1`,
+		`DELETE FROM events WHERE id = $1`,
+	}
+	for _, stmt := range statements {
+		_, err = tx.Exec(ctx, stmt, id)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
 }
 
 func (m *EventRepo) GetEventsByType(tip *string, pageNumber *int) ([]*Event, error) {
@@ -115,7 +411,8 @@ func (m *EventRepo) GetEventsByType(tip *string, pageNumber *int) ([]*Event, err
 	limit := 20 * *pageNumber
 	offset := limit * (*pageNumber - 1)
 
-	rows, err := tx.Query(context.Background(), `SELECT event_id FROM event_types WHERE type_id = $1 ORDER BY event_id desc LIMIT $2 OFFSET $3`, typeId, limit, offset)
+	rows, err := tx.Query(context.Background(), `SELECT et.event_id FROM event_types et JOIN events e ON e.id = et.event_id
+		WHERE et.type_id = $1 AND e.deleted_at IS NULL AND e.status = ANY($4) ORDER BY et.event_id desc LIMIT $2 OFFSET $3`, typeId, limit, offset, ListedEventStatuses)
 	if err != nil {
 		return nil, err
 	}
@@ -150,14 +447,12 @@ func (m *EventRepo) GetEventsByType(tip *string, pageNumber *int) ([]*Event, err
 }
 
 func (m *EventRepo) CreateEventType(name *string) (*EventType, error) {
-	translatedName := translit.ICAO(*name)
 	tx, err := m.DB.Begin(context.Background())
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback(context.Background())
-	var id int
-	err = tx.QueryRow(context.Background(), `INSERT INTO types(id, name, translated_name) VALUES(default, $1, $2) RETURNING id`, *name, translatedName).Scan(&id)
+	t, err := insertEventType(context.Background(), tx, name)
 	if err != nil {
 		return nil, err
 	}
@@ -165,6 +460,16 @@ func (m *EventRepo) CreateEventType(name *string) (*EventType, error) {
 	if err != nil {
 		return nil, err
 	}
+	return t, nil
+}
+
+func insertEventType(ctx context.Context, tx pgx.Tx, name *string) (*EventType, error) {
+	translatedName := translit.ICAO(*name)
+	var id int
+	err := tx.QueryRow(ctx, `INSERT INTO types(id, name, translated_name) VALUES(default, $1, $2) RETURNING id`, *name, translatedName).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
 	t := EventType{
 		ID:             &id,
 		Name:           name,
@@ -278,19 +583,22 @@ func (m *EventRepo) GetEventTypeByEvent(eventId *int) ([]*EventType, error) {
 	return eTypes, nil
 }
 
-func (m *EventRepo) GetEventsPage(page *int) ([]*Event, *int, error) {
+// GetEventsPage returns a page of the events in one of the statuses, nil
+// statuses return every event that isn't deleted.
+func (m *EventRepo) GetEventsPage(page *int, statuses []string) ([]*Event, *int, error) {
 	tx, err := m.DB.Begin(context.Background())
 	if err != nil {
 		return nil, nil, err
 	}
 	defer tx.Rollback(context.Background())
 	var totalPages int
-	err = tx.QueryRow(context.Background(), `SELECT count(*) FROM events`).Scan(&totalPages)
+	err = tx.QueryRow(context.Background(), `SELECT count(*) FROM events WHERE deleted_at IS NULL AND ($1::text[] IS NULL OR status = ANY($1))`, statuses).Scan(&totalPages)
 	if err != nil {
 		return nil, nil, err
 	}
-	stmt := `SELECT id, title, description, brief_desc, genre, start_time, end_time, price, age_restriction, rating, created_at, updated_at FROM events order by start_time desc limit $1 OFFSET $2`
-	rows, err := tx.Query(context.Background(), stmt, 10, *page*10)
+	stmt := `SELECT id, title, description, brief_desc, genre, start_time, end_time, price, currency, age_restriction, rating, created_at, updated_at, status, publish_at FROM events
+		WHERE deleted_at IS NULL AND ($3::text[] IS NULL OR status = ANY($3)) order by start_time desc limit $1 OFFSET $2`
+	rows, err := tx.Query(context.Background(), stmt, 10, *page*10, statuses)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -299,10 +607,12 @@ func (m *EventRepo) GetEventsPage(page *int) ([]*Event, *int, error) {
 	venueRepo := VenueRepo{DB: m.DB}
 	for rows.Next() {
 		var e Event
-		err := rows.Scan(&e.ID, &e.Title, &e.Description, &e.BriefDesc, &e.Genres, &e.StartTime, &e.EndTime, &e.Price, &e.AgeRestriction, &e.Rating, &e.CreatedAt, &e.UpdatedAt)
+		var price *int64
+		err := rows.Scan(&e.ID, &e.Title, &e.Description, &e.BriefDesc, &e.Genres, &e.StartTime, &e.EndTime, &price, &e.Currency, &e.AgeRestriction, &e.Rating, &e.CreatedAt, &e.UpdatedAt, &e.Status, &e.PublishAt)
 		if err != nil {
 			return nil, nil, err
 		}
+		e.Price = moneyOrNil(price, *e.Currency)
 		venues, err := venueRepo.GetVenuesByEvent(e.ID)
 		eventTypes, err := m.GetEventTypeByEvent(e.ID)
 		if err != nil {
@@ -351,7 +661,7 @@ func (m *EventRepo) GetAllGenres() ([]*string, error) {
 	}
 	defer tx.Rollback(context.Background())
 	genres := make([]*string, 0)
-	rows, err := tx.Query(context.Background(), `SELECT DISTINCT UNNEST(genre) AS genre FROM events;`)
+	rows, err := tx.Query(context.Background(), `SELECT DISTINCT UNNEST(genre) AS genre FROM events WHERE deleted_at IS NULL AND status = ANY($1);`, ListedEventStatuses)
 	if err != nil {
 		return nil, err
 	}
@@ -378,10 +688,15 @@ func (m *EventRepo) GetEventById(id *int) (*Event, error) {
 	}
 	defer tx.Rollback(context.Background())
 	var e Event
-	err = tx.QueryRow(context.Background(), `SELECT * FROM events where id = $1`, *id).Scan(&e.ID, &e.Title, &e.Description, &e.BriefDesc, &e.Genres, &e.StartTime, &e.EndTime, &e.Price, &e.AgeRestriction, &e.Rating, &e.CreatedAt, &e.UpdatedAt, &e.Duration)
+	var price *int64
+	err = tx.QueryRow(context.Background(), `SELECT id, title, description, brief_desc, genre, start_time, end_time, price, currency, age_restriction, rating, created_at, updated_at, duration, refund_window_hours, transfer_cutoff_hours, max_tickets_per_user, status, publish_at FROM events where id = $1 AND deleted_at IS NULL AND status = ANY($2)`, *id, visibleEventStatuses).Scan(&e.ID, &e.Title, &e.Description, &e.BriefDesc, &e.Genres, &e.StartTime, &e.EndTime, &price, &e.Currency, &e.AgeRestriction, &e.Rating, &e.CreatedAt, &e.UpdatedAt, &e.Duration, &e.RefundWindowHours, &e.TransferCutoffHours, &e.MaxTicketsPerUser, &e.Status, &e.PublishAt)
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrEventNotFound
+		}
 		return nil, err
 	}
+	e.Price = moneyOrNil(price, *e.Currency)
 	err = tx.Commit(context.Background())
 	if err != nil {
 		return nil, err
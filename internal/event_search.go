@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+const eventSearchPageSize = 20
+
+// EventSearch is a catalog query. Query is matched against the title, brief
+// description and description in Russian and Kazakh, the filters narrow the
+// result and nil or empty filters don't filter. An event matches the date
+// range when one of its days falls in [From, To), events without days by
+// their start time. MinPrice and MaxPrice bound the lowest current ticket
+// price of an event, in minor units of Currency, which they require.
+type EventSearch struct {
+	Query             *string
+	Genres            []string
+	TypeIds           []int
+	VenueIds          []int
+	From              *time.Time
+	To                *time.Time
+	MinPrice          *int64
+	MaxPrice          *int64
+	Currency          *string
+	MaxAgeRestriction *int
+	Page              int
+}
+
+// FacetCount is the number of matching events with one genre, type or
+// venue. Id is empty for genres.
+type FacetCount struct {
+	Id    *int    `json:"id,omitempty"`
+	Name  *string `json:"name"`
+	Count int     `json:"count"`
+}
+
+// EventFacets are counted over the events matching every filter except the
+// one of the facet itself, so picking a genre doesn't hide the other genres.
+type EventFacets struct {
+	Genres []*FacetCount `json:"genres"`
+	Types  []*FacetCount `json:"types"`
+	Venues []*FacetCount `json:"venues"`
+}
+
+type EventSearchResult struct {
+	Events     []*Event     `json:"events"`
+	Total      int          `json:"total"`
+	TotalPages int          `json:"totalPages"`
+	Facets     *EventFacets `json:"facets"`
+}
+
+// Placeholders of the search filters, facets clear their own one
+const (
+	searchArgQuery = iota
+	searchArgGenres
+	searchArgTypes
+	searchArgVenues
+	searchArgFrom
+	searchArgTo
+	searchArgMinPrice
+	searchArgMaxPrice
+	searchArgCurrency
+	searchArgMaxAge
+	searchArgStatuses
+)
+
+const eventSearchQuery = `(websearch_to_tsquery('russian', $1) || websearch_to_tsquery('kazakh', $1))`
+
+// eventMinPrice is the lowest current price of the GA and seated ticket
+// types of an event, GA types at their active price tier.
+const eventMinPrice = `(SELECT min(p.price) FROM (
+		SELECT COALESCE((SELECT pt.price FROM ticket_price_tiers pt
+			WHERE pt.ticket_type_id = tt.id
+			AND (pt.valid_until IS NULL OR now() < pt.valid_until)
+			AND (pt.sold_below IS NULL OR COALESCE(tt.sold_count, 0) < pt.sold_below)
+			AND (pt.hours_before_event IS NULL OR now() >= d.date - pt.hours_before_event * interval '1 hour')
+			ORDER BY pt.position, pt.id LIMIT 1), tt.price) AS price
+		FROM ticket_types_no_shah tt JOIN event_days_no_shah d ON d.id = tt.event_day_id WHERE d.event_id = e.id
+		UNION ALL SELECT tt.price FROM shah_ticket_types tt JOIN event_days_shah d ON d.id = tt.event_day_id WHERE d.event_id = e.id
+	) p)`
+
+const eventSearchWhere = `e.deleted_at IS NULL AND e.status = ANY($11)
+	AND ($1::text IS NULL OR e.search_vector @@ ` + eventSearchQuery + `)
+	AND ($2::text[] IS NULL OR e.genre && $2)
+	AND ($3::int[] IS NULL OR EXISTS(SELECT 1 FROM event_types et WHERE et.event_id = e.id AND et.type_id = ANY($3)))
+	AND ($4::int[] IS NULL OR EXISTS(SELECT 1 FROM event_venues ev WHERE ev.event_id = e.id AND ev.venue_id = ANY($4)))
+	AND (($5::timestamptz IS NULL AND $6::timestamptz IS NULL) OR EXISTS(
+		SELECT 1 FROM (
+			SELECT date FROM event_days_no_shah WHERE event_id = e.id
+			UNION ALL SELECT date FROM event_days_shah WHERE event_id = e.id
+			UNION ALL SELECT e.start_time::timestamptz
+				WHERE NOT EXISTS(SELECT 1 FROM event_days_no_shah WHERE event_id = e.id)
+				AND NOT EXISTS(SELECT 1 FROM event_days_shah WHERE event_id = e.id)
+		) d WHERE ($5::timestamptz IS NULL OR d.date >= $5) AND ($6::timestamptz IS NULL OR d.date < $6)))
+	AND ($9::text IS NULL OR e.currency = $9)
+	AND (($7::bigint IS NULL AND $8::bigint IS NULL) OR EXISTS(
+		SELECT 1 FROM (SELECT ` + eventMinPrice + ` AS price) m
+		WHERE $9::text IS NOT NULL AND ($7::bigint IS NULL OR m.price >= $7) AND ($8::bigint IS NULL OR m.price <= $8)))
+	AND ($10::int IS NULL OR COALESCE(e.age_restriction, 0) <= $10)`
+
+func (s *EventSearch) args() []any {
+	args := make([]any, searchArgStatuses+1)
+	if s.Query != nil && *s.Query != "" {
+		args[searchArgQuery] = *s.Query
+	}
+	if len(s.Genres) > 0 {
+		args[searchArgGenres] = s.Genres
+	}
+	if len(s.TypeIds) > 0 {
+		args[searchArgTypes] = s.TypeIds
+	}
+	if len(s.VenueIds) > 0 {
+		args[searchArgVenues] = s.VenueIds
+	}
+	args[searchArgFrom] = s.From
+	args[searchArgTo] = s.To
+	args[searchArgMinPrice] = s.MinPrice
+	args[searchArgMaxPrice] = s.MaxPrice
+	args[searchArgCurrency] = s.Currency
+	args[searchArgMaxAge] = s.MaxAgeRestriction
+	args[searchArgStatuses] = ListedEventStatuses
+	return args
+}
+
+// without returns the arguments with one filter cleared.
+func without(args []any, i int) []any {
+	c := append([]any(nil), args...)
+	c[i] = nil
+	return c
+}
+
+// SearchEvents returns a page of the listed events matching s, best matches
+// first when there is a query and the latest otherwise, with the facets of
+// the whole result.
+func (m *EventRepo) SearchEvents(s *EventSearch) (*EventSearchResult, error) {
+	ctx := context.Background()
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	args := s.args()
+	result := EventSearchResult{Events: make([]*Event, 0), Facets: &EventFacets{}}
+	err = tx.QueryRow(ctx, `SELECT count(*) FROM events e WHERE `+eventSearchWhere, args...).Scan(&result.Total)
+	if err != nil {
+		return nil, err
+	}
+	result.TotalPages = (result.Total + eventSearchPageSize - 1) / eventSearchPageSize
+
+	page := s.Page
+	if page < 1 {
+		page = 1
+	}
+	rows, err := tx.Query(ctx, `SELECT e.id, e.title, e.description, e.brief_desc, e.genre, e.start_time, e.end_time, e.price, e.currency, e.age_restriction, e.rating, e.created_at, e.updated_at, e.status, e.publish_at
+		FROM events e WHERE `+eventSearchWhere+`
+		ORDER BY CASE WHEN $1::text IS NULL THEN 0 ELSE ts_rank_cd(e.search_vector, `+eventSearchQuery+`) END DESC, e.start_time DESC, e.id DESC
+		LIMIT $12 OFFSET $13`, append(args, eventSearchPageSize, (page-1)*eventSearchPageSize)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e Event
+		var price *int64
+		err = rows.Scan(&e.ID, &e.Title, &e.Description, &e.BriefDesc, &e.Genres, &e.StartTime, &e.EndTime, &price, &e.Currency, &e.AgeRestriction, &e.Rating, &e.CreatedAt, &e.UpdatedAt, &e.Status, &e.PublishAt)
+		if err != nil {
+			return nil, err
+		}
+		e.Price = moneyOrNil(price, *e.Currency)
+		result.Events = append(result.Events, &e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	venueRepo := &VenueRepo{DB: m.DB}
+	for _, e := range result.Events {
+		e.Venues, err = venueRepo.GetVenuesByEvent(e.ID)
+		if err != nil {
+			return nil, err
+		}
+		e.Type, err = m.GetEventTypeByEvent(e.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result.Facets.Genres, err = searchFacet(ctx, tx, `SELECT NULL::int, g, count(*) FROM events e, unnest(e.genre) g
+		WHERE `+eventSearchWhere+` GROUP BY g ORDER BY count(*) DESC, g`, without(args, searchArgGenres))
+	if err != nil {
+		return nil, err
+	}
+	result.Facets.Types, err = searchFacet(ctx, tx, `SELECT t.id, t.name, count(DISTINCT e.id) FROM events e
+		JOIN event_types et ON et.event_id = e.id JOIN types t ON t.id = et.type_id
+		WHERE `+eventSearchWhere+` GROUP BY t.id, t.name ORDER BY count(DISTINCT e.id) DESC, t.name`, without(args, searchArgTypes))
+	if err != nil {
+		return nil, err
+	}
+	result.Facets.Venues, err = searchFacet(ctx, tx, `SELECT v.id, v.name, count(DISTINCT e.id) FROM events e
+		JOIN event_venues ev ON ev.event_id = e.id JOIN venues v ON v.id = ev.venue_id
+		WHERE `+eventSearchWhere+` GROUP BY v.id, v.name ORDER BY count(DISTINCT e.id) DESC, v.name`, without(args, searchArgVenues))
+	if err != nil {
+		return nil, err
+	}
+	return &result, tx.Commit(ctx)
+}
+
+func searchFacet(ctx context.Context, tx pgx.Tx, query string, args []any) ([]*FacetCount, error) {
+	rows, err := tx.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	facets := make([]*FacetCount, 0)
+	for rows.Next() {
+		var f FacetCount
+		err = rows.Scan(&f.Id, &f.Name, &f.Count)
+		if err != nil {
+			return nil, err
+		}
+		facets = append(facets, &f)
+	}
+	return facets, rows.Err()
+}
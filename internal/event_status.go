@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+const (
+	EventStatusDraft     = "draft"
+	EventStatusScheduled = "scheduled"
+	EventStatusPublished = "published"
+	EventStatusOnSale    = "on_sale"
+	EventStatusSoldOut   = "sold_out"
+	EventStatusPostponed = "postponed"
+	EventStatusCancelled = "cancelled"
+	EventStatusFinished  = "finished"
+)
+
+var (
+	ErrInvalidEventStatus    = errors.New("invalid event status")
+	ErrEventStatusTransition = errors.New("event can't move to this status")
+	ErrPublishTimeRequired   = errors.New("scheduled events need a publish time in the future")
+	ErrEventNotOnSale        = errors.New("event is not on sale")
+)
+
+// eventTransitions lists the statuses every status can move to. Cancelled
+// and finished events are final.
+var eventTransitions = map[string][]string{
+	EventStatusDraft:     {EventStatusScheduled, EventStatusPublished, EventStatusOnSale, EventStatusCancelled},
+	EventStatusScheduled: {EventStatusDraft, EventStatusPublished, EventStatusOnSale, EventStatusCancelled},
+	EventStatusPublished: {EventStatusDraft, EventStatusOnSale, EventStatusPostponed, EventStatusCancelled, EventStatusFinished},
+	EventStatusOnSale:    {EventStatusPublished, EventStatusSoldOut, EventStatusPostponed, EventStatusCancelled, EventStatusFinished},
+	EventStatusSoldOut:   {EventStatusOnSale, EventStatusPostponed, EventStatusCancelled, EventStatusFinished},
+	EventStatusPostponed: {EventStatusPublished, EventStatusOnSale, EventStatusCancelled},
+	EventStatusCancelled: {},
+	EventStatusFinished:  {},
+}
+
+// ListedEventStatuses are the statuses of events shown in public listings.
+var ListedEventStatuses = []string{EventStatusPublished, EventStatusOnSale, EventStatusSoldOut, EventStatusPostponed}
+
+// visibleEventStatuses can be opened by id, ticket holders still need the
+// page of a cancelled or finished event.
+var visibleEventStatuses = append([]string{EventStatusCancelled, EventStatusFinished}, ListedEventStatuses...)
+
+func CanTransition(from, to string) bool {
+	for _, s := range eventTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+func validEventStatus(status string) bool {
+	_, ok := eventTransitions[status]
+	return ok
+}
+
+// checkInitialStatus validates the status an event is created with, nil
+// means draft.
+func checkInitialStatus(status *string, publishAt *time.Time) (string, error) {
+	if status == nil || *status == EventStatusDraft {
+		return EventStatusDraft, nil
+	}
+	if !validEventStatus(*status) {
+		return "", ErrInvalidEventStatus
+	}
+	if !CanTransition(EventStatusDraft, *status) {
+		return "", ErrEventStatusTransition
+	}
+	if *status == EventStatusScheduled && (publishAt == nil || !publishAt.After(time.Now())) {
+		return "", ErrPublishTimeRequired
+	}
+	return *status, nil
+}
+
+// SetEventStatus moves an event to status. Scheduled events are published
+// automatically at publishAt by PublishScheduledEvents.
+func (m *EventRepo) SetEventStatus(id *int, status string, publishAt *time.Time) error {
+	if !validEventStatus(status) {
+		return ErrInvalidEventStatus
+	}
+	if status == EventStatusScheduled && (publishAt == nil || !publishAt.After(time.Now())) {
+		return ErrPublishTimeRequired
+	}
+	ctx := context.Background()
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var current string
+	err = tx.QueryRow(ctx, `SELECT status FROM events WHERE id = $1 FOR UPDATE`, id).Scan(&current)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrEventNotFound
+		}
+		return err
+	}
+	if !CanTransition(current, status) {
+		return ErrEventStatusTransition
+	}
+	if status != EventStatusScheduled {
+		publishAt = nil
+	}
+	_, err = tx.Exec(ctx, `UPDATE events SET status = $2, publish_at = $3, updated_at = $4 WHERE id = $1`, id, status, publishAt, time.Now())
+	if err != nil {
+		return err
+	}
+	// Inventory freed while the event was off sale waits for this moment
+	if isOfferable(status) && !isOfferable(current) {
+		err = offerEventWaitlist(ctx, tx, *id)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// PublishScheduledEvents publishes the scheduled events whose publish time
+// has come and returns how many were published.
+func (m *EventRepo) PublishScheduledEvents() (int64, error) {
+	tx, err := m.DB.Begin(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(context.Background())
+	tag, err := tx.Exec(context.Background(), `UPDATE events SET status = $1, updated_at = $2
+		WHERE status = $3 AND publish_at <= now()`, EventStatusPublished, time.Now(), EventStatusScheduled)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), tx.Commit(context.Background())
+}
+
+// purchasableEventStatuses accept purchases. offerableEventStatuses also
+// accept waitlist offers and the purchase of an offered hold, a sold out
+// event is the one the waitlist is for.
+var (
+	purchasableEventStatuses = []string{EventStatusOnSale}
+	offerableEventStatuses   = []string{EventStatusOnSale, EventStatusSoldOut}
+)
+
+func isOfferable(status string) bool {
+	return status == EventStatusOnSale || status == EventStatusSoldOut
+}
+
+// eventInStatus reports whether the event isn't deleted and is in one of
+// statuses.
+func eventInStatus(ctx context.Context, tx pgx.Tx, eventId int, statuses []string) (bool, error) {
+	var onSale bool
+	err := tx.QueryRow(ctx, `SELECT status = ANY($2) AND deleted_at IS NULL FROM events WHERE id = $1`, eventId, statuses).Scan(&onSale)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	return onSale, err
+}
+
+// offerEventWaitlist offers every free ticket type and seat of the event to
+// its waitlist.
+func offerEventWaitlist(ctx context.Context, tx pgx.Tx, eventId int) error {
+	rows, err := tx.Query(ctx, `SELECT tt.id FROM ticket_types_no_shah tt
+		JOIN event_days_no_shah d ON d.id = tt.event_day_id
+		WHERE d.event_id = $1 AND tt.amount > tt.sold_count ORDER BY tt.id`, eventId)
+	if err != nil {
+		return err
+	}
+	ticketTypeIds, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return err
+	}
+	rows, err = tx.Query(ctx, `SELECT s.id FROM shah_seats s WHERE s.event_id = $1
+		AND NOT EXISTS(SELECT 1 FROM tickets_shah t WHERE t.seat_id = s.id AND t.refunded_at IS NULL) ORDER BY s.id`, eventId)
+	if err != nil {
+		return err
+	}
+	seatIds, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return err
+	}
+	return offerWaitlist(ctx, tx, ticketTypeIds, seatIds)
+}
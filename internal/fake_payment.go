@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const FakeSignatureHeader = "X-Fake-Signature"
+
+// FakeProvider is a payment gateway for development and tests. With
+// AutoSettle an intent is settled after Delay from the moment Settle is
+// called for it, once its payment is stored, by posting a signed callback to
+// CallbackURL. The outcome is chosen by Succeed. Without it callbacks have to
+// be signed and posted by hand.
+//
+// Intents are only kept in memory, ones created before a restart are taken
+// as captured in full.
+type FakeProvider struct {
+	Secret      []byte
+	CallbackURL string
+	AutoSettle  bool
+	Succeed     bool
+	Delay       time.Duration
+	Client      *http.Client
+
+	mu      sync.Mutex
+	intents map[string]Money
+	refunds map[string]string
+}
+
+func NewFakeProvider(secret []byte, callbackURL string) *FakeProvider {
+	return &FakeProvider{
+		Secret:      secret,
+		CallbackURL: callbackURL,
+		Succeed:     true,
+		Delay:       2 * time.Second,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		intents:     make(map[string]Money),
+		refunds:     make(map[string]string),
+	}
+}
+
+func (p *FakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *FakeProvider) CreateIntent(orderId int, amount Money) (*PaymentIntent, error) {
+	id := "fake_" + uuid.NewString()
+	p.mu.Lock()
+	p.intents[id] = amount
+	p.mu.Unlock()
+
+	status := PaymentStatusPending
+	name := p.Name()
+	intent := PaymentIntent{Id: &id, Provider: &name, OrderId: &orderId, Amount: &amount, Status: &status}
+	return &intent, nil
+}
+
+// Settle starts settling an intent. It has to be called after the payment of
+// the intent is stored, otherwise the callback could find no payment.
+func (p *FakeProvider) Settle(intentId string) {
+	if !p.AutoSettle {
+		return
+	}
+	outcome := PaymentStatusFailed
+	if p.Succeed {
+		outcome = PaymentStatusSucceeded
+	}
+	go func() {
+		time.Sleep(p.Delay)
+		err := p.sendCallback(PaymentEvent{IntentId: intentId, Status: outcome})
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+	}()
+}
+
+func (p *FakeProvider) Capture(intentId string) error {
+	return nil
+}
+
+func (p *FakeProvider) Refund(intentId string, amount Money, key string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if refundId, ok := p.refunds[key]; ok {
+		return refundId, nil
+	}
+	captured, ok := p.intents[intentId]
+	if !ok {
+		captured = amount
+	}
+	if amount.Currency != captured.Currency {
+		return "", fmt.Errorf("fake provider: refund in %s of a payment in %s", amount.Currency, captured.Currency)
+	}
+	if amount.Amount <= 0 || amount.Amount > captured.Amount {
+		return "", fmt.Errorf("fake provider: refund of %s exceeds captured amount %s", amount, captured)
+	}
+	p.intents[intentId] = captured.Sub(amount)
+	refundId := "fake_refund_" + uuid.NewString()
+	p.refunds[key] = refundId
+	return refundId, nil
+}
+
+func (p *FakeProvider) VerifyWebhook(payload []byte, header http.Header) (*PaymentEvent, error) {
+	signature, err := hex.DecodeString(header.Get(FakeSignatureHeader))
+	if err != nil || !hmac.Equal(signature, p.sign(payload)) {
+		return nil, ErrInvalidSignature
+	}
+	var event PaymentEvent
+	err = json.Unmarshal(payload, &event)
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+func (p *FakeProvider) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, p.Secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func (p *FakeProvider) sendCallback(event PaymentEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.CallbackURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(FakeSignatureHeader, hex.EncodeToString(p.sign(payload)))
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fake provider: callback for %s returned %d", event.IntentId, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+const DefaultHoldTTL = 10 * time.Minute
+
+const (
+	HoldStatusActive    = "active"
+	HoldStatusConverted = "converted"
+	HoldStatusReleased  = "released"
+	HoldStatusExpired   = "expired"
+)
+
+var (
+	ErrHoldNotFound  = errors.New("hold not found")
+	ErrHoldNotActive = errors.New("hold is not active")
+	ErrHoldExpired   = errors.New("hold expired")
+)
+
+type HoldRepo struct {
+	DB *pgxpool.Pool
+}
+
+type HoldItem struct {
+	TicketTypeId *int `json:"ticketTypeId"`
+	Count        *int `json:"count"`
+}
+
+type Hold struct {
+	Id            *int       `json:"id"`
+	UserId        *int       `json:"userId"`
+	Status        *string    `json:"status"`
+	CreatedAt     *time.Time `json:"createdAt"`
+	ExpiresAt     *time.Time `json:"expiresAt"`
+	TicketIds     []int      `json:"ticketIds"`
+	SeatTicketIds []int      `json:"seatTicketIds"`
+}
+
+func (r *HoldRepo) CreateHold(userId *int, sessionToken *string, items []*HoldItem, seats []*SeatPurchase, ttl time.Duration) (*Hold, error) {
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	h, err := createHold(ctx, tx, userId, sessionToken, items, seats, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// createHold reserves every GA item and seat under a single hold inside tx.
+func createHold(ctx context.Context, tx pgx.Tx, userId *int, sessionToken *string, items []*HoldItem, seats []*SeatPurchase, ttl time.Duration) (*Hold, error) {
+	if len(items) == 0 && len(seats) == 0 {
+		return nil, ErrInvalidTicketsCount
+	}
+	h, err := insertHold(ctx, tx, userId, sessionToken, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		if item == nil || item.TicketTypeId == nil || item.Count == nil || *item.Count <= 0 {
+			return nil, ErrInvalidTicketsCount
+		}
+		res, err := reserveTicketsNoShah(ctx, tx, item.TicketTypeId, userId, *item.Count, h.Id, purchasableEventStatuses)
+		if err != nil {
+			return nil, err
+		}
+		h.TicketIds = append(h.TicketIds, res.TicketIDs...)
+	}
+
+	if len(seats) > 0 {
+		res, err := reserveSeatsShah(ctx, tx, userId, seats, h.Id, purchasableEventStatuses)
+		if err != nil {
+			return nil, err
+		}
+		h.SeatTicketIds = append(h.SeatTicketIds, res.TicketIDs...)
+	}
+	return h, nil
+}
+
+func insertHold(ctx context.Context, tx pgx.Tx, userId *int, sessionToken *string, ttl time.Duration) (*Hold, error) {
+	h := Hold{UserId: userId, TicketIds: make([]int, 0), SeatTicketIds: make([]int, 0)}
+	err := tx.QueryRow(ctx, `INSERT INTO holds (user_id, session_token, status, expires_at)
+		VALUES ($1, $2, $3, now() + $4 * interval '1 second') RETURNING id, status, created_at, expires_at`,
+		userId, sessionToken, HoldStatusActive, ttl.Seconds()).Scan(&h.Id, &h.Status, &h.CreatedAt, &h.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// lockHold locks an active hold owned by the given user and session.
+func lockHold(ctx context.Context, tx pgx.Tx, holdId, userId *int, sessionToken *string) (*Hold, error) {
+	var h Hold
+	var sessionMatches bool
+	// Holds offered from the waitlist aren't tied to a session
+	err := tx.QueryRow(ctx, `SELECT id, user_id, status, created_at, expires_at, session_token IS NULL OR session_token IS NOT DISTINCT FROM $3
+		FROM holds WHERE id = $1 AND user_id = $2 FOR UPDATE`, holdId, userId, sessionToken).
+		Scan(&h.Id, &h.UserId, &h.Status, &h.CreatedAt, &h.ExpiresAt, &sessionMatches)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrHoldNotFound
+		}
+		return nil, err
+	}
+	if !sessionMatches {
+		return nil, ErrHoldNotFound
+	}
+	if *h.Status != HoldStatusActive {
+		return nil, ErrHoldNotActive
+	}
+	if h.ExpiresAt.Before(time.Now()) {
+		return nil, ErrHoldExpired
+	}
+	return &h, nil
+}
+
+// convertHold turns the reserved inventory of a locked hold into sold tickets.
+func convertHold(ctx context.Context, tx pgx.Tx, h *Hold) error {
+	h.TicketIds = make([]int, 0)
+	h.SeatTicketIds = make([]int, 0)
+	rows, err := tx.Query(ctx, `UPDATE tickets_no_shah SET is_reserved = false, purchase_time = now() WHERE hold_id = $1 AND is_reserved RETURNING id`, h.Id)
+	if err != nil {
+		return err
+	}
+	h.TicketIds, err = pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return err
+	}
+	rows, err = tx.Query(ctx, `UPDATE tickets_shah SET is_reserved = false, purchase_time = now() WHERE hold_id = $1 AND is_reserved RETURNING id`, h.Id)
+	if err != nil {
+		return err
+	}
+	h.SeatTicketIds, err = pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return err
+	}
+	rows, err = tx.Query(ctx, `SELECT seat_id FROM tickets_shah WHERE id = ANY($1)`, h.SeatTicketIds)
+	if err != nil {
+		return err
+	}
+	seatIds, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return err
+	}
+	err = notifySeats(ctx, tx, seatIds, SeatStateSold)
+	if err != nil {
+		return err
+	}
+	status := HoldStatusConverted
+	_, err = tx.Exec(ctx, `UPDATE holds SET status = $1 WHERE id = $2`, status, h.Id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `UPDATE waitlist_entries SET status = $1 WHERE hold_id = $2 AND status = $3`, WaitlistStatusFulfilled, h.Id, WaitlistStatusOffered)
+	if err != nil {
+		return err
+	}
+	h.Status = &status
+	return nil
+}
+
+func (r *HoldRepo) ReleaseHold(holdId, userId *int, sessionToken *string) error {
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// An expired hold is still released here so the user doesn't wait for the sweeper
+	_, err = lockHold(ctx, tx, holdId, userId, sessionToken)
+	if err != nil && !errors.Is(err, ErrHoldExpired) {
+		return err
+	}
+	err = releaseHold(ctx, tx, holdId, HoldStatusReleased)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// ReleaseExpiredHolds returns the inventory of every hold whose TTL has passed
+// back to the pool and reports how many holds were expired. Each hold is
+// released with its waitlist offers in its own transaction, one that fails
+// is skipped until the next sweep and the last failure is returned.
+func (r *HoldRepo) ReleaseExpiredHolds() (int, error) {
+	rows, err := r.DB.Query(context.Background(), `SELECT id FROM holds WHERE status = $1 AND expires_at < now() ORDER BY id`, HoldStatusActive)
+	if err != nil {
+		return 0, err
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return 0, err
+	}
+	released := 0
+	var failed error
+	for _, id := range ids {
+		ok, err := r.releaseExpiredHold(id)
+		if err != nil {
+			failed = err
+			continue
+		}
+		if ok {
+			released++
+		}
+	}
+	return released, failed
+}
+
+// releaseExpiredHold expires one hold unless it was converted, released or
+// is being worked on meanwhile.
+func (r *HoldRepo) releaseExpiredHold(id int) (bool, error) {
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, `SELECT id FROM holds WHERE id = $1 AND status = $2 AND expires_at < now() FOR UPDATE SKIP LOCKED`, id, HoldStatusActive).Scan(&id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	err = releaseHold(ctx, tx, &id, HoldStatusExpired)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// releaseHold deletes the still reserved tickets of a locked hold, gives
+// their inventory back and cancels the pending order placed with the hold.
+// The freed inventory is offered to the waitlist.
+func releaseHold(ctx context.Context, tx pgx.Tx, holdId *int, status string) error {
+	rows, err := tx.Query(ctx, `
+		WITH released AS (
+			DELETE FROM tickets_no_shah WHERE hold_id = $1 AND is_reserved RETURNING ticket_type_id
+		), counts AS (
+			SELECT ticket_type_id, count(*) AS cnt FROM released GROUP BY ticket_type_id
+		)
+		UPDATE ticket_types_no_shah t
+		SET sold_count = t.sold_count - counts.cnt, version = t.version + 1
+		FROM counts
+		WHERE t.id = counts.ticket_type_id
+		RETURNING t.id
+	`, holdId)
+	if err != nil {
+		return err
+	}
+	ticketTypeIds, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return err
+	}
+	rows, err = tx.Query(ctx, `DELETE FROM tickets_shah WHERE hold_id = $1 AND is_reserved RETURNING seat_id`, holdId)
+	if err != nil {
+		return err
+	}
+	seatIds, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `UPDATE waitlist_entries SET status = $1 WHERE hold_id = $2 AND status = $3`, WaitlistStatusExpired, holdId, WaitlistStatusOffered)
+	if err != nil {
+		return err
+	}
+	// A cancelled order gives its promo code redemption back
+	_, err = tx.Exec(ctx, `
+		WITH released AS (
+			DELETE FROM promo_redemptions r USING orders o
+			WHERE r.order_id = o.id AND o.hold_id = $1 AND o.status = $2
+			RETURNING r.promo_code_id
+		)
+		UPDATE promo_codes p SET used_count = p.used_count - 1
+		FROM released WHERE p.id = released.promo_code_id
+	`, holdId, OrderStatusPending)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `UPDATE orders SET status = $1, updated_at = now() WHERE hold_id = $2 AND status = $3`, OrderStatusCancelled, holdId, OrderStatusPending)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `UPDATE holds SET status = $1 WHERE id = $2`, status, holdId)
+	if err != nil {
+		return err
+	}
+	err = notifyTicketTypes(ctx, tx, ticketTypeIds)
+	if err != nil {
+		return err
+	}
+	err = notifySeats(ctx, tx, seatIds, SeatStateReleased)
+	if err != nil {
+		return err
+	}
+	return offerWaitlist(ctx, tx, ticketTypeIds, seatIds)
+}
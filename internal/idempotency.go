@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// IdempotencyKeyTTL is how long a stored response is replayed.
+const IdempotencyKeyTTL = 24 * time.Hour
+
+var (
+	ErrIdempotencyKeyReused     = errors.New("idempotency key was used with a different request")
+	ErrIdempotencyKeyInProgress = errors.New("a request with this idempotency key is in progress")
+)
+
+type IdempotencyRepo struct {
+	DB *pgxpool.Pool
+}
+
+// StoredResponse is the response of the first request sent with a key.
+type StoredResponse struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+// Claim reserves the key for a request. It returns nil when the caller is
+// the first to use the key and should run the request, the stored response
+// when the same request already completed, ErrIdempotencyKeyReused when the
+// key came with another request and ErrIdempotencyKeyInProgress while the
+// first request is still running.
+func (r *IdempotencyRepo) Claim(scope, key, requestHash string) (*StoredResponse, error) {
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// A key past its TTL is taken over as if it was never used
+	var claimed bool
+	err = tx.QueryRow(ctx, `INSERT INTO idempotency_keys (scope, key, request_hash) VALUES ($1, $2, $3)
+		ON CONFLICT (scope, key) DO UPDATE SET request_hash = excluded.request_hash, status_code = NULL,
+			content_type = NULL, response = NULL, created_at = now()
+		WHERE idempotency_keys.created_at < now() - $4 * interval '1 second'
+		RETURNING true`, scope, key, requestHash, int(IdempotencyKeyTTL.Seconds())).Scan(&claimed)
+	if err == nil {
+		return nil, tx.Commit(ctx)
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+
+	var storedHash string
+	var status *int
+	var contentType *string
+	var body []byte
+	err = tx.QueryRow(ctx, `SELECT request_hash, status_code, content_type, response FROM idempotency_keys WHERE scope = $1 AND key = $2`,
+		scope, key).Scan(&storedHash, &status, &contentType, &body)
+	if err != nil {
+		return nil, err
+	}
+	if storedHash != requestHash {
+		return nil, ErrIdempotencyKeyReused
+	}
+	if status == nil {
+		return nil, ErrIdempotencyKeyInProgress
+	}
+	res := StoredResponse{StatusCode: *status, Body: body}
+	if contentType != nil {
+		res.ContentType = *contentType
+	}
+	return &res, tx.Commit(ctx)
+}
+
+// Save stores the response of a claimed key for replays.
+func (r *IdempotencyRepo) Save(scope, key string, res *StoredResponse) error {
+	tx, err := r.DB.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+	_, err = tx.Exec(context.Background(), `UPDATE idempotency_keys SET status_code = $3, content_type = $4, response = $5 WHERE scope = $1 AND key = $2`,
+		scope, key, res.StatusCode, res.ContentType, res.Body)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// Forget drops a claimed key so the request can be retried with it, used
+// when the request failed before it changed anything.
+func (r *IdempotencyRepo) Forget(scope, key string) error {
+	tx, err := r.DB.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+	_, err = tx.Exec(context.Background(), `DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2`, scope, key)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// DeleteExpiredKeys removes keys past their TTL and reports how many.
+func (r *IdempotencyRepo) DeleteExpiredKeys() (int64, error) {
+	tx, err := r.DB.Begin(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(context.Background())
+	tag, err := tx.Exec(context.Background(), `DELETE FROM idempotency_keys WHERE created_at < now() - $1 * interval '1 second'`, int(IdempotencyKeyTTL.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), tx.Commit(context.Background())
+}
@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	CurrencyKZT = "KZT"
+	CurrencyRUB = "RUB"
+	CurrencyUSD = "USD"
+)
+
+// DefaultCurrency is the currency of events that don't set one.
+const DefaultCurrency = CurrencyKZT
+
+// currencyExponents is the number of minor unit digits of every currency
+// events can be sold in.
+var currencyExponents = map[string]int{
+	CurrencyKZT: 2,
+	CurrencyRUB: 2,
+	CurrencyUSD: 2,
+}
+
+var (
+	ErrUnsupportedCurrency = errors.New("unsupported currency")
+	ErrCurrencyMismatch    = errors.New("currency doesn't match the event currency")
+	ErrInvalidAmount       = errors.New("invalid amount")
+)
+
+// Money is an amount in the minor units of its currency, tiyn for KZT,
+// kopecks for RUB and cents for USD. Arithmetic stays in integers, rounding
+// happens only where a fraction of an amount is taken.
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+func NewMoney(amount int64, currency string) *Money {
+	return &Money{Amount: amount, Currency: currency}
+}
+
+// ValidCurrency reports whether events can be sold in the currency.
+func ValidCurrency(currency string) bool {
+	_, ok := currencyExponents[currency]
+	return ok
+}
+
+// Add returns m + o, both must be in the same currency.
+func (m Money) Add(o Money) Money {
+	return Money{Amount: m.Amount + o.Amount, Currency: m.Currency}
+}
+
+func (m Money) Sub(o Money) Money {
+	return Money{Amount: m.Amount - o.Amount, Currency: m.Currency}
+}
+
+func (m Money) Mul(n int) Money {
+	return Money{Amount: m.Amount * int64(n), Currency: m.Currency}
+}
+
+// Percent returns p percent of m rounded half away from zero to the minor
+// unit.
+func (m Money) Percent(p int) Money {
+	v := m.Amount * int64(p)
+	if v < 0 {
+		return Money{Amount: (v - 50) / 100, Currency: m.Currency}
+	}
+	return Money{Amount: (v + 50) / 100, Currency: m.Currency}
+}
+
+// Min returns the smaller of m and o.
+func (m Money) Min(o Money) Money {
+	if o.Amount < m.Amount {
+		return o
+	}
+	return m
+}
+
+// String formats m in major units, e.g. "1500.00 KZT".
+func (m Money) String() string {
+	return m.Major() + " " + m.Currency
+}
+
+// Major formats the amount in major units without the currency.
+func (m Money) Major() string {
+	exp := currencyExponents[m.Currency]
+	sign := ""
+	amount := m.Amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	if exp == 0 {
+		return fmt.Sprintf("%s%d", sign, amount)
+	}
+	unit := int64(1)
+	for i := 0; i < exp; i++ {
+		unit *= 10
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/unit, exp, amount%unit)
+}
+
+// Totals sums amounts per currency, amounts in different currencies are
+// never added up.
+type Totals []Money
+
+// Add returns the totals with m added to the total of its currency.
+func (t Totals) Add(m Money) Totals {
+	for i := range t {
+		if t[i].Currency == m.Currency {
+			t[i].Amount += m.Amount
+			return t
+		}
+	}
+	return append(t, m)
+}
+
+func (t Totals) MarshalJSON() ([]byte, error) {
+	if t == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal([]Money(t))
+}
+
+// checkPrice validates a price given for an event in currency. A price
+// without a currency takes the event currency.
+func checkPrice(m *Money, currency string) error {
+	if m == nil || m.Amount < 0 {
+		return ErrInvalidAmount
+	}
+	if m.Currency == "" {
+		m.Currency = currency
+	}
+	if m.Currency != currency {
+		return ErrCurrencyMismatch
+	}
+	return nil
+}
+
+// moneyOrNil builds a Money from a nullable amount column.
+func moneyOrNil(amount *int64, currency string) *Money {
+	if amount == nil {
+		return nil
+	}
+	return NewMoney(*amount, currency)
+}
+
+// eventCurrency returns the currency the event is sold in.
+func eventCurrency(ctx context.Context, tx pgx.Tx, eventId *int) (string, error) {
+	var currency string
+	err := tx.QueryRow(ctx, `SELECT currency FROM events WHERE id = $1`, eventId).Scan(&currency)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", ErrEventNotFound
+		}
+		return "", err
+	}
+	return currency, nil
+}
@@ -0,0 +1,580 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+const (
+	OrderStatusPending   = "pending"
+	OrderStatusPaid      = "paid"
+	OrderStatusCancelled = "cancelled"
+	OrderStatusRefunded  = "refunded"
+)
+
+var (
+	ErrOrderNotFound    = errors.New("order not found")
+	ErrOrderNotPending  = errors.New("order is not pending")
+	ErrOrderMixedEvents = errors.New("order items belong to different events")
+)
+
+type OrderRepo struct {
+	DB *pgxpool.Pool
+}
+
+type Order struct {
+	Id          *int         `json:"id"`
+	UserId      *int         `json:"userId"`
+	EventId     *int         `json:"eventId"`
+	HoldId      *int         `json:"holdId"`
+	Status      *string      `json:"status"`
+	PromoCodeId *int         `json:"promoCodeId"`
+	PromoCode   *string      `json:"promoCode"`
+	Currency    *string      `json:"currency"`
+	Subtotal    *Money       `json:"subtotal"`
+	Discount    *Money       `json:"discount"`
+	Total       *Money       `json:"total"`
+	CreatedAt   *time.Time   `json:"createdAt"`
+	UpdatedAt   *time.Time   `json:"updatedAt"`
+	Items       []*OrderItem `json:"items"`
+}
+
+type OrderItem struct {
+	Id               *int    `json:"id"`
+	OrderId          *int    `json:"orderId"`
+	TicketTypeId     *int    `json:"ticketTypeId"`
+	SeatId           *int    `json:"seatId"`
+	ShahTicketTypeId *int    `json:"shahTicketTypeId"`
+	Name             *string `json:"name"`
+	Quantity         *int    `json:"quantity"`
+	UnitPrice        *Money  `json:"unitPrice"`
+	UnitDiscount     *Money  `json:"unitDiscount"`
+	Total            *Money  `json:"total"`
+	TicketIds        []int   `json:"ticketIds"`
+}
+
+// CreateOrder reserves every GA item and seat under one hold and records a
+// pending order for them. All items must belong to the same event. An
+// optional promo code is redeemed together with the order.
+func (r *OrderRepo) CreateOrder(userId *int, sessionToken *string, items []*HoldItem, seats []*SeatPurchase, promoCode *string, ttl time.Duration) (*Order, error) {
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	err = checkOrderItems(items, seats)
+	if err != nil {
+		return nil, err
+	}
+	hold, err := insertHold(ctx, tx, userId, sessionToken, ttl)
+	if err != nil {
+		return nil, err
+	}
+	// Reserving locks the ticket type rows, the tiers are priced from the
+	// sold counts under that lock
+	ticketIds := make([][]int, len(items))
+	for i, item := range items {
+		res, err := reserveTicketsNoShah(ctx, tx, item.TicketTypeId, userId, *item.Count, hold.Id, purchasableEventStatuses)
+		if err != nil {
+			return nil, err
+		}
+		ticketIds[i] = res.TicketIDs
+	}
+	var seatTicketIds []int
+	if len(seats) > 0 {
+		res, err := reserveSeatsShah(ctx, tx, userId, seats, hold.Id, purchasableEventStatuses)
+		if err != nil {
+			return nil, err
+		}
+		seatTicketIds = res.TicketIDs
+	}
+
+	o, err := priceOrder(ctx, tx, userId, items, seats, ticketIds)
+	if err != nil {
+		return nil, err
+	}
+	o.HoldId = hold.Id
+	for i, id := range seatTicketIds {
+		o.Items[len(o.Items)-len(seats)+i].TicketIds = []int{id}
+	}
+	err = applyOrderPromoCode(ctx, tx, o, promoCode)
+	if err != nil {
+		return nil, err
+	}
+
+	err = insertOrder(ctx, tx, o)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// QuoteOrder prices the items like CreateOrder would, with the promo code
+// applied, without reserving anything.
+func (r *OrderRepo) QuoteOrder(userId *int, items []*HoldItem, seats []*SeatPurchase, promoCode *string) (*Order, error) {
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	o, err := priceOrder(ctx, tx, userId, items, seats, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = applyOrderPromoCode(ctx, tx, o, promoCode)
+	if err != nil {
+		return nil, err
+	}
+	computeOrderTotals(o)
+	return o, nil
+}
+
+func checkOrderItems(items []*HoldItem, seats []*SeatPurchase) error {
+	if len(items) == 0 && len(seats) == 0 {
+		return ErrInvalidTicketsCount
+	}
+	for _, item := range items {
+		if item == nil || item.TicketTypeId == nil || item.Count == nil || *item.Count <= 0 {
+			return ErrInvalidTicketsCount
+		}
+	}
+	for _, seat := range seats {
+		if seat == nil || seat.SeatId == nil || seat.TicketTypeId == nil {
+			return ErrInvalidTicketsCount
+		}
+	}
+	return nil
+}
+
+// priceOrder builds the unsaved items of an order from the current prices,
+// GA items are split by price tier. ticketIds holds the tickets of each GA
+// item when they were already reserved in tx, they count in sold_count and
+// each item is priced by the tickets taken before it.
+func priceOrder(ctx context.Context, tx pgx.Tx, userId *int, items []*HoldItem, seats []*SeatPurchase, ticketIds [][]int) (*Order, error) {
+	err := checkOrderItems(items, seats)
+	if err != nil {
+		return nil, err
+	}
+	reserved := make(map[int]int)
+	if ticketIds != nil {
+		for _, item := range items {
+			reserved[*item.TicketTypeId] += *item.Count
+		}
+	}
+	before := make(map[int]int)
+	o := Order{UserId: userId, Items: make([]*OrderItem, 0)}
+	for i, item := range items {
+		oi := OrderItem{TicketTypeId: item.TicketTypeId, Quantity: item.Count}
+		if ticketIds != nil {
+			oi.TicketIds = ticketIds[i]
+		}
+		var eventId, sold int
+		var base Money
+		var date *time.Time
+		err := tx.QueryRow(ctx, `SELECT d.event_id, t.name, t.price, e.currency, t.sold_count, d.date FROM ticket_types_no_shah t
+			JOIN event_days_no_shah d ON d.id = t.event_day_id
+			JOIN events e ON e.id = d.event_id
+			WHERE t.id = $1`, item.TicketTypeId).Scan(&eventId, &oi.Name, &base.Amount, &base.Currency, &sold, &date)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil, ErrTicketTypeNotFound
+			}
+			return nil, err
+		}
+		tiered, err := tieredItems(ctx, tx, &oi, base, sold-reserved[*item.TicketTypeId]+before[*item.TicketTypeId], date)
+		if err != nil {
+			return nil, err
+		}
+		before[*item.TicketTypeId] += *item.Count
+		if o.EventId != nil && *o.EventId != eventId {
+			return nil, ErrOrderMixedEvents
+		}
+		o.EventId = &eventId
+		o.Currency = &base.Currency
+		o.Items = append(o.Items, tiered...)
+	}
+	for _, seat := range seats {
+		one := 1
+		oi := OrderItem{SeatId: seat.SeatId, ShahTicketTypeId: seat.TicketTypeId, Quantity: &one}
+		var eventId *int
+		price := Money{}
+		err := tx.QueryRow(ctx, `SELECT s.event_id, t.name, t.price, e.currency FROM shah_seats s
+			JOIN events e ON e.id = s.event_id
+			JOIN shah_ticket_types t ON t.id = $2
+			WHERE s.id = $1`, seat.SeatId, seat.TicketTypeId).Scan(&eventId, &oi.Name, &price.Amount, &price.Currency)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil, ErrSeatNotFound
+			}
+			return nil, err
+		}
+		if eventId == nil || (o.EventId != nil && *o.EventId != *eventId) {
+			return nil, ErrOrderMixedEvents
+		}
+		err = checkSeatTicketType(ctx, tx, seat.SeatId, seat.TicketTypeId)
+		if err != nil {
+			return nil, err
+		}
+		oi.UnitPrice = &price
+		o.EventId = eventId
+		o.Currency = &price.Currency
+		o.Items = append(o.Items, &oi)
+	}
+	return &o, nil
+}
+
+// applyOrderPromoCode locks and applies the promo code when one is given.
+func applyOrderPromoCode(ctx context.Context, tx pgx.Tx, o *Order, promoCode *string) error {
+	if promoCode == nil || *promoCode == "" {
+		return nil
+	}
+	p, err := lockPromoCode(ctx, tx, *promoCode, o.UserId)
+	if err != nil {
+		return err
+	}
+	return applyPromoCode(o, p)
+}
+
+// CreateOrderFromHold places a pending order for the inventory reserved by
+// an active hold. The order takes over the hold until it is paid.
+func (r *OrderRepo) CreateOrderFromHold(holdId, userId *int, sessionToken *string, promoCode *string) (*Order, error) {
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	hold, err := lockHold(ctx, tx, holdId, userId, sessionToken)
+	if err != nil {
+		return nil, err
+	}
+	var taken bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM orders WHERE hold_id = $1)`, hold.Id).Scan(&taken)
+	if err != nil {
+		return nil, err
+	}
+	if taken {
+		return nil, ErrHoldNotActive
+	}
+
+	o := Order{UserId: userId, HoldId: hold.Id, Items: make([]*OrderItem, 0)}
+	rows, err := tx.Query(ctx, `SELECT t.ticket_type_id, d.event_id, tt.name, tt.price, e.currency, tt.sold_count, d.date, array_agg(t.id ORDER BY t.id)
+		FROM tickets_no_shah t
+		JOIN ticket_types_no_shah tt ON tt.id = t.ticket_type_id
+		JOIN event_days_no_shah d ON d.id = tt.event_day_id
+		JOIN events e ON e.id = d.event_id
+		WHERE t.hold_id = $1 AND t.is_reserved
+		GROUP BY t.ticket_type_id, d.event_id, tt.name, tt.price, e.currency, tt.sold_count, d.date
+		ORDER BY t.ticket_type_id`, hold.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	eventIds := make([]*int, 0)
+	// Held tickets are already counted in sold_count, price them by the count before the hold
+	type heldItem struct {
+		oi   *OrderItem
+		base Money
+		sold int
+		date *time.Time
+	}
+	heldItems := make([]heldItem, 0)
+	for rows.Next() {
+		var oi OrderItem
+		var eventId *int
+		var base Money
+		var sold int
+		var date *time.Time
+		err = rows.Scan(&oi.TicketTypeId, &eventId, &oi.Name, &base.Amount, &base.Currency, &sold, &date, &oi.TicketIds)
+		if err != nil {
+			return nil, err
+		}
+		quantity := len(oi.TicketIds)
+		oi.Quantity = &quantity
+		eventIds = append(eventIds, eventId)
+		o.Currency = &base.Currency
+		heldItems = append(heldItems, heldItem{oi: &oi, base: base, sold: sold - quantity, date: date})
+	}
+	rows.Close()
+	for _, h := range heldItems {
+		tiered, err := tieredItems(ctx, tx, h.oi, h.base, h.sold, h.date)
+		if err != nil {
+			return nil, err
+		}
+		o.Items = append(o.Items, tiered...)
+	}
+
+	rows, err = tx.Query(ctx, `SELECT t.id, t.seat_id, t.ticket_type_id, s.event_id, tt.name, tt.price, e.currency
+		FROM tickets_shah t
+		JOIN shah_seats s ON s.id = t.seat_id
+		JOIN shah_ticket_types tt ON tt.id = t.ticket_type_id
+		JOIN events e ON e.id = s.event_id
+		WHERE t.hold_id = $1 AND t.is_reserved
+		ORDER BY t.id`, hold.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		oi := OrderItem{UnitPrice: &Money{}}
+		var ticketId int
+		var eventId *int
+		err = rows.Scan(&ticketId, &oi.SeatId, &oi.ShahTicketTypeId, &eventId, &oi.Name, &oi.UnitPrice.Amount, &oi.UnitPrice.Currency)
+		if err != nil {
+			return nil, err
+		}
+		o.Currency = &oi.UnitPrice.Currency
+		one := 1
+		oi.Quantity = &one
+		oi.TicketIds = []int{ticketId}
+		o.Items = append(o.Items, &oi)
+		eventIds = append(eventIds, eventId)
+	}
+	rows.Close()
+
+	if len(o.Items) == 0 {
+		return nil, ErrHoldNotActive
+	}
+	for _, eventId := range eventIds {
+		if eventId == nil || (o.EventId != nil && *o.EventId != *eventId) {
+			return nil, ErrOrderMixedEvents
+		}
+		o.EventId = eventId
+	}
+	// A waitlist offer can still be bought once the event is marked sold out
+	statuses := purchasableEventStatuses
+	var offered bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM waitlist_entries WHERE hold_id = $1)`, hold.Id).Scan(&offered)
+	if err != nil {
+		return nil, err
+	}
+	if offered {
+		statuses = offerableEventStatuses
+	}
+	onSale, err := eventInStatus(ctx, tx, *o.EventId, statuses)
+	if err != nil {
+		return nil, err
+	}
+	if !onSale {
+		return nil, ErrEventNotOnSale
+	}
+	err = applyOrderPromoCode(ctx, tx, &o, promoCode)
+	if err != nil {
+		return nil, err
+	}
+
+	err = insertOrder(ctx, tx, &o)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// computeOrderTotals fills in the item totals and the order subtotal,
+// discount and total in the order currency.
+func computeOrderTotals(o *Order) {
+	subtotal, discount := Money{Currency: *o.Currency}, Money{Currency: *o.Currency}
+	for _, oi := range o.Items {
+		if oi.UnitDiscount == nil {
+			oi.UnitDiscount = NewMoney(0, *o.Currency)
+		}
+		t := oi.UnitPrice.Sub(*oi.UnitDiscount).Mul(*oi.Quantity)
+		oi.Total = &t
+		subtotal = subtotal.Add(oi.UnitPrice.Mul(*oi.Quantity))
+		discount = discount.Add(oi.UnitDiscount.Mul(*oi.Quantity))
+	}
+	total := subtotal.Sub(discount)
+	o.Subtotal = &subtotal
+	o.Discount = &discount
+	o.Total = &total
+}
+
+// insertOrder stores a pending order with its items, links the reserved
+// tickets of every item to it and redeems the applied promo code.
+func insertOrder(ctx context.Context, tx pgx.Tx, o *Order) error {
+	computeOrderTotals(o)
+
+	err := tx.QueryRow(ctx, `INSERT INTO orders (user_id, event_id, hold_id, status, promo_code_id, currency, subtotal, discount, total)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id, status, created_at, updated_at`,
+		o.UserId, o.EventId, o.HoldId, OrderStatusPending, o.PromoCodeId, o.Currency, o.Subtotal.Amount, o.Discount.Amount, o.Total.Amount).Scan(&o.Id, &o.Status, &o.CreatedAt, &o.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	if o.PromoCodeId != nil {
+		err = redeemPromoCode(ctx, tx, o)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, oi := range o.Items {
+		oi.OrderId = o.Id
+		err = tx.QueryRow(ctx, `INSERT INTO order_items (order_id, ticket_type_id, seat_id, shah_ticket_type_id, name, quantity, unit_price, unit_discount, total)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+			oi.OrderId, oi.TicketTypeId, oi.SeatId, oi.ShahTicketTypeId, oi.Name, oi.Quantity, oi.UnitPrice.Amount, oi.UnitDiscount.Amount, oi.Total.Amount).Scan(&oi.Id)
+		if err != nil {
+			return err
+		}
+		table := "tickets_no_shah"
+		if oi.SeatId != nil {
+			table = "tickets_shah"
+		}
+		_, err = tx.Exec(ctx, `UPDATE `+table+` SET order_item_id = $1 WHERE id = ANY($2)`, oi.Id, oi.TicketIds)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// payOrder issues the tickets reserved for a pending order and marks it paid.
+func payOrder(ctx context.Context, tx pgx.Tx, orderId *int) error {
+	var status string
+	var holdId *int
+	err := tx.QueryRow(ctx, `SELECT status, hold_id FROM orders WHERE id = $1 FOR UPDATE`, orderId).Scan(&status, &holdId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrOrderNotFound
+		}
+		return err
+	}
+	if status != OrderStatusPending {
+		return ErrOrderNotPending
+	}
+
+	var h Hold
+	err = tx.QueryRow(ctx, `SELECT id, user_id, status, created_at, expires_at FROM holds WHERE id = $1 FOR UPDATE`, holdId).
+		Scan(&h.Id, &h.UserId, &h.Status, &h.CreatedAt, &h.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	if *h.Status != HoldStatusActive {
+		return ErrHoldNotActive
+	}
+	// The sweeper may not have released an expired hold yet
+	if h.ExpiresAt.Before(time.Now()) {
+		return ErrHoldExpired
+	}
+	err = convertHold(ctx, tx, &h)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE orders SET status = $1, updated_at = now() WHERE id = $2`, OrderStatusPaid, orderId)
+	return err
+}
+
+const orderColumns = `o.id, o.user_id, o.event_id, o.hold_id, o.status, o.promo_code_id, p.code, o.currency, o.subtotal, o.discount, o.total, o.created_at, o.updated_at`
+
+// scanOrder reads a row of orderColumns.
+func scanOrder(row pgx.Row) (*Order, error) {
+	var o Order
+	var currency string
+	var subtotal, discount, total int64
+	err := row.Scan(&o.Id, &o.UserId, &o.EventId, &o.HoldId, &o.Status, &o.PromoCodeId, &o.PromoCode, &currency, &subtotal, &discount, &total, &o.CreatedAt, &o.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	o.Currency = &currency
+	o.Subtotal = NewMoney(subtotal, currency)
+	o.Discount = NewMoney(discount, currency)
+	o.Total = NewMoney(total, currency)
+	return &o, nil
+}
+
+func (r *OrderRepo) GetOrder(id *int) (*Order, error) {
+	tx, err := r.DB.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+	o, err := scanOrder(tx.QueryRow(context.Background(), `SELECT `+orderColumns+` FROM orders o
+		LEFT JOIN promo_codes p ON p.id = o.promo_code_id WHERE o.id = $1`, id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrOrderNotFound
+		}
+		return nil, err
+	}
+	o.Items, err = getOrderItems(context.Background(), tx, o.Id, *o.Currency)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (r *OrderRepo) GetOrdersByUser(userId *int) ([]*Order, error) {
+	tx, err := r.DB.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+	rows, err := tx.Query(context.Background(), `SELECT `+orderColumns+` FROM orders o
+		LEFT JOIN promo_codes p ON p.id = o.promo_code_id WHERE o.user_id = $1 ORDER BY o.id DESC`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orders := make([]*Order, 0)
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	rows.Close()
+	for _, o := range orders {
+		o.Items, err = getOrderItems(context.Background(), tx, o.Id, *o.Currency)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tx.Commit(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+func getOrderItems(ctx context.Context, tx pgx.Tx, orderId *int, currency string) ([]*OrderItem, error) {
+	rows, err := tx.Query(ctx, `SELECT i.id, i.order_id, i.ticket_type_id, i.seat_id, i.shah_ticket_type_id, i.name, i.quantity, i.unit_price, i.unit_discount, i.total,
+       COALESCE(
+           (SELECT array_agg(t.id ORDER BY t.id) FROM tickets_no_shah t WHERE t.order_item_id = i.id),
+           (SELECT array_agg(t.id ORDER BY t.id) FROM tickets_shah t WHERE t.order_item_id = i.id),
+           '{}')
+		FROM order_items i WHERE i.order_id = $1 ORDER BY i.id`, orderId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := make([]*OrderItem, 0)
+	for rows.Next() {
+		oi := OrderItem{UnitPrice: NewMoney(0, currency), UnitDiscount: NewMoney(0, currency), Total: NewMoney(0, currency)}
+		err = rows.Scan(&oi.Id, &oi.OrderId, &oi.TicketTypeId, &oi.SeatId, &oi.ShahTicketTypeId, &oi.Name, &oi.Quantity, &oi.UnitPrice.Amount, &oi.UnitDiscount.Amount, &oi.Total.Amount, &oi.TicketIds)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, &oi)
+	}
+	return items, rows.Err()
+}
@@ -0,0 +1,285 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	PaymentStatusPending   = "pending"
+	PaymentStatusSucceeded = "succeeded"
+	PaymentStatusFailed    = "failed"
+	PaymentStatusRefunded  = "refunded"
+	// PaymentStatusRefundDue marks money captured for an order that could no
+	// longer be paid, it stays until the refund goes through.
+	PaymentStatusRefundDue = "refund_due"
+)
+
+var (
+	ErrPaymentNotFound     = errors.New("payment not found")
+	ErrInvalidSignature    = errors.New("invalid webhook signature")
+	ErrUnknownPaymentEvent = errors.New("unknown payment event")
+)
+
+// PaymentProvider is implemented by every payment gateway. Amounts are in the
+// minor units of the order currency.
+type PaymentProvider interface {
+	Name() string
+	CreateIntent(orderId int, amount Money) (*PaymentIntent, error)
+	Capture(intentId string) error
+	// Refund sends amount back. A retry with the same key must not send it
+	// again and returns the refund made the first time.
+	Refund(intentId string, amount Money, key string) (string, error)
+	VerifyWebhook(payload []byte, header http.Header) (*PaymentEvent, error)
+}
+
+type PaymentIntent struct {
+	Id         *string `json:"id"`
+	Provider   *string `json:"provider"`
+	OrderId    *int    `json:"orderId"`
+	Amount     *Money  `json:"amount"`
+	Status     *string `json:"status"`
+	PaymentURL *string `json:"paymentUrl"`
+}
+
+// PaymentEvent is a verified provider callback about an intent.
+type PaymentEvent struct {
+	IntentId string `json:"intentId"`
+	Status   string `json:"status"`
+}
+
+type Payment struct {
+	Id        *int       `json:"id"`
+	OrderId   *int       `json:"orderId"`
+	Provider  *string    `json:"provider"`
+	IntentId  *string    `json:"intentId"`
+	Amount    *Money     `json:"amount"`
+	Status    *string    `json:"status"`
+	CreatedAt *time.Time `json:"createdAt"`
+	UpdatedAt *time.Time `json:"updatedAt"`
+}
+
+type PaymentRepo struct {
+	DB *pgxpool.Pool
+}
+
+func (r *PaymentRepo) CreatePayment(intent *PaymentIntent) (*Payment, error) {
+	tx, err := r.DB.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+	p := Payment{OrderId: intent.OrderId, Provider: intent.Provider, IntentId: intent.Id, Amount: intent.Amount}
+	err = tx.QueryRow(context.Background(), `INSERT INTO payments (order_id, provider, intent_id, amount, currency, status)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, status, created_at, updated_at`,
+		intent.OrderId, intent.Provider, intent.Id, intent.Amount.Amount, intent.Amount.Currency, PaymentStatusPending).Scan(&p.Id, &p.Status, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// CompletePayment records a successful payment and pays its order. A payment
+// for an order that expired or was cancelled in the meantime is marked
+// PaymentStatusRefundDue and has to be refunded with RefundUnpaidPayment. A
+// payment that was already completed is left as is.
+func (r *PaymentRepo) CompletePayment(provider, intentId *string) (*Payment, error) {
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	p, err := lockPayment(ctx, tx, provider, intentId)
+	if err != nil {
+		return nil, err
+	}
+	if *p.Status != PaymentStatusPending {
+		return p, nil
+	}
+
+	status := PaymentStatusSucceeded
+	err = payOrder(ctx, tx, p.OrderId)
+	if err != nil {
+		if !errors.Is(err, ErrOrderNotPending) && !errors.Is(err, ErrHoldNotActive) && !errors.Is(err, ErrHoldExpired) {
+			return nil, err
+		}
+		status = PaymentStatusRefundDue
+	}
+
+	err = setPaymentStatus(ctx, tx, p, status)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// RefundUnpaidPayment gives back a payment marked PaymentStatusRefundDue. The
+// payment row stays locked while the provider is called, so concurrent
+// callbacks refund it once, and a failed refund keeps it due for the next
+// retry. Payments in any other status are left as is.
+func (r *PaymentRepo) RefundUnpaidPayment(provider PaymentProvider, intentId *string) (*Payment, error) {
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	name := provider.Name()
+	p, err := lockPayment(ctx, tx, &name, intentId)
+	if err != nil {
+		return nil, err
+	}
+	if *p.Status != PaymentStatusRefundDue {
+		return p, nil
+	}
+	_, err = provider.Refund(*p.IntentId, *p.Amount, "payment-"+strconv.Itoa(*p.Id))
+	if err != nil {
+		return nil, err
+	}
+	err = setPaymentStatus(ctx, tx, p, PaymentStatusRefunded)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// FailPayment records a failed payment, cancels its order and releases the
+// inventory held for it.
+func (r *PaymentRepo) FailPayment(provider, intentId *string) (*Payment, error) {
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	p, err := lockPayment(ctx, tx, provider, intentId)
+	if err != nil {
+		return nil, err
+	}
+	if *p.Status != PaymentStatusPending {
+		return p, nil
+	}
+
+	var holdId *int
+	var status string
+	err = tx.QueryRow(ctx, `SELECT status, hold_id FROM orders WHERE id = $1 FOR UPDATE`, p.OrderId).Scan(&status, &holdId)
+	if err != nil {
+		return nil, err
+	}
+	if status == OrderStatusPending {
+		var holdStatus string
+		err = tx.QueryRow(ctx, `SELECT status FROM holds WHERE id = $1 FOR UPDATE`, holdId).Scan(&holdStatus)
+		if err != nil {
+			return nil, err
+		}
+		if holdStatus == HoldStatusActive {
+			err = releaseHold(ctx, tx, holdId, HoldStatusReleased)
+			if err != nil {
+				return nil, err
+			}
+		}
+		_, err = tx.Exec(ctx, `UPDATE orders SET status = $1, updated_at = now() WHERE id = $2`, OrderStatusCancelled, p.OrderId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = setPaymentStatus(ctx, tx, p, PaymentStatusFailed)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (r *PaymentRepo) SetPaymentStatus(id *int, status string) error {
+	tx, err := r.DB.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+	_, err = tx.Exec(context.Background(), `UPDATE payments SET status = $1, updated_at = now() WHERE id = $2`, status, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+func (r *PaymentRepo) GetPaymentsByOrder(orderId *int) ([]*Payment, error) {
+	tx, err := r.DB.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+	rows, err := tx.Query(context.Background(), `SELECT `+paymentColumns+` FROM payments WHERE order_id = $1 ORDER BY id`, orderId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	payments := make([]*Payment, 0)
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	err = tx.Commit(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return payments, nil
+}
+
+const paymentColumns = `id, order_id, provider, intent_id, amount, currency, status, created_at, updated_at`
+
+func scanPayment(row pgx.Row) (*Payment, error) {
+	p := Payment{Amount: &Money{}}
+	err := row.Scan(&p.Id, &p.OrderId, &p.Provider, &p.IntentId, &p.Amount.Amount, &p.Amount.Currency, &p.Status, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func lockPayment(ctx context.Context, tx pgx.Tx, provider, intentId *string) (*Payment, error) {
+	p, err := scanPayment(tx.QueryRow(ctx, `SELECT `+paymentColumns+`
+		FROM payments WHERE provider = $1 AND intent_id = $2 FOR UPDATE`, provider, intentId))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrPaymentNotFound
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+func setPaymentStatus(ctx context.Context, tx pgx.Tx, p *Payment, status string) error {
+	err := tx.QueryRow(ctx, `UPDATE payments SET status = $1, updated_at = now() WHERE id = $2 RETURNING updated_at`, status, p.Id).Scan(&p.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	p.Status = &status
+	return nil
+}
@@ -0,0 +1,223 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"sort"
+	"time"
+)
+
+var ErrInvalidPriceTier = errors.New("invalid price tier")
+
+// PriceTier is one step of a ticket type price schedule. A tier is active
+// while every condition it sets holds: before ValidUntil, while fewer than
+// SoldBelow tickets are sold and within HoursBeforeEvent of the event day.
+type PriceTier struct {
+	ID               *int       `json:"id"`
+	TicketTypeId     *int       `json:"ticketTypeId"`
+	Name             *string    `json:"name"`
+	Price            *Money     `json:"price"`
+	Position         *int       `json:"position"`
+	ValidUntil       *time.Time `json:"validUntil"`
+	SoldBelow        *int       `json:"soldBelow"`
+	HoursBeforeEvent *int       `json:"hoursBeforeEvent"`
+}
+
+// PriceChange is the next scheduled price of a ticket type. At is set when
+// the change happens at a moment in time, AfterSold when it happens once that
+// many tickets are sold.
+type PriceChange struct {
+	Price     *Money     `json:"price"`
+	Tier      *string    `json:"tier"`
+	At        *time.Time `json:"at,omitempty"`
+	AfterSold *int       `json:"afterSold,omitempty"`
+}
+
+func (t *PriceTier) active(sold int, date *time.Time, now time.Time) bool {
+	if t.ValidUntil != nil && !now.Before(*t.ValidUntil) {
+		return false
+	}
+	if t.SoldBelow != nil && sold >= *t.SoldBelow {
+		return false
+	}
+	if t.HoursBeforeEvent != nil && (date == nil || now.Before(date.Add(-time.Duration(*t.HoursBeforeEvent)*time.Hour))) {
+		return false
+	}
+	return true
+}
+
+// effectiveTier returns the first active tier, nil means the base price.
+func effectiveTier(tiers []*PriceTier, sold int, date *time.Time, now time.Time) *PriceTier {
+	for _, t := range tiers {
+		if t.active(sold, date, now) {
+			return t
+		}
+	}
+	return nil
+}
+
+func tierPrice(t *PriceTier, base Money) (Money, *string) {
+	if t == nil {
+		return base, nil
+	}
+	return *t.Price, t.Name
+}
+
+// nextPriceChange finds the next point at which the effective price differs
+// from the current one. A sold count threshold of the current tier can be hit
+// at any moment, so it wins over changes scheduled in time.
+func nextPriceChange(tiers []*PriceTier, base Money, sold int, date *time.Time, now time.Time) *PriceChange {
+	current := effectiveTier(tiers, sold, date, now)
+	currentPrice, _ := tierPrice(current, base)
+
+	if current != nil && current.SoldBelow != nil {
+		afterSold := *current.SoldBelow
+		price, name := tierPrice(effectiveTier(tiers, afterSold, date, now), base)
+		if price != currentPrice {
+			return &PriceChange{Price: &price, Tier: name, AfterSold: &afterSold}
+		}
+	}
+
+	moments := make([]time.Time, 0)
+	for _, t := range tiers {
+		if t.ValidUntil != nil && t.ValidUntil.After(now) {
+			moments = append(moments, *t.ValidUntil)
+		}
+		if t.HoursBeforeEvent != nil && date != nil {
+			at := date.Add(-time.Duration(*t.HoursBeforeEvent) * time.Hour)
+			if at.After(now) {
+				moments = append(moments, at)
+			}
+		}
+	}
+	sort.Slice(moments, func(i, j int) bool { return moments[i].Before(moments[j]) })
+	for i := range moments {
+		price, name := tierPrice(effectiveTier(tiers, sold, date, moments[i]), base)
+		if price != currentPrice {
+			return &PriceChange{Price: &price, Tier: name, At: &moments[i]}
+		}
+	}
+	return nil
+}
+
+// applyPriceSchedule sets the current price and the next change of a ticket
+// type from its tiers.
+func (t *TicketTypeNoShah) applyPriceSchedule(tiers []*PriceTier, date *time.Time, now time.Time) {
+	sold := 0
+	if t.SoldCount != nil {
+		sold = *t.SoldCount
+	}
+	base := *t.Price
+	price, name := tierPrice(effectiveTier(tiers, sold, date, now), base)
+	t.CurrentPrice = &price
+	t.CurrentTier = name
+	t.NextPriceChange = nextPriceChange(tiers, base, sold, date, now)
+	t.Tiers = tiers
+}
+
+func insertPriceTiers(ctx context.Context, tx pgx.Tx, ticketTypeId int, currency string, tiers []*PriceTier) error {
+	for i, tier := range tiers {
+		if tier == nil || tier.Name == nil {
+			return ErrInvalidPriceTier
+		}
+		if err := checkPrice(tier.Price, currency); err != nil {
+			return err
+		}
+		position := i
+		if tier.Position != nil {
+			position = *tier.Position
+		}
+		_, err := tx.Exec(ctx, `INSERT INTO ticket_price_tiers (ticket_type_id, name, price, position, valid_until, sold_below, hours_before_event)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`, ticketTypeId, tier.Name, tier.Price.Amount, position, tier.ValidUntil, tier.SoldBelow, tier.HoursBeforeEvent)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadPriceTiers returns the tiers of the given ticket types ordered by
+// position.
+func loadPriceTiers(ctx context.Context, tx pgx.Tx, ticketTypeIds []int) (map[int][]*PriceTier, error) {
+	rows, err := tx.Query(ctx, `SELECT p.id, p.ticket_type_id, p.name, p.price, e.currency, p.position, p.valid_until, p.sold_below, p.hours_before_event
+		FROM ticket_price_tiers p
+		JOIN ticket_types_no_shah tt ON tt.id = p.ticket_type_id
+		JOIN event_days_no_shah d ON d.id = tt.event_day_id
+		JOIN events e ON e.id = d.event_id
+		WHERE p.ticket_type_id = ANY($1) ORDER BY p.ticket_type_id, p.position, p.id`, ticketTypeIds)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tiers := make(map[int][]*PriceTier)
+	for rows.Next() {
+		t := PriceTier{Price: &Money{}}
+		err = rows.Scan(&t.ID, &t.TicketTypeId, &t.Name, &t.Price.Amount, &t.Price.Currency, &t.Position, &t.ValidUntil, &t.SoldBelow, &t.HoursBeforeEvent)
+		if err != nil {
+			return nil, err
+		}
+		tiers[*t.TicketTypeId] = append(tiers[*t.TicketTypeId], &t)
+	}
+	return tiers, rows.Err()
+}
+
+// tieredItems splits a GA order item into runs of tickets sold at the same
+// price when sold tickets of the type are already taken. Each ticket sells
+// at the tier active for the count before it, so an item crossing a sold
+// count threshold pays both prices. TicketIds, when set, are shared out in
+// order.
+func tieredItems(ctx context.Context, tx pgx.Tx, oi *OrderItem, base Money, sold int, date *time.Time) ([]*OrderItem, error) {
+	tiers, err := loadPriceTiers(ctx, tx, []int{*oi.TicketTypeId})
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	items := make([]*OrderItem, 0, 1)
+	var run *OrderItem
+	for i := 0; i < *oi.Quantity; i++ {
+		price, _ := tierPrice(effectiveTier(tiers[*oi.TicketTypeId], sold+i, date, now), base)
+		if run == nil || *run.UnitPrice != price {
+			quantity := 0
+			run = &OrderItem{TicketTypeId: oi.TicketTypeId, Name: oi.Name, Quantity: &quantity, UnitPrice: &price}
+			items = append(items, run)
+		}
+		*run.Quantity++
+		if oi.TicketIds != nil {
+			run.TicketIds = append(run.TicketIds, oi.TicketIds[i])
+		}
+	}
+	return items, nil
+}
+
+// SetPriceTiers replaces the price schedule of a GA ticket type.
+func (r *TicketRepo) SetPriceTiers(ticketTypeId *int, tiers []*PriceTier) error {
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var id int
+	var currency string
+	err = tx.QueryRow(ctx, `SELECT tt.id, e.currency FROM ticket_types_no_shah tt
+		JOIN event_days_no_shah d ON d.id = tt.event_day_id
+		JOIN events e ON e.id = d.event_id
+		WHERE tt.id = $1 FOR UPDATE OF tt`, ticketTypeId).Scan(&id, &currency)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrTicketTypeNotFound
+		}
+		return err
+	}
+	_, err = tx.Exec(ctx, `DELETE FROM ticket_price_tiers WHERE ticket_type_id = $1`, id)
+	if err != nil {
+		return err
+	}
+	err = insertPriceTiers(ctx, tx, id, currency, tiers)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"strings"
+	"time"
+)
+
+const (
+	PromoDiscountPercent = "percent"
+	PromoDiscountFixed   = "fixed"
+)
+
+var (
+	ErrPromoNotFound      = errors.New("promo code not found")
+	ErrPromoNotActive     = errors.New("promo code is not active")
+	ErrPromoExhausted     = errors.New("promo code usage limit reached")
+	ErrPromoUserLimit     = errors.New("promo code already used the maximum number of times")
+	ErrPromoNotApplicable = errors.New("promo code doesn't apply to these tickets")
+	ErrPromoInvalid       = errors.New("invalid promo code")
+	ErrPromoCodeTaken     = errors.New("promo code already exists")
+)
+
+type PromoRepo struct {
+	DB *pgxpool.Pool
+}
+
+// PromoCode is a discount admins hand out. Percent codes take Value percent
+// off every eligible ticket, fixed codes take Amount off every eligible
+// ticket priced in the same currency without going below zero. With no
+// EventId, TicketTypeId or ShahTicketTypeId the code applies sitewide.
+type PromoCode struct {
+	Id               *int       `json:"id"`
+	Code             *string    `json:"code"`
+	DiscountType     *string    `json:"discountType"`
+	Value            *int       `json:"value"`
+	Amount           *Money     `json:"amount"`
+	EventId          *int       `json:"eventId"`
+	TicketTypeId     *int       `json:"ticketTypeId"`
+	ShahTicketTypeId *int       `json:"shahTicketTypeId"`
+	MaxUses          *int       `json:"maxUses"`
+	MaxUsesPerUser   *int       `json:"maxUsesPerUser"`
+	UsedCount        *int       `json:"usedCount"`
+	ValidFrom        *time.Time `json:"validFrom"`
+	ValidUntil       *time.Time `json:"validUntil"`
+	AdminId          *int       `json:"adminId"`
+	CreatedAt        *time.Time `json:"createdAt"`
+}
+
+func (r *PromoRepo) CreatePromoCode(p *PromoCode) (*PromoCode, error) {
+	if p.Code == nil || strings.TrimSpace(*p.Code) == "" || p.DiscountType == nil {
+		return nil, ErrPromoInvalid
+	}
+	var value int64
+	var currency *string
+	switch *p.DiscountType {
+	case PromoDiscountPercent:
+		if p.Value == nil || *p.Value <= 0 || *p.Value > 100 {
+			return nil, ErrPromoInvalid
+		}
+		value, p.Amount = int64(*p.Value), nil
+	case PromoDiscountFixed:
+		if p.Amount == nil || p.Amount.Amount <= 0 {
+			return nil, ErrPromoInvalid
+		}
+		if p.Amount.Currency == "" {
+			p.Amount.Currency = DefaultCurrency
+		}
+		if !ValidCurrency(p.Amount.Currency) {
+			return nil, ErrUnsupportedCurrency
+		}
+		value, currency, p.Value = p.Amount.Amount, &p.Amount.Currency, nil
+	default:
+		return nil, ErrPromoInvalid
+	}
+	code := strings.ToUpper(strings.TrimSpace(*p.Code))
+	p.Code = &code
+
+	tx, err := r.DB.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+	err = tx.QueryRow(context.Background(), `INSERT INTO promo_codes (code, discount_type, value, currency, event_id, ticket_type_id, shah_ticket_type_id,
+			max_uses, max_uses_per_user, valid_from, valid_until, admin_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (code) DO NOTHING RETURNING id, used_count, created_at`,
+		p.Code, p.DiscountType, value, currency, p.EventId, p.TicketTypeId, p.ShahTicketTypeId,
+		p.MaxUses, p.MaxUsesPerUser, p.ValidFrom, p.ValidUntil, p.AdminId).Scan(&p.Id, &p.UsedCount, &p.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrPromoCodeTaken
+		}
+		return nil, err
+	}
+	err = tx.Commit(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (r *PromoRepo) GetPromoCodes() ([]*PromoCode, error) {
+	tx, err := r.DB.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+	rows, err := tx.Query(context.Background(), `SELECT `+promoColumns+` FROM promo_codes ORDER BY id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	codes := make([]*PromoCode, 0)
+	for rows.Next() {
+		p, err := scanPromoCode(rows)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, p)
+	}
+	err = tx.Commit(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+const promoColumns = `id, code, discount_type, value, currency, event_id, ticket_type_id, shah_ticket_type_id,
+	max_uses, max_uses_per_user, used_count, valid_from, valid_until, admin_id, created_at`
+
+func scanPromoCode(row pgx.Row) (*PromoCode, error) {
+	var p PromoCode
+	var value int64
+	var currency *string
+	err := row.Scan(&p.Id, &p.Code, &p.DiscountType, &value, &currency, &p.EventId, &p.TicketTypeId, &p.ShahTicketTypeId,
+		&p.MaxUses, &p.MaxUsesPerUser, &p.UsedCount, &p.ValidFrom, &p.ValidUntil, &p.AdminId, &p.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if currency != nil {
+		p.Amount = NewMoney(value, *currency)
+	} else {
+		percent := int(value)
+		p.Value = &percent
+	}
+	return &p, nil
+}
+
+// lockPromoCode locks a promo code and checks it can be redeemed once more by
+// the user. The row lock serializes concurrent checkouts with the same code,
+// so a capped code can't be redeemed past its limits.
+func lockPromoCode(ctx context.Context, tx pgx.Tx, code string, userId *int) (*PromoCode, error) {
+	p, err := scanPromoCode(tx.QueryRow(ctx, `SELECT `+promoColumns+` FROM promo_codes WHERE code = upper($1) FOR UPDATE`, strings.TrimSpace(code)))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrPromoNotFound
+		}
+		return nil, err
+	}
+	now := time.Now()
+	if (p.ValidFrom != nil && now.Before(*p.ValidFrom)) || (p.ValidUntil != nil && now.After(*p.ValidUntil)) {
+		return nil, ErrPromoNotActive
+	}
+	if p.MaxUses != nil && *p.UsedCount >= *p.MaxUses {
+		return nil, ErrPromoExhausted
+	}
+	if p.MaxUsesPerUser != nil {
+		var used int
+		err = tx.QueryRow(ctx, `SELECT count(*) FROM promo_redemptions WHERE promo_code_id = $1 AND user_id = $2`, p.Id, userId).Scan(&used)
+		if err != nil {
+			return nil, err
+		}
+		if used >= *p.MaxUsesPerUser {
+			return nil, ErrPromoUserLimit
+		}
+	}
+	return p, nil
+}
+
+// applyPromoCode sets the per ticket discount of every order item the code
+// is scoped to. At least one item has to be eligible.
+func applyPromoCode(o *Order, p *PromoCode) error {
+	applied := false
+	for _, oi := range o.Items {
+		switch {
+		case p.TicketTypeId != nil && (oi.TicketTypeId == nil || *oi.TicketTypeId != *p.TicketTypeId):
+			continue
+		case p.ShahTicketTypeId != nil && (oi.ShahTicketTypeId == nil || *oi.ShahTicketTypeId != *p.ShahTicketTypeId):
+			continue
+		case p.EventId != nil && (o.EventId == nil || *o.EventId != *p.EventId):
+			continue
+		case p.Amount != nil && p.Amount.Currency != oi.UnitPrice.Currency:
+			continue
+		}
+		var discount Money
+		if p.Amount == nil {
+			discount = oi.UnitPrice.Percent(*p.Value)
+		} else {
+			discount = *p.Amount
+		}
+		discount = discount.Min(*oi.UnitPrice)
+		oi.UnitDiscount = &discount
+		applied = true
+	}
+	if !applied {
+		return ErrPromoNotApplicable
+	}
+	o.PromoCodeId = p.Id
+	o.PromoCode = p.Code
+	return nil
+}
+
+// redeemPromoCode counts the redemption of the code applied to a stored order.
+func redeemPromoCode(ctx context.Context, tx pgx.Tx, o *Order) error {
+	_, err := tx.Exec(ctx, `INSERT INTO promo_redemptions (promo_code_id, order_id, user_id, amount) VALUES ($1, $2, $3, $4)`,
+		o.PromoCodeId, o.Id, o.UserId, o.Discount.Amount)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `UPDATE promo_codes SET used_count = used_count + 1 WHERE id = $1`, o.PromoCodeId)
+	return err
+}
@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	ErrPurchaseLimitExceeded = errors.New("purchase limit exceeded")
+	ErrInvalidPurchaseLimit  = errors.New("invalid purchase limit")
+	ErrLimitTargetNotFound   = errors.New("limit target not found")
+)
+
+// purchaseLimitLock namespaces the per user advisory lock taken while
+// tickets are reserved.
+const purchaseLimitLock = 13
+
+// liveTicket matches tickets a user holds: issued and not refunded, or
+// reserved by a hold that is still running.
+const liveTicket = `t.refunded_at IS NULL AND (NOT t.is_reserved OR EXISTS(
+	SELECT 1 FROM holds h WHERE h.id = t.hold_id AND h.status = 'active' AND h.expires_at > now()))`
+
+type PurchaseLimitRepo struct {
+	DB *pgxpool.Pool
+}
+
+// PurchaseLimit sets the per user limit of exactly one of an event, a GA
+// event day, a GA ticket type, a seated event day or a seated ticket type.
+// A nil MaxTicketsPerUser removes the limit.
+type PurchaseLimit struct {
+	EventId           *int `json:"eventId"`
+	EventDayId        *int `json:"eventDayId"`
+	TicketTypeId      *int `json:"ticketTypeId"`
+	SeatedEventDayId  *int `json:"seatedEventDayId"`
+	ShahTicketTypeId  *int `json:"shahTicketTypeId"`
+	MaxTicketsPerUser *int `json:"maxTicketsPerUser"`
+}
+
+func (r *PurchaseLimitRepo) SetPurchaseLimit(l *PurchaseLimit) error {
+	if l.MaxTicketsPerUser != nil && *l.MaxTicketsPerUser < 0 {
+		return ErrInvalidPurchaseLimit
+	}
+	var table string
+	var id *int
+	set := 0
+	for _, target := range []struct {
+		table string
+		id    *int
+	}{
+		{"events", l.EventId},
+		{"event_days_no_shah", l.EventDayId},
+		{"ticket_types_no_shah", l.TicketTypeId},
+		{"event_days_shah", l.SeatedEventDayId},
+		{"shah_ticket_types", l.ShahTicketTypeId},
+	} {
+		if target.id != nil {
+			table, id = target.table, target.id
+			set++
+		}
+	}
+	if set != 1 {
+		return ErrInvalidPurchaseLimit
+	}
+
+	tx, err := r.DB.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+	tag, err := tx.Exec(context.Background(), `UPDATE `+table+` SET max_tickets_per_user = $1 WHERE id = $2`, l.MaxTicketsPerUser, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrLimitTargetNotFound
+	}
+	return tx.Commit(context.Background())
+}
+
+// lockUserPurchases serializes reservations of one user until tx ends, so
+// parallel requests can't each stay under a limit and together exceed it.
+// It is taken before any ticket type or seat row is locked. Waitlist offers
+// run under the row locks of the inventory being freed, they only try it
+// with tryLockUserPurchases.
+func lockUserPurchases(ctx context.Context, tx pgx.Tx, userId *int) error {
+	_, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1::int, $2::int)`, purchaseLimitLock, userId)
+	return err
+}
+
+// tryLockUserPurchases takes the lock of lockUserPurchases if nobody holds
+// it, without waiting.
+func tryLockUserPurchases(ctx context.Context, tx pgx.Tx, userId *int) (bool, error) {
+	var locked bool
+	err := tx.QueryRow(ctx, `SELECT pg_try_advisory_xact_lock($1::int, $2::int)`, purchaseLimitLock, userId).Scan(&locked)
+	return locked, err
+}
+
+// checkLimitsNoShah verifies the user's live tickets, including the ones just
+// reserved in tx, stay within the limits of a GA ticket type, its day and its
+// event.
+func checkLimitsNoShah(ctx context.Context, tx pgx.Tx, userId *int, ticketTypeId *int) error {
+	var typeLimit, dayLimit, eventLimit *int
+	var dayId, eventId *int
+	err := tx.QueryRow(ctx, `SELECT tt.max_tickets_per_user, d.max_tickets_per_user, e.max_tickets_per_user, d.id, e.id
+		FROM ticket_types_no_shah tt
+		JOIN event_days_no_shah d ON d.id = tt.event_day_id
+		LEFT JOIN events e ON e.id = d.event_id
+		WHERE tt.id = $1`, ticketTypeId).Scan(&typeLimit, &dayLimit, &eventLimit, &dayId, &eventId)
+	if err != nil {
+		return err
+	}
+	if typeLimit == nil && dayLimit == nil && eventLimit == nil {
+		return nil
+	}
+
+	var typeCount, dayCount int
+	err = tx.QueryRow(ctx, `SELECT count(*) FILTER (WHERE t.ticket_type_id = $2), count(*)
+		FROM tickets_no_shah t
+		JOIN ticket_types_no_shah tt ON tt.id = t.ticket_type_id
+		WHERE t.user_id = $1 AND tt.event_day_id = $3 AND `+liveTicket, userId, ticketTypeId, dayId).Scan(&typeCount, &dayCount)
+	if err != nil {
+		return err
+	}
+	if (typeLimit != nil && typeCount > *typeLimit) || (dayLimit != nil && dayCount > *dayLimit) {
+		return ErrPurchaseLimitExceeded
+	}
+	return checkEventLimit(ctx, tx, userId, eventId, eventLimit)
+}
+
+type userLimit struct {
+	id, limit int
+}
+
+// checkLimitsShah does the same for seated ticket types, their days and
+// their events.
+func checkLimitsShah(ctx context.Context, tx pgx.Tx, userId *int, seatIds []int) error {
+	rows, err := tx.Query(ctx, `SELECT DISTINCT tt.id, tt.max_tickets_per_user
+		FROM tickets_shah t JOIN shah_ticket_types tt ON tt.id = t.ticket_type_id
+		WHERE t.seat_id = ANY($1) AND t.user_id = $2 AND tt.max_tickets_per_user IS NOT NULL AND `+liveTicket, seatIds, userId)
+	if err != nil {
+		return err
+	}
+	limits := make([]userLimit, 0)
+	for rows.Next() {
+		var l userLimit
+		if err = rows.Scan(&l.id, &l.limit); err != nil {
+			rows.Close()
+			return err
+		}
+		limits = append(limits, l)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, l := range limits {
+		var count int
+		err = tx.QueryRow(ctx, `SELECT count(*) FROM tickets_shah t WHERE t.user_id = $1 AND t.ticket_type_id = $2 AND `+liveTicket, userId, l.id).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > l.limit {
+			return ErrPurchaseLimitExceeded
+		}
+	}
+
+	rows, err = tx.Query(ctx, `SELECT DISTINCT d.id, d.max_tickets_per_user
+		FROM shah_seats s JOIN event_days_shah d ON d.id = s.event_day_id
+		WHERE s.id = ANY($1) AND d.max_tickets_per_user IS NOT NULL`, seatIds)
+	if err != nil {
+		return err
+	}
+	days := make([]userLimit, 0)
+	for rows.Next() {
+		var d userLimit
+		if err = rows.Scan(&d.id, &d.limit); err != nil {
+			rows.Close()
+			return err
+		}
+		days = append(days, d)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, d := range days {
+		var count int
+		err = tx.QueryRow(ctx, `SELECT count(*) FROM tickets_shah t JOIN shah_seats s ON s.id = t.seat_id
+			WHERE t.user_id = $1 AND s.event_day_id = $2 AND `+liveTicket, userId, d.id).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > d.limit {
+			return ErrPurchaseLimitExceeded
+		}
+	}
+
+	rows, err = tx.Query(ctx, `SELECT DISTINCT e.id, e.max_tickets_per_user
+		FROM shah_seats s JOIN events e ON e.id = s.event_id
+		WHERE s.id = ANY($1) AND e.max_tickets_per_user IS NOT NULL`, seatIds)
+	if err != nil {
+		return err
+	}
+	events := make([]userLimit, 0)
+	for rows.Next() {
+		var e userLimit
+		if err = rows.Scan(&e.id, &e.limit); err != nil {
+			rows.Close()
+			return err
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, e := range events {
+		err = checkEventLimit(ctx, tx, userId, &e.id, &e.limit)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkEventLimit counts GA and seated tickets of the event together.
+func checkEventLimit(ctx context.Context, tx pgx.Tx, userId, eventId, limit *int) error {
+	if eventId == nil || limit == nil {
+		return nil
+	}
+	var count int
+	err := tx.QueryRow(ctx, `SELECT
+		(SELECT count(*) FROM tickets_no_shah t
+			JOIN ticket_types_no_shah tt ON tt.id = t.ticket_type_id
+			JOIN event_days_no_shah d ON d.id = tt.event_day_id
+			WHERE t.user_id = $1 AND d.event_id = $2 AND `+liveTicket+`)
+		+ (SELECT count(*) FROM tickets_shah t
+			JOIN shah_seats s ON s.id = t.seat_id
+			WHERE t.user_id = $1 AND s.event_id = $2 AND `+liveTicket+`)`, userId, eventId).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > *limit {
+		return ErrPurchaseLimitExceeded
+	}
+	return nil
+}
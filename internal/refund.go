@@ -0,0 +1,448 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrOrderNotPaid          = errors.New("order is not paid")
+	ErrTicketNotRefundable   = errors.New("ticket can't be refunded")
+	ErrRefundWindowClosed    = errors.New("refund window is closed")
+	ErrRefundReasonRequired  = errors.New("refund reason is required")
+	ErrPaymentNotRefundable  = errors.New("order has no refundable payment")
+	ErrRefundsNotAllowed     = errors.New("event doesn't allow refunds")
+	ErrRefundTicketsRequired = errors.New("no tickets to refund")
+)
+
+const (
+	RefundStatusPending   = "pending"
+	RefundStatusSucceeded = "succeeded"
+)
+
+// refundRetryAge is how long a refund stays pending before
+// RetryPendingRefunds sends it again.
+const refundRetryAge = time.Minute
+
+type RefundRepo struct {
+	DB *pgxpool.Pool
+}
+
+type Refund struct {
+	Id               *int       `json:"id"`
+	OrderId          *int       `json:"orderId"`
+	Amount           *Money     `json:"amount"`
+	Reason           *string    `json:"reason"`
+	UserId           *int       `json:"userId"`
+	AdminId          *int       `json:"adminId"`
+	ProviderRefundId *string    `json:"providerRefundId"`
+	Status           *string    `json:"status"`
+	CreatedAt        *time.Time `json:"createdAt"`
+	TicketIds        []int      `json:"ticketIds"`
+	SeatTicketIds    []int      `json:"seatTicketIds"`
+}
+
+// RefundRequest selects the tickets of an order to refund, leaving both ID
+// lists empty refunds everything that is still valid. Exactly one of UserId
+// and AdminId is set, buyers are bound by the event refund window.
+type RefundRequest struct {
+	OrderId       *int    `json:"orderId"`
+	TicketIds     []int   `json:"ticketIds"`
+	SeatTicketIds []int   `json:"seatTicketIds"`
+	Reason        *string `json:"reason"`
+	UserId        *int    `json:"-"`
+	AdminId       *int    `json:"-"`
+}
+
+type refundableTicket struct {
+	id     int
+	seated bool
+	price  int64
+	date   *time.Time
+}
+
+// RefundOrder refunds the requested tickets, returns their inventory to the
+// pool and records the refund in the ledger as pending. Only after that is
+// committed the money is sent back through the provider that took the
+// payment, keyed by the refund id, and the refund marked succeeded. When the
+// provider fails the pending refund is returned with the error and
+// RetryPendingRefunds sends it later.
+func (r *RefundRepo) RefundOrder(req *RefundRequest, provider PaymentProvider) (*Refund, error) {
+	if req.Reason == nil || *req.Reason == "" {
+		return nil, ErrRefundReasonRequired
+	}
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var status, currency string
+	var userId int
+	var windowHours *int
+	err = tx.QueryRow(ctx, `SELECT o.status, o.currency, o.user_id, e.refund_window_hours FROM orders o
+		JOIN events e ON e.id = o.event_id WHERE o.id = $1 FOR UPDATE OF o`, req.OrderId).Scan(&status, &currency, &userId, &windowHours)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrOrderNotFound
+		}
+		return nil, err
+	}
+	if req.AdminId == nil && (req.UserId == nil || *req.UserId != userId) {
+		return nil, ErrOrderNotFound
+	}
+	if status != OrderStatusPaid {
+		return nil, ErrOrderNotPaid
+	}
+	if req.AdminId == nil && windowHours == nil {
+		return nil, ErrRefundsNotAllowed
+	}
+
+	// Buyers can't refund tickets they have transferred to someone else
+	var ownerId *int
+	if req.AdminId == nil {
+		ownerId = &userId
+	}
+	tickets, err := lockRefundableTickets(ctx, tx, req.OrderId, ownerId, req.AdminId != nil)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := selectRefundTickets(tickets, req.TicketIds, req.SeatTicketIds)
+	if err != nil {
+		return nil, err
+	}
+
+	refund := Refund{OrderId: req.OrderId, Reason: req.Reason, UserId: req.UserId, AdminId: req.AdminId, TicketIds: make([]int, 0), SeatTicketIds: make([]int, 0)}
+	amount := Money{Currency: currency}
+	for _, t := range selected {
+		if req.AdminId == nil && t.date != nil && time.Now().Add(time.Duration(*windowHours)*time.Hour).After(*t.date) {
+			return nil, ErrRefundWindowClosed
+		}
+		amount.Amount += t.price
+		if t.seated {
+			refund.SeatTicketIds = append(refund.SeatTicketIds, t.id)
+		} else {
+			refund.TicketIds = append(refund.TicketIds, t.id)
+		}
+	}
+	refund.Amount = &amount
+
+	rows, err := tx.Query(ctx, `
+		WITH refunded AS (
+			UPDATE tickets_no_shah SET refunded_at = now() WHERE id = ANY($1) RETURNING ticket_type_id
+		), counts AS (
+			SELECT ticket_type_id, count(*) AS cnt FROM refunded GROUP BY ticket_type_id
+		)
+		UPDATE ticket_types_no_shah t
+		SET sold_count = t.sold_count - counts.cnt, version = t.version + 1
+		FROM counts
+		WHERE t.id = counts.ticket_type_id
+		RETURNING t.id
+	`, refund.TicketIds)
+	if err != nil {
+		return nil, err
+	}
+	ticketTypeIds, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return nil, err
+	}
+	rows, err = tx.Query(ctx, `UPDATE tickets_shah SET refunded_at = now() WHERE id = ANY($1) RETURNING seat_id`, refund.SeatTicketIds)
+	if err != nil {
+		return nil, err
+	}
+	seatIds, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return nil, err
+	}
+	err = notifyTicketTypes(ctx, tx, ticketTypeIds)
+	if err != nil {
+		return nil, err
+	}
+	err = notifySeats(ctx, tx, seatIds, SeatStateReleased)
+	if err != nil {
+		return nil, err
+	}
+	err = offerWaitlist(ctx, tx, ticketTypeIds, seatIds)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tickets the buyer can't refund (transferred away or checked in) still count
+	var fullRefund bool
+	err = tx.QueryRow(ctx, `SELECT
+		NOT EXISTS(SELECT 1 FROM tickets_no_shah t JOIN order_items i ON i.id = t.order_item_id WHERE i.order_id = $1 AND t.refunded_at IS NULL)
+		AND NOT EXISTS(SELECT 1 FROM tickets_shah t JOIN order_items i ON i.id = t.order_item_id WHERE i.order_id = $1 AND t.refunded_at IS NULL)`,
+		req.OrderId).Scan(&fullRefund)
+	if err != nil {
+		return nil, err
+	}
+	if fullRefund {
+		_, err = tx.Exec(ctx, `UPDATE orders SET status = $1, updated_at = now() WHERE id = $2`, OrderStatusRefunded, req.OrderId)
+	} else {
+		_, err = tx.Exec(ctx, `UPDATE orders SET updated_at = now() WHERE id = $1`, req.OrderId)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	refundStatus := RefundStatusSucceeded
+	var payment *Payment
+	if amount.Amount > 0 {
+		payment, err = lockOrderPayment(ctx, tx, req.OrderId)
+		if err != nil {
+			return nil, err
+		}
+		if *payment.Provider != provider.Name() {
+			return nil, ErrPaymentNotRefundable
+		}
+		refundStatus = RefundStatusPending
+	}
+	refund.Status = &refundStatus
+
+	var paymentId *int
+	if payment != nil {
+		paymentId = payment.Id
+	}
+	err = tx.QueryRow(ctx, `INSERT INTO refunds (order_id, amount, currency, reason, user_id, admin_id, status, payment_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, created_at`,
+		refund.OrderId, amount.Amount, amount.Currency, refund.Reason, refund.UserId, refund.AdminId, refundStatus, paymentId).Scan(&refund.Id, &refund.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(ctx, `INSERT INTO refund_tickets (refund_id, ticket_id) SELECT $1, unnest($2::int[])`, refund.Id, refund.TicketIds)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(ctx, `INSERT INTO refund_tickets (refund_id, seat_ticket_id) SELECT $1, unnest($2::int[])`, refund.Id, refund.SeatTicketIds)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	if payment == nil {
+		return &refund, nil
+	}
+	err = r.sendRefund(provider, &refund, *payment.Id, *payment.IntentId)
+	if err != nil {
+		return &refund, err
+	}
+	return &refund, nil
+}
+
+// sendRefund asks the provider to send a pending refund back and records
+// the outcome. The payment is refunded once its order is refunded in full
+// and nothing is pending for it.
+func (r *RefundRepo) sendRefund(provider PaymentProvider, refund *Refund, paymentId int, intentId string) error {
+	providerRefundId, err := provider.Refund(intentId, *refund.Amount, "refund-"+strconv.Itoa(*refund.Id))
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `UPDATE refunds SET status = $1, provider_refund_id = $2 WHERE id = $3 AND status = $4`,
+		RefundStatusSucceeded, providerRefundId, refund.Id, RefundStatusPending)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `UPDATE payments p SET status = $1, updated_at = now()
+		WHERE p.id = $2 AND p.status = $3
+		  AND EXISTS(SELECT 1 FROM orders o WHERE o.id = p.order_id AND o.status = $4)
+		  AND NOT EXISTS(SELECT 1 FROM refunds r WHERE r.payment_id = p.id AND r.status = $5)`,
+		PaymentStatusRefunded, paymentId, PaymentStatusSucceeded, OrderStatusRefunded, RefundStatusPending)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	status := RefundStatusSucceeded
+	refund.Status = &status
+	refund.ProviderRefundId = &providerRefundId
+	return nil
+}
+
+// RetryPendingRefunds sends again the refunds whose provider call failed and
+// returns how many went through, along with the last failure.
+func (r *RefundRepo) RetryPendingRefunds(provider PaymentProvider) (int, error) {
+	rows, err := r.DB.Query(context.Background(), `SELECT r.id, r.amount, r.currency, p.id, p.intent_id
+		FROM refunds r JOIN payments p ON p.id = r.payment_id
+		WHERE r.status = $1 AND r.created_at < $2 AND p.provider = $3
+		ORDER BY r.id`, RefundStatusPending, time.Now().Add(-refundRetryAge), provider.Name())
+	if err != nil {
+		return 0, err
+	}
+	type pendingRefund struct {
+		refund    Refund
+		paymentId int
+		intentId  string
+	}
+	pending := make([]*pendingRefund, 0)
+	for rows.Next() {
+		p := pendingRefund{refund: Refund{Amount: &Money{}}}
+		err = rows.Scan(&p.refund.Id, &p.refund.Amount.Amount, &p.refund.Amount.Currency, &p.paymentId, &p.intentId)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, &p)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// A refund the provider still rejects doesn't hold up the others
+	sent := 0
+	var failed error
+	for _, p := range pending {
+		err = r.sendRefund(provider, &p.refund, p.paymentId, p.intentId)
+		if err != nil {
+			failed = err
+			continue
+		}
+		sent++
+	}
+	return sent, failed
+}
+
+func (r *RefundRepo) GetRefundsByOrder(orderId *int) ([]*Refund, error) {
+	tx, err := r.DB.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+	rows, err := tx.Query(context.Background(), `SELECT r.id, r.order_id, r.amount, r.currency, r.reason, r.user_id, r.admin_id, r.provider_refund_id, r.status, r.created_at,
+       COALESCE(array_agg(rt.ticket_id ORDER BY rt.ticket_id) FILTER (WHERE rt.ticket_id IS NOT NULL), '{}'),
+       COALESCE(array_agg(rt.seat_ticket_id ORDER BY rt.seat_ticket_id) FILTER (WHERE rt.seat_ticket_id IS NOT NULL), '{}')
+		FROM refunds r
+		LEFT JOIN refund_tickets rt ON rt.refund_id = r.id
+		WHERE r.order_id = $1
+		GROUP BY r.id
+		ORDER BY r.id`, orderId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	refunds := make([]*Refund, 0)
+	for rows.Next() {
+		ref := Refund{Amount: &Money{}}
+		err = rows.Scan(&ref.Id, &ref.OrderId, &ref.Amount.Amount, &ref.Amount.Currency, &ref.Reason, &ref.UserId, &ref.AdminId, &ref.ProviderRefundId, &ref.Status, &ref.CreatedAt, &ref.TicketIds, &ref.SeatTicketIds)
+		if err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, &ref)
+	}
+	err = tx.Commit(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return refunds, nil
+}
+
+// lockRefundableTickets locks every issued and not yet refunded ticket of an
+// order together with the price it was sold at and the date it is valid for.
+// Tickets used at the door are only included when includeCheckedIn is set.
+func lockRefundableTickets(ctx context.Context, tx pgx.Tx, orderId, ownerId *int, includeCheckedIn bool) ([]*refundableTicket, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT t.id, false, i.unit_price - i.unit_discount, d.date
+		FROM tickets_no_shah t
+		JOIN order_items i ON i.id = t.order_item_id
+		JOIN ticket_types_no_shah tt ON tt.id = t.ticket_type_id
+		JOIN event_days_no_shah d ON d.id = tt.event_day_id
+		WHERE i.order_id = $1 AND NOT t.is_reserved AND t.refunded_at IS NULL
+		  AND ($2 OR NOT EXISTS(SELECT 1 FROM check_ins c WHERE c.ticket_id = t.id))
+		  AND ($3::int IS NULL OR t.user_id = $3)
+		FOR UPDATE OF t
+	`, orderId, includeCheckedIn, ownerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tickets := make([]*refundableTicket, 0)
+	for rows.Next() {
+		var t refundableTicket
+		err = rows.Scan(&t.id, &t.seated, &t.price, &t.date)
+		if err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, &t)
+	}
+	rows.Close()
+
+	rows, err = tx.Query(ctx, `
+		SELECT t.id, true, i.unit_price - i.unit_discount, COALESCE(s.date::timestamptz, e.start_time::timestamptz)
+		FROM tickets_shah t
+		JOIN order_items i ON i.id = t.order_item_id
+		JOIN shah_seats s ON s.id = t.seat_id
+		JOIN orders o ON o.id = i.order_id
+		JOIN events e ON e.id = o.event_id
+		WHERE i.order_id = $1 AND NOT t.is_reserved AND t.refunded_at IS NULL
+		  AND ($2 OR NOT EXISTS(SELECT 1 FROM check_ins c WHERE c.seat_ticket_id = t.id))
+		  AND ($3::int IS NULL OR t.user_id = $3)
+		FOR UPDATE OF t
+	`, orderId, includeCheckedIn, ownerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t refundableTicket
+		err = rows.Scan(&t.id, &t.seated, &t.price, &t.date)
+		if err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, &t)
+	}
+	return tickets, rows.Err()
+}
+
+func selectRefundTickets(tickets []*refundableTicket, ticketIds, seatTicketIds []int) ([]*refundableTicket, error) {
+	if len(ticketIds) == 0 && len(seatTicketIds) == 0 {
+		if len(tickets) == 0 {
+			return nil, ErrRefundTicketsRequired
+		}
+		return tickets, nil
+	}
+	wanted := make(map[int]bool)
+	wantedSeats := make(map[int]bool)
+	for _, id := range ticketIds {
+		wanted[id] = true
+	}
+	for _, id := range seatTicketIds {
+		wantedSeats[id] = true
+	}
+	selected := make([]*refundableTicket, 0)
+	for _, t := range tickets {
+		if (t.seated && wantedSeats[t.id]) || (!t.seated && wanted[t.id]) {
+			selected = append(selected, t)
+		}
+	}
+	if len(selected) != len(wanted)+len(wantedSeats) {
+		return nil, ErrTicketNotRefundable
+	}
+	return selected, nil
+}
+
+func lockOrderPayment(ctx context.Context, tx pgx.Tx, orderId *int) (*Payment, error) {
+	p, err := scanPayment(tx.QueryRow(ctx, `SELECT `+paymentColumns+`
+		FROM payments WHERE order_id = $1 AND status = $2 ORDER BY id DESC LIMIT 1 FOR UPDATE`, orderId, PaymentStatusSucceeded))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrPaymentNotRefundable
+		}
+		return nil, err
+	}
+	return p, nil
+}
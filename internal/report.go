@@ -0,0 +1,369 @@
+package internal
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"sort"
+	"time"
+)
+
+type ReportRepo struct {
+	DB *pgxpool.Pool
+}
+
+// ReportFilter narrows reports to tickets bought in [From, To) and to one
+// event or venue. Nil fields don't filter.
+type ReportFilter struct {
+	From    *time.Time
+	To      *time.Time
+	EventId *int
+	VenueId *int
+}
+
+// SalesLine is one row of a sales report. Lines of the ticket type
+// breakdown have every field set, the other breakdowns only the fields they
+// are grouped by. Remaining is the capacity still for sale right now and
+// Revenue is totalled per currency.
+type SalesLine struct {
+	Kind           string     `json:"kind,omitempty"`
+	EventId        *int       `json:"eventId,omitempty"`
+	EventTitle     *string    `json:"eventTitle,omitempty"`
+	EventDayId     *int       `json:"eventDayId,omitempty"`
+	Date           *time.Time `json:"date,omitempty"`
+	VenueId        *int       `json:"venueId,omitempty"`
+	VenueName      *string    `json:"venueName,omitempty"`
+	TicketTypeId   *int       `json:"ticketTypeId,omitempty"`
+	TicketTypeName *string    `json:"ticketTypeName,omitempty"`
+	Sold           int        `json:"sold"`
+	Refunded       int        `json:"refunded"`
+	Revenue        Totals     `json:"revenue"`
+	Remaining      int        `json:"remaining"`
+}
+
+type SalesReport struct {
+	Total        *SalesLine   `json:"total"`
+	ByEvent      []*SalesLine `json:"byEvent"`
+	ByDay        []*SalesLine `json:"byDay"`
+	ByVenue      []*SalesLine `json:"byVenue"`
+	ByTicketType []*SalesLine `json:"byTicketType"`
+}
+
+type DailySales struct {
+	Day     time.Time `json:"day"`
+	Sold    int       `json:"sold"`
+	Revenue Totals    `json:"revenue"`
+}
+
+// ReportTicket is a row of the raw ticket export.
+type ReportTicket struct {
+	Kind           string     `json:"kind"`
+	TicketId       int        `json:"ticketId"`
+	OrderId        *int       `json:"orderId"`
+	EventTitle     *string    `json:"eventTitle"`
+	Date           *time.Time `json:"date"`
+	VenueName      *string    `json:"venueName"`
+	TicketTypeName *string    `json:"ticketTypeName"`
+	SeatNum        *int       `json:"seatNum"`
+	Price          *Money     `json:"price"`
+	PurchaseTime   *time.Time `json:"purchaseTime"`
+	RefundedAt     *time.Time `json:"refundedAt"`
+	CheckedIn      bool       `json:"checkedIn"`
+	BuyerName      *string    `json:"buyerName"`
+	Email          *string    `json:"email"`
+	Phone          *string    `json:"phone"`
+}
+
+// reportTickets lists issued tickets of both kinds with what they were sold
+// for. $1 to $4 are the ReportFilter fields.
+const reportTickets = `
+	SELECT * FROM (
+		SELECT 'ga' AS kind, t.id, t.user_id, t.purchase_time, t.refunded_at, i.order_id,
+		       e.id AS event_id, e.title, d.id AS day_id, d.date, v.id AS venue_id, v.name AS venue_name,
+		       tt.id AS type_id, tt.name AS type_name, NULL::int AS seat_num,
+		       COALESCE(i.unit_price - i.unit_discount, tt.price)::bigint AS price, e.currency,
+		       EXISTS(SELECT 1 FROM check_ins c WHERE c.ticket_id = t.id) AS checked_in
+		FROM tickets_no_shah t
+		JOIN ticket_types_no_shah tt ON tt.id = t.ticket_type_id
+		JOIN event_days_no_shah d ON d.id = tt.event_day_id
+		JOIN events e ON e.id = d.event_id
+		LEFT JOIN venues v ON v.id = d.venue_id
+		LEFT JOIN order_items i ON i.id = t.order_item_id
+		WHERE NOT t.is_reserved
+		UNION ALL
+		SELECT 'seat', t.id, t.user_id, t.purchase_time, t.refunded_at, i.order_id,
+		       e.id, e.title, d.id, d.date, v.id, v.name,
+		       tt.id, tt.name, s.num,
+		       COALESCE(i.unit_price - i.unit_discount, tt.price)::bigint, e.currency,
+		       EXISTS(SELECT 1 FROM check_ins c WHERE c.seat_ticket_id = t.id)
+		FROM tickets_shah t
+		JOIN shah_seats s ON s.id = t.seat_id
+		JOIN event_days_shah d ON d.id = s.event_day_id
+		JOIN shah_ticket_types tt ON tt.id = t.ticket_type_id
+		JOIN events e ON e.id = d.event_id
+		LEFT JOIN venues v ON v.id = d.venue_id
+		LEFT JOIN order_items i ON i.id = t.order_item_id
+		WHERE NOT t.is_reserved
+	) r
+	WHERE ($1::timestamptz IS NULL OR r.purchase_time >= $1) AND ($2::timestamptz IS NULL OR r.purchase_time < $2)
+	  AND ($3::int IS NULL OR r.event_id = $3) AND ($4::int IS NULL OR r.venue_id = $4)`
+
+// GetSalesReport counts sold and refunded tickets and revenue in the range
+// next to the capacity left, per ticket type and rolled up per event day,
+// event and venue.
+func (r *ReportRepo) GetSalesReport(f *ReportFilter) (*SalesReport, error) {
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+		WITH r AS (`+reportTickets+`)
+		SELECT 'ga', e.id, e.title, d.id, d.date, v.id, v.name, tt.id, tt.name,
+		       count(r.id) FILTER (WHERE r.refunded_at IS NULL), count(r.id) FILTER (WHERE r.refunded_at IS NOT NULL),
+		       COALESCE(sum(r.price) FILTER (WHERE r.refunded_at IS NULL), 0)::bigint, e.currency,
+		       tt.amount - tt.sold_count
+		FROM ticket_types_no_shah tt
+		JOIN event_days_no_shah d ON d.id = tt.event_day_id
+		JOIN events e ON e.id = d.event_id
+		LEFT JOIN venues v ON v.id = d.venue_id
+		LEFT JOIN r ON r.kind = 'ga' AND r.type_id = tt.id
+		WHERE ($3::int IS NULL OR e.id = $3) AND ($4::int IS NULL OR v.id = $4)
+		GROUP BY e.id, e.title, e.currency, d.id, d.date, v.id, v.name, tt.id, tt.name, tt.amount, tt.sold_count
+		UNION ALL
+		SELECT 'seat', e.id, e.title, d.id, d.date, v.id, v.name, tt.id, tt.name,
+		       count(r.id) FILTER (WHERE r.refunded_at IS NULL), count(r.id) FILTER (WHERE r.refunded_at IS NOT NULL),
+		       COALESCE(sum(r.price) FILTER (WHERE r.refunded_at IS NULL), 0)::bigint, e.currency,
+		       (SELECT count(*) FROM shah_seat_ticket_types st
+		        WHERE st.ticket_type_id = tt.id
+		          AND NOT EXISTS(SELECT 1 FROM tickets_shah x WHERE x.seat_id = st.seat_id AND x.refunded_at IS NULL))
+		FROM shah_ticket_types tt
+		JOIN event_days_shah d ON d.id = tt.event_day_id
+		JOIN events e ON e.id = d.event_id
+		LEFT JOIN venues v ON v.id = d.venue_id
+		LEFT JOIN r ON r.kind = 'seat' AND r.type_id = tt.id
+		WHERE ($3::int IS NULL OR e.id = $3) AND ($4::int IS NULL OR v.id = $4)
+		GROUP BY e.id, e.title, e.currency, d.id, d.date, v.id, v.name, tt.id, tt.name
+		ORDER BY 5, 2, 1, 8`, f.From, f.To, f.EventId, f.VenueId)
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]*SalesLine, 0)
+	for rows.Next() {
+		var l SalesLine
+		var revenue Money
+		err = rows.Scan(&l.Kind, &l.EventId, &l.EventTitle, &l.EventDayId, &l.Date, &l.VenueId, &l.VenueName, &l.TicketTypeId, &l.TicketTypeName,
+			&l.Sold, &l.Refunded, &revenue.Amount, &revenue.Currency, &l.Remaining)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		l.Revenue = l.Revenue.Add(revenue)
+		lines = append(lines, &l)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// A seat can be sold as several ticket types, so the free seats of a
+	// seated day aren't the sum over its types
+	rows, err = tx.Query(ctx, `SELECT d.id, count(s.id) FILTER (WHERE NOT EXISTS(
+			SELECT 1 FROM tickets_shah x WHERE x.seat_id = s.id AND x.refunded_at IS NULL))
+		FROM event_days_shah d
+		JOIN shah_seats s ON s.event_day_id = d.id
+		WHERE ($1::int IS NULL OR d.event_id = $1) AND ($2::int IS NULL OR d.venue_id = $2)
+		GROUP BY d.id`, f.EventId, f.VenueId)
+	if err != nil {
+		return nil, err
+	}
+	freeSeats := make(map[int]int)
+	for rows.Next() {
+		var dayId, free int
+		if err = rows.Scan(&dayId, &free); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		freeSeats[dayId] = free
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return buildSalesReport(lines, freeSeats), nil
+}
+
+type dayKey struct {
+	kind string
+	id   int
+}
+
+func buildSalesReport(lines []*SalesLine, freeSeats map[int]int) *SalesReport {
+	report := SalesReport{Total: &SalesLine{}, ByTicketType: lines}
+	days := make(map[dayKey]*SalesLine)
+	events := make(map[int]*SalesLine)
+	venues := make(map[int]*SalesLine)
+
+	for _, l := range lines {
+		key := dayKey{l.Kind, *l.EventDayId}
+		day, ok := days[key]
+		if !ok {
+			day = &SalesLine{Kind: l.Kind, EventId: l.EventId, EventTitle: l.EventTitle, EventDayId: l.EventDayId, Date: l.Date, VenueId: l.VenueId, VenueName: l.VenueName}
+			if l.Kind == TicketKindSeat {
+				day.Remaining = freeSeats[*l.EventDayId]
+			}
+			days[key] = day
+			report.ByDay = append(report.ByDay, day)
+		}
+		day.add(l, l.Kind == TicketKindGA)
+	}
+
+	for _, day := range report.ByDay {
+		event, ok := events[*day.EventId]
+		if !ok {
+			event = &SalesLine{EventId: day.EventId, EventTitle: day.EventTitle}
+			events[*day.EventId] = event
+			report.ByEvent = append(report.ByEvent, event)
+		}
+		event.add(day, true)
+		if day.VenueId != nil {
+			venue, ok := venues[*day.VenueId]
+			if !ok {
+				venue = &SalesLine{VenueId: day.VenueId, VenueName: day.VenueName}
+				venues[*day.VenueId] = venue
+				report.ByVenue = append(report.ByVenue, venue)
+			}
+			venue.add(day, true)
+		}
+		report.Total.add(day, true)
+	}
+
+	if report.ByDay == nil {
+		report.ByDay = make([]*SalesLine, 0)
+	}
+	if report.ByEvent == nil {
+		report.ByEvent = make([]*SalesLine, 0)
+	}
+	if report.ByVenue == nil {
+		report.ByVenue = make([]*SalesLine, 0)
+	}
+	sort.SliceStable(report.ByEvent, func(i, j int) bool { return *report.ByEvent[i].EventId < *report.ByEvent[j].EventId })
+	sort.SliceStable(report.ByVenue, func(i, j int) bool { return *report.ByVenue[i].VenueId < *report.ByVenue[j].VenueId })
+	return &report
+}
+
+func (l *SalesLine) add(o *SalesLine, remaining bool) {
+	l.Sold += o.Sold
+	l.Refunded += o.Refunded
+	for _, m := range o.Revenue {
+		l.Revenue = l.Revenue.Add(m)
+	}
+	if remaining {
+		l.Remaining += o.Remaining
+	}
+}
+
+// GetDailySales returns tickets sold and revenue per currency per day of
+// purchase in the location, days without sales included.
+func (r *ReportRepo) GetDailySales(f *ReportFilter, loc *time.Location) ([]*DailySales, error) {
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	rows, err := tx.Query(ctx, `SELECT (r.purchase_time AT TIME ZONE $5)::date, r.currency, count(*), COALESCE(sum(r.price), 0)::bigint
+		FROM (`+reportTickets+`) r
+		WHERE r.refunded_at IS NULL
+		GROUP BY 1, 2 ORDER BY 1, 2`, f.From, f.To, f.EventId, f.VenueId, loc.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	series := make([]*DailySales, 0)
+	for rows.Next() {
+		var day time.Time
+		var sold int
+		var revenue Money
+		err = rows.Scan(&day, &revenue.Currency, &sold, &revenue.Amount)
+		if err != nil {
+			return nil, err
+		}
+		if len(series) == 0 || !series[len(series)-1].Day.Equal(day) {
+			series = append(series, &DailySales{Day: day})
+		}
+		d := series[len(series)-1]
+		d.Sold += sold
+		d.Revenue = d.Revenue.Add(revenue)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	err = tx.Commit(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return fillDays(series), nil
+}
+
+// fillDays adds the days without sales between the first and last one.
+func fillDays(series []*DailySales) []*DailySales {
+	if len(series) < 2 {
+		return series
+	}
+	filled := make([]*DailySales, 0, len(series))
+	for _, d := range series {
+		if len(filled) > 0 {
+			for next := filled[len(filled)-1].Day.AddDate(0, 0, 1); next.Before(d.Day); next = next.AddDate(0, 0, 1) {
+				filled = append(filled, &DailySales{Day: next})
+			}
+		}
+		filled = append(filled, d)
+	}
+	return filled
+}
+
+// GetReportTickets lists the tickets matching the filter with their buyers.
+func (r *ReportRepo) GetReportTickets(f *ReportFilter) ([]*ReportTicket, error) {
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	rows, err := tx.Query(ctx, `SELECT r.kind, r.id, r.order_id, r.title, r.date, r.venue_name, r.type_name, r.seat_num, r.price, r.currency,
+			r.purchase_time, r.refunded_at, r.checked_in,
+			NULLIF(concat_ws(' ', a.surname, a.name, a.patronymic), ''), u.email, u.phone
+		FROM (`+reportTickets+`) r
+		LEFT JOIN users u ON u.id = r.user_id
+		LEFT JOIN additional_user_data a ON a.user_id = r.user_id
+		ORDER BY r.purchase_time, r.kind, r.id`, f.From, f.To, f.EventId, f.VenueId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tickets := make([]*ReportTicket, 0)
+	for rows.Next() {
+		t := ReportTicket{Price: &Money{}}
+		err = rows.Scan(&t.Kind, &t.TicketId, &t.OrderId, &t.EventTitle, &t.Date, &t.VenueName, &t.TicketTypeName, &t.SeatNum, &t.Price.Amount, &t.Price.Currency,
+			&t.PurchaseTime, &t.RefundedAt, &t.CheckedIn, &t.BuyerName, &t.Email, &t.Phone)
+		if err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, &t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tickets, nil
+}
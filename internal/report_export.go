@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/xuri/excelize/v2"
+	"io"
+	"strconv"
+	"time"
+)
+
+var reportTicketHeader = []string{"Номер", "Заказ", "Событие", "Дата", "Площадка", "Билет", "Место", "Цена", "Валюта",
+	"Куплен", "Возврат", "Вход", "Покупатель", "Email", "Телефон"}
+
+const reportTimeLayout = "2006-01-02 15:04"
+
+func (t *ReportTicket) record() []string {
+	return []string{
+		fmt.Sprintf("%s-%d", t.Kind, t.TicketId),
+		intOr(t.OrderId),
+		stringOr(t.EventTitle, ""),
+		timeOr(t.Date),
+		stringOr(t.VenueName, ""),
+		stringOr(t.TicketTypeName, ""),
+		intOr(t.SeatNum),
+		t.Price.Major(),
+		t.Price.Currency,
+		timeOr(t.PurchaseTime),
+		timeOr(t.RefundedAt),
+		strconv.FormatBool(t.CheckedIn),
+		stringOr(t.BuyerName, ""),
+		stringOr(t.Email, ""),
+		stringOr(t.Phone, ""),
+	}
+}
+
+// WriteTicketsCSV writes the ticket export as CSV with a header row.
+func WriteTicketsCSV(w io.Writer, tickets []*ReportTicket) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(reportTicketHeader); err != nil {
+		return err
+	}
+	for _, t := range tickets {
+		if err := cw.Write(t.record()); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// TicketsXLSX renders the ticket export as a single sheet workbook. Numbers
+// and times are stored as such so they can be summed and sorted in Excel.
+func TicketsXLSX(tickets []*ReportTicket) ([]byte, error) {
+	f := excelize.NewFile()
+	defer f.Close()
+	sheet := f.GetSheetName(0)
+	sw, err := f.NewStreamWriter(sheet)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]interface{}, len(reportTicketHeader))
+	for i, h := range reportTicketHeader {
+		header[i] = h
+	}
+	if err := sw.SetRow("A1", header); err != nil {
+		return nil, err
+	}
+	for i, t := range tickets {
+		row := []interface{}{
+			fmt.Sprintf("%s-%d", t.Kind, t.TicketId),
+			cellOr(t.OrderId),
+			stringOr(t.EventTitle, ""),
+			timeOr(t.Date),
+			stringOr(t.VenueName, ""),
+			stringOr(t.TicketTypeName, ""),
+			cellOr(t.SeatNum),
+			moneyCell(t.Price),
+			t.Price.Currency,
+			timeOr(t.PurchaseTime),
+			timeOr(t.RefundedAt),
+			t.CheckedIn,
+			stringOr(t.BuyerName, ""),
+			stringOr(t.Email, ""),
+			stringOr(t.Phone, ""),
+		}
+		cell, err := excelize.CoordinatesToCellName(1, i+2)
+		if err != nil {
+			return nil, err
+		}
+		if err := sw.SetRow(cell, row); err != nil {
+			return nil, err
+		}
+	}
+	if err := sw.Flush(); err != nil {
+		return nil, err
+	}
+	buf, err := f.WriteToBuffer()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func intOr(v *int) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.Itoa(*v)
+}
+
+func cellOr(v *int) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+// moneyCell stores an amount as a number of major units.
+func moneyCell(m *Money) interface{} {
+	v, err := strconv.ParseFloat(m.Major(), 64)
+	if err != nil {
+		return m.Major()
+	}
+	return v
+}
+
+func timeOr(v *time.Time) string {
+	if v == nil {
+		return ""
+	}
+	return v.Format(reportTimeLayout)
+}
@@ -0,0 +1,258 @@
+package internal
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidRRule = errors.New("invalid recurrence rule")
+
+const (
+	freqDaily   = "DAILY"
+	freqWeekly  = "WEEKLY"
+	freqMonthly = "MONTHLY"
+)
+
+var rruleWeekdays = map[string]time.Weekday{
+	"MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday, "TH": time.Thursday,
+	"FR": time.Friday, "SA": time.Saturday, "SU": time.Sunday,
+}
+
+// rruleDay is a BYDAY entry. N picks the nth weekday of the month, counted
+// from the end when negative, 0 means every such weekday.
+type rruleDay struct {
+	N       int
+	Weekday time.Weekday
+}
+
+// RRule is the supported subset of an RFC 5545 recurrence rule: FREQ of
+// DAILY, WEEKLY or MONTHLY with INTERVAL, COUNT or UNTIL, BYDAY and
+// BYMONTHDAY. Weeks start on Monday.
+type RRule struct {
+	Freq       string
+	Interval   int
+	Count      int
+	Until      *time.Time
+	ByDay      []rruleDay
+	ByMonthDay []int
+}
+
+// ParseRRule parses a rule such as "FREQ=WEEKLY;BYDAY=FR,SA;UNTIL=20250601",
+// with or without the "RRULE:" prefix.
+func ParseRRule(s string) (*RRule, error) {
+	r := RRule{Interval: 1}
+	s = strings.TrimPrefix(strings.TrimSpace(s), "RRULE:")
+	for _, part := range strings.Split(s, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok || value == "" {
+			return nil, ErrInvalidRRule
+		}
+		var err error
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			r.Freq = strings.ToUpper(value)
+			if r.Freq != freqDaily && r.Freq != freqWeekly && r.Freq != freqMonthly {
+				return nil, ErrInvalidRRule
+			}
+		case "INTERVAL":
+			r.Interval, err = strconv.Atoi(value)
+			if err != nil || r.Interval < 1 {
+				return nil, ErrInvalidRRule
+			}
+		case "COUNT":
+			r.Count, err = strconv.Atoi(value)
+			if err != nil || r.Count < 1 {
+				return nil, ErrInvalidRRule
+			}
+		case "UNTIL":
+			until, err := parseRRuleTime(value)
+			if err != nil {
+				return nil, ErrInvalidRRule
+			}
+			r.Until = &until
+		case "BYDAY":
+			for _, d := range strings.Split(strings.ToUpper(value), ",") {
+				if len(d) < 2 {
+					return nil, ErrInvalidRRule
+				}
+				weekday, ok := rruleWeekdays[d[len(d)-2:]]
+				if !ok {
+					return nil, ErrInvalidRRule
+				}
+				n := 0
+				if len(d) > 2 {
+					n, err = strconv.Atoi(d[:len(d)-2])
+					if err != nil || n == 0 || n < -5 || n > 5 {
+						return nil, ErrInvalidRRule
+					}
+				}
+				r.ByDay = append(r.ByDay, rruleDay{N: n, Weekday: weekday})
+			}
+		case "BYMONTHDAY":
+			for _, d := range strings.Split(value, ",") {
+				n, err := strconv.Atoi(d)
+				if err != nil || n == 0 || n < -31 || n > 31 {
+					return nil, ErrInvalidRRule
+				}
+				r.ByMonthDay = append(r.ByMonthDay, n)
+			}
+		case "WKST":
+			if strings.ToUpper(value) != "MO" {
+				return nil, ErrInvalidRRule
+			}
+		default:
+			return nil, ErrInvalidRRule
+		}
+	}
+	if r.Freq == "" || (r.Count > 0 && r.Until != nil) {
+		return nil, ErrInvalidRRule
+	}
+	for _, d := range r.ByDay {
+		if d.N != 0 && r.Freq != freqMonthly {
+			return nil, ErrInvalidRRule
+		}
+	}
+	if len(r.ByMonthDay) > 0 && r.Freq != freqMonthly {
+		return nil, ErrInvalidRRule
+	}
+	return &r, nil
+}
+
+// parseRRuleTime reads an UNTIL value, a plain date includes the whole day.
+func parseRRuleTime(s string) (time.Time, error) {
+	if t, err := time.Parse("20060102T150405Z", s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("20060102", s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.AddDate(0, 0, 1).Add(-time.Second), nil
+}
+
+// Ended reports whether the rule has no occurrences after t.
+func (r *RRule) Ended(t time.Time) bool {
+	return r.Until != nil && r.Until.Before(t)
+}
+
+// Occurrences calls fn with every occurrence of the rule starting at start,
+// in order, up to and including until. Occurrences are at the time of day
+// of start in its location. fn returning false stops the expansion. COUNT
+// is counted from start.
+func (r *RRule) Occurrences(start, until time.Time, fn func(time.Time) bool) {
+	if r.Until != nil && r.Until.Before(until) {
+		until = *r.Until
+	}
+	loc := start.Location()
+	hour, minute, sec := start.Clock()
+	at := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, hour, minute, sec, 0, loc)
+	}
+
+	count := 0
+	for period := 0; ; period++ {
+		var candidates []time.Time
+		var periodStart time.Time
+		switch r.Freq {
+		case freqDaily:
+			periodStart = at(start.Year(), start.Month(), start.Day()+period*r.Interval)
+			if r.matchesWeekday(periodStart.Weekday()) {
+				candidates = []time.Time{periodStart}
+			}
+		case freqWeekly:
+			monday := start.Day() - (int(start.Weekday())+6)%7
+			periodStart = at(start.Year(), start.Month(), monday+period*7*r.Interval)
+			for i := 0; i < 7; i++ {
+				day := at(periodStart.Year(), periodStart.Month(), periodStart.Day()+i)
+				if (len(r.ByDay) == 0 && day.Weekday() == start.Weekday()) || (len(r.ByDay) > 0 && r.matchesWeekday(day.Weekday())) {
+					candidates = append(candidates, day)
+				}
+			}
+		case freqMonthly:
+			periodStart = at(start.Year(), start.Month()+time.Month(period*r.Interval), 1)
+			candidates = r.monthDays(periodStart, start.Day(), at)
+		}
+		if periodStart.After(until) {
+			return
+		}
+		for _, c := range candidates {
+			if c.Before(start) {
+				continue
+			}
+			if c.After(until) {
+				return
+			}
+			count++
+			if r.Count > 0 && count > r.Count {
+				return
+			}
+			if !fn(c) {
+				return
+			}
+		}
+	}
+}
+
+func (r *RRule) matchesWeekday(w time.Weekday) bool {
+	if len(r.ByDay) == 0 {
+		return true
+	}
+	for _, d := range r.ByDay {
+		if d.Weekday == w {
+			return true
+		}
+	}
+	return false
+}
+
+// monthDays returns the days of the month starting at first that match the
+// rule, the day of month of the start when the rule doesn't pick days.
+func (r *RRule) monthDays(first time.Time, startDay int, at func(int, time.Month, int) time.Time) []time.Time {
+	length := time.Date(first.Year(), first.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	byMonthDay := r.ByMonthDay
+	if len(byMonthDay) == 0 && len(r.ByDay) == 0 {
+		byMonthDay = []int{startDay}
+	}
+
+	days := make([]int, 0)
+	for day := 1; day <= length; day++ {
+		if len(byMonthDay) > 0 && !containsMonthDay(byMonthDay, day, length) {
+			continue
+		}
+		if len(r.ByDay) > 0 && !r.matchesMonthWeekday(first.Year(), first.Month(), day, length) {
+			continue
+		}
+		days = append(days, day)
+	}
+	sort.Ints(days)
+	result := make([]time.Time, 0, len(days))
+	for _, day := range days {
+		result = append(result, at(first.Year(), first.Month(), day))
+	}
+	return result
+}
+
+func containsMonthDay(byMonthDay []int, day, length int) bool {
+	for _, d := range byMonthDay {
+		if d == day || (d < 0 && length+d+1 == day) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RRule) matchesMonthWeekday(year int, month time.Month, day, length int) bool {
+	weekday := time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Weekday()
+	for _, d := range r.ByDay {
+		if d.Weekday != weekday {
+			continue
+		}
+		if d.N == 0 || (d.N > 0 && (day-1)/7+1 == d.N) || (d.N < 0 && (length-day)/7+1 == -d.N) {
+			return true
+		}
+	}
+	return false
+}
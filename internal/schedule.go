@@ -0,0 +1,391 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+var (
+	ErrScheduleNotFound      = errors.New("schedule not found")
+	ErrInvalidSchedule       = errors.New("invalid schedule")
+	ErrScheduleDayHasTickets = errors.New("tickets were already issued for this day")
+)
+
+// ScheduleHorizon is how far ahead days of an open ended schedule are
+// generated, ScheduleMaxHorizon how far an admin may extend one at once.
+const (
+	ScheduleHorizon    = 90 * 24 * time.Hour
+	ScheduleMaxHorizon = 2 * 365 * 24 * time.Hour
+)
+
+const scheduleDateLayout = "2006-01-02"
+
+type ScheduleRepo struct {
+	DB *pgxpool.Pool
+}
+
+// EventSchedule generates GA days of an event at a venue from a recurrence
+// rule. Start is the first occurrence, every day is at its time of day in
+// Timezone. ExDates are local days skipped by the rule. Types is the ticket
+// type template copied onto every generated day, price tiers are set on the
+// generated ticket types.
+type EventSchedule struct {
+	Id                *int                `json:"id"`
+	EventId           *int                `json:"eventId"`
+	VenueId           *int                `json:"venueId"`
+	RRule             *string             `json:"rrule"`
+	Start             *time.Time          `json:"start"`
+	Timezone          *string             `json:"timezone"`
+	ExDates           []string            `json:"exdates"`
+	MaxTicketsPerUser *int                `json:"maxTicketsPerUser"`
+	Types             []*TicketTypeNoShah `json:"types"`
+	GeneratedUntil    *time.Time          `json:"generatedUntil"`
+	CreatedAt         *time.Time          `json:"createdAt"`
+}
+
+// parseExDates turns local days into dates, duplicates are dropped.
+func parseExDates(days []string) ([]time.Time, error) {
+	dates := make([]time.Time, 0, len(days))
+	seen := make(map[string]bool)
+	for _, d := range days {
+		t, err := time.Parse(scheduleDateLayout, d)
+		if err != nil {
+			return nil, ErrInvalidSchedule
+		}
+		if seen[d] {
+			continue
+		}
+		seen[d] = true
+		dates = append(dates, t)
+	}
+	return dates, nil
+}
+
+func checkScheduleUntil(until time.Time) error {
+	if until.After(time.Now().Add(ScheduleMaxHorizon)) {
+		return ErrInvalidSchedule
+	}
+	return nil
+}
+
+// CreateSchedule saves a recurring schedule and generates its days up to
+// until, ScheduleHorizon from now when nil. The ids of the created days are
+// returned.
+func (r *ScheduleRepo) CreateSchedule(s *EventSchedule, until *time.Time) (*EventSchedule, []int, error) {
+	if s.EventId == nil || s.VenueId == nil || s.RRule == nil || s.Start == nil || len(s.Types) == 0 {
+		return nil, nil, ErrInvalidSchedule
+	}
+	if _, err := ParseRRule(*s.RRule); err != nil {
+		return nil, nil, err
+	}
+	if s.Timezone == nil {
+		tz := "UTC"
+		s.Timezone = &tz
+	}
+	if _, err := time.LoadLocation(*s.Timezone); err != nil {
+		return nil, nil, ErrInvalidSchedule
+	}
+	exDates, err := parseExDates(s.ExDates)
+	if err != nil {
+		return nil, nil, err
+	}
+	end := time.Now().Add(ScheduleHorizon)
+	if until != nil {
+		end = *until
+	}
+	if err := checkScheduleUntil(end); err != nil {
+		return nil, nil, err
+	}
+
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	currency, err := eventCurrency(ctx, tx, s.EventId)
+	if err != nil {
+		return nil, nil, err
+	}
+	var venueExists bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM venues WHERE id = $1)`, s.VenueId).Scan(&venueExists)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !venueExists {
+		return nil, nil, ErrInvalidSchedule
+	}
+	err = tx.QueryRow(ctx, `INSERT INTO event_schedules (event_id, venue_id, rrule, start_time, timezone, exdates, max_tickets_per_user)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at`,
+		s.EventId, s.VenueId, s.RRule, s.Start, s.Timezone, exDates, s.MaxTicketsPerUser).Scan(&s.Id, &s.CreatedAt)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, t := range s.Types {
+		if t == nil || t.Name == nil || t.Amount == nil || *t.Amount < 0 || len(t.Tiers) > 0 {
+			return nil, nil, ErrInvalidSchedule
+		}
+		if err := checkPrice(t.Price, currency); err != nil {
+			return nil, nil, err
+		}
+		err = tx.QueryRow(ctx, `INSERT INTO event_schedule_ticket_types (schedule_id, name, price, amount, max_tickets_per_user, position)
+			VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`, s.Id, t.Name, t.Price.Amount, t.Amount, t.MaxTicketsPerUser, i).Scan(&t.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	dayIds, err := generateScheduleDays(ctx, tx, s, currency, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, err
+	}
+	return s, dayIds, nil
+}
+
+func (r *ScheduleRepo) GetSchedulesByEvent(eventId *int) ([]*EventSchedule, error) {
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `SELECT id FROM event_schedules WHERE event_id = $1 ORDER BY id`, eventId)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return nil, err
+	}
+	schedules := make([]*EventSchedule, 0, len(ids))
+	for _, id := range ids {
+		s, err := getSchedule(ctx, tx, id, false)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, s)
+	}
+	return schedules, tx.Commit(ctx)
+}
+
+// ExtendSchedule generates the days of a schedule up to until and returns
+// the ids of the new ones.
+func (r *ScheduleRepo) ExtendSchedule(id *int, until time.Time) ([]int, error) {
+	if err := checkScheduleUntil(until); err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	s, err := getSchedule(ctx, tx, *id, true)
+	if err != nil {
+		return nil, err
+	}
+	currency, err := eventCurrency(ctx, tx, s.EventId)
+	if err != nil {
+		return nil, err
+	}
+	dayIds, err := generateScheduleDays(ctx, tx, s, currency, until)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return dayIds, nil
+}
+
+// ExtendSchedules keeps ScheduleHorizon worth of days generated for the
+// schedules of events still running and returns how many days were created.
+func (r *ScheduleRepo) ExtendSchedules() (int, error) {
+	ctx := context.Background()
+	until := time.Now().Add(ScheduleHorizon)
+	rows, err := r.DB.Query(ctx, `SELECT s.id FROM event_schedules s JOIN events e ON e.id = s.event_id
+		WHERE e.deleted_at IS NULL AND e.status <> ALL($1) AND (s.generated_until IS NULL OR s.generated_until < $2)
+		ORDER BY s.id`, []string{EventStatusCancelled, EventStatusFinished}, until)
+	if err != nil {
+		return 0, err
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return 0, err
+	}
+	// One broken schedule doesn't hold back the others
+	created := 0
+	var errs []error
+	for _, id := range ids {
+		dayIds, err := r.ExtendSchedule(&id, until)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		created += len(dayIds)
+	}
+	return created, errors.Join(errs...)
+}
+
+// AddExceptionDates skips more local days in a schedule. Days already
+// generated on them are removed unless tickets were issued for them.
+func (r *ScheduleRepo) AddExceptionDates(id *int, days []string) error {
+	dates, err := parseExDates(days)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	s, err := getSchedule(ctx, tx, *id, true)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(ctx, `SELECT id FROM event_days_no_shah
+		WHERE schedule_id = $1 AND (date AT TIME ZONE $2)::date = ANY($3)`, s.Id, s.Timezone, dates)
+	if err != nil {
+		return err
+	}
+	dayIds, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return err
+	}
+	var used bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM tickets_no_shah t
+		JOIN ticket_types_no_shah tt ON tt.id = t.ticket_type_id WHERE tt.event_day_id = ANY($1))`, dayIds).Scan(&used)
+	if err != nil {
+		return err
+	}
+	if used {
+		return ErrScheduleDayHasTickets
+	}
+	statements := []string{
+		`DELETE FROM waitlist_entries WHERE ticket_type_id IN (SELECT id FROM ticket_types_no_shah WHERE event_day_id = ANY($1))`,
+		`DELETE FROM promo_codes WHERE ticket_type_id IN (SELECT id FROM ticket_types_no_shah WHERE event_day_id = ANY($1))`,
+		`DELETE FROM ticket_types_no_shah WHERE event_day_id = ANY($1)`,
+		`DELETE FROM event_days_no_shah WHERE id = ANY($1)`,
+	}
+	for _, stmt := range statements {
+		_, err = tx.Exec(ctx, stmt, dayIds)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE event_schedules SET exdates = ARRAY(SELECT DISTINCT unnest(exdates || $2::date[]) ORDER BY 1) WHERE id = $1`, s.Id, dates)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func getSchedule(ctx context.Context, tx pgx.Tx, id int, lock bool) (*EventSchedule, error) {
+	query := `SELECT id, event_id, venue_id, rrule, start_time, timezone, exdates, max_tickets_per_user, generated_until, created_at
+		FROM event_schedules WHERE id = $1`
+	if lock {
+		query += ` FOR UPDATE`
+	}
+	var s EventSchedule
+	var exDates []time.Time
+	err := tx.QueryRow(ctx, query, id).Scan(&s.Id, &s.EventId, &s.VenueId, &s.RRule, &s.Start, &s.Timezone, &exDates,
+		&s.MaxTicketsPerUser, &s.GeneratedUntil, &s.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrScheduleNotFound
+		}
+		return nil, err
+	}
+	s.ExDates = make([]string, 0, len(exDates))
+	for _, d := range exDates {
+		s.ExDates = append(s.ExDates, d.Format(scheduleDateLayout))
+	}
+
+	rows, err := tx.Query(ctx, `SELECT t.id, t.name, t.price, e.currency, t.amount, t.max_tickets_per_user
+		FROM event_schedule_ticket_types t
+		JOIN event_schedules s ON s.id = t.schedule_id
+		JOIN events e ON e.id = s.event_id
+		WHERE t.schedule_id = $1 ORDER BY t.position, t.id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	s.Types = make([]*TicketTypeNoShah, 0)
+	for rows.Next() {
+		t := TicketTypeNoShah{Price: &Money{}}
+		err = rows.Scan(&t.ID, &t.Name, &t.Price.Amount, &t.Price.Currency, &t.Amount, &t.MaxTicketsPerUser)
+		if err != nil {
+			return nil, err
+		}
+		s.Types = append(s.Types, &t)
+	}
+	return &s, rows.Err()
+}
+
+// generateScheduleDays creates the days of the schedule after the ones
+// generated so far up to until. Days in the past and on exception dates are
+// skipped.
+func generateScheduleDays(ctx context.Context, tx pgx.Tx, s *EventSchedule, currency string, until time.Time) ([]int, error) {
+	rule, err := ParseRRule(*s.RRule)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(*s.Timezone)
+	if err != nil {
+		return nil, ErrInvalidSchedule
+	}
+	skip := make(map[string]bool)
+	for _, d := range s.ExDates {
+		skip[d] = true
+	}
+	after := time.Now()
+	if s.GeneratedUntil != nil && s.GeneratedUntil.After(after) {
+		after = *s.GeneratedUntil
+	}
+
+	dayIds := make([]int, 0)
+	var genErr error
+	rule.Occurrences(s.Start.In(loc), until, func(date time.Time) bool {
+		if !date.After(after) || skip[date.Format(scheduleDateLayout)] {
+			return true
+		}
+		var exists bool
+		genErr = tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM event_days_no_shah WHERE schedule_id = $1 AND date = $2)`, s.Id, date).Scan(&exists)
+		if genErr != nil || exists {
+			return genErr == nil
+		}
+		day := DateWithTicketsNoShah{Date: &date, MaxTicketsPerUser: s.MaxTicketsPerUser, Types: s.Types}
+		id, err := insertDayNoShah(ctx, tx, s.EventId, s.VenueId, s.Id, &day, currency)
+		if err != nil {
+			genErr = err
+			return false
+		}
+		dayIds = append(dayIds, id)
+		return true
+	})
+	if genErr != nil {
+		return nil, genErr
+	}
+
+	if s.GeneratedUntil == nil || until.After(*s.GeneratedUntil) {
+		_, err = tx.Exec(ctx, `UPDATE event_schedules SET generated_until = $2 WHERE id = $1`, s.Id, until)
+		if err != nil {
+			return nil, err
+		}
+		s.GeneratedUntil = &until
+	}
+	return dayIds, nil
+}
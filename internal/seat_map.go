@@ -0,0 +1,307 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"strings"
+	"time"
+)
+
+var (
+	ErrSeatMapTemplateNotFound = errors.New("seat map template not found")
+	ErrInvalidSeatMapTemplate  = errors.New("invalid seat map template")
+	ErrUnknownSector           = errors.New("unknown sector")
+)
+
+type SeatMapRepo struct {
+	DB *pgxpool.Pool
+}
+
+// SeatMapTemplate is a named layout of a venue. Saving a template under a
+// name the venue already uses adds a new version, event days keep the copy
+// they were created from.
+type SeatMapTemplate struct {
+	Id        *int             `json:"id"`
+	VenueId   *int             `json:"venueId"`
+	Name      *string          `json:"name"`
+	Version   *int             `json:"version"`
+	AdminId   *int             `json:"adminId"`
+	CreatedAt *time.Time       `json:"createdAt"`
+	SeatCount *int             `json:"seatCount"`
+	Sectors   []*SeatMapSector `json:"sectors"`
+	Seats     []*TemplateSeat  `json:"seats"`
+}
+
+// SeatMapSector groups seats of a template sold at one price. Every sector
+// becomes a ticket type of the event day created from the template.
+type SeatMapSector struct {
+	Id                *int    `json:"id"`
+	Name              *string `json:"name"`
+	Price             *Money  `json:"price"`
+	Color             *string `json:"color"`
+	MaxTicketsPerUser *int    `json:"maxTicketsPerUser"`
+}
+
+// TemplateSeat is a seat of a template, Sectors holds the names of the
+// sectors it belongs to.
+type TemplateSeat struct {
+	Id        *int     `json:"id"`
+	Num       *int     `json:"num"`
+	Left      *int     `json:"left"`
+	Top       *int     `json:"top"`
+	BgColor   *string  `json:"bgColor"`
+	TextColor *string  `json:"textColor"`
+	Sectors   []string `json:"sectors"`
+}
+
+// SectorPrice overrides the price of a template sector for one event. The
+// price of a sector that isn't overridden must already be in the event
+// currency.
+type SectorPrice struct {
+	SectorId *int   `json:"sectorId"`
+	Price    *Money `json:"price"`
+}
+
+func (r *SeatMapRepo) CreateTemplate(t *SeatMapTemplate) (*SeatMapTemplate, error) {
+	if t.VenueId == nil || t.Name == nil || strings.TrimSpace(*t.Name) == "" || len(t.Seats) == 0 || len(t.Sectors) == 0 {
+		return nil, ErrInvalidSeatMapTemplate
+	}
+	name := strings.TrimSpace(*t.Name)
+	t.Name = &name
+
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, `INSERT INTO seat_map_templates (venue_id, name, version, admin_id)
+		SELECT $1, $2, COALESCE(max(version), 0) + 1, $3 FROM seat_map_templates WHERE venue_id = $1 AND name = $2
+		RETURNING id, version, created_at`, t.VenueId, t.Name, t.AdminId).Scan(&t.Id, &t.Version, &t.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	sectorIds := make(map[string]int)
+	for _, sector := range t.Sectors {
+		if sector == nil || sector.Name == nil || sector.Price == nil || sector.Price.Amount < 0 {
+			return nil, ErrInvalidSeatMapTemplate
+		}
+		if sector.Price.Currency == "" {
+			sector.Price.Currency = DefaultCurrency
+		}
+		if !ValidCurrency(sector.Price.Currency) {
+			return nil, ErrUnsupportedCurrency
+		}
+		if _, ok := sectorIds[*sector.Name]; ok {
+			return nil, ErrInvalidSeatMapTemplate
+		}
+		err = tx.QueryRow(ctx, `INSERT INTO seat_map_template_sectors (template_id, name, price, currency, color, max_tickets_per_user)
+			VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`, t.Id, sector.Name, sector.Price.Amount, sector.Price.Currency, sector.Color, sector.MaxTicketsPerUser).Scan(&sector.Id)
+		if err != nil {
+			return nil, err
+		}
+		sectorIds[*sector.Name] = *sector.Id
+	}
+
+	for _, seat := range t.Seats {
+		if seat == nil || len(seat.Sectors) == 0 {
+			return nil, ErrInvalidSeatMapTemplate
+		}
+		err = tx.QueryRow(ctx, `INSERT INTO seat_map_template_seats (template_id, num, "left", top, bg_color, text_color)
+			VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`, t.Id, seat.Num, seat.Left, seat.Top, seat.BgColor, seat.TextColor).Scan(&seat.Id)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range seat.Sectors {
+			sectorId, ok := sectorIds[name]
+			if !ok {
+				return nil, ErrUnknownSector
+			}
+			_, err = tx.Exec(ctx, `INSERT INTO seat_map_template_seat_sectors (seat_id, sector_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, seat.Id, sectorId)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	count := len(t.Seats)
+	t.SeatCount = &count
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// GetTemplatesByVenue lists every version of the venue templates without
+// their seats, latest versions first.
+func (r *SeatMapRepo) GetTemplatesByVenue(venueId *int) ([]*SeatMapTemplate, error) {
+	tx, err := r.DB.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+	rows, err := tx.Query(context.Background(), `SELECT t.id, t.venue_id, t.name, t.version, t.admin_id, t.created_at,
+			(SELECT count(*) FROM seat_map_template_seats s WHERE s.template_id = t.id)
+		FROM seat_map_templates t WHERE t.venue_id = $1 ORDER BY t.name, t.version DESC`, venueId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	templates := make([]*SeatMapTemplate, 0)
+	for rows.Next() {
+		var t SeatMapTemplate
+		err = rows.Scan(&t.Id, &t.VenueId, &t.Name, &t.Version, &t.AdminId, &t.CreatedAt, &t.SeatCount)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, &t)
+	}
+	err = tx.Commit(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return templates, nil
+}
+
+func (r *SeatMapRepo) GetTemplate(id *int) (*SeatMapTemplate, error) {
+	tx, err := r.DB.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+	return getTemplate(context.Background(), tx, id)
+}
+
+func getTemplate(ctx context.Context, tx pgx.Tx, id *int) (*SeatMapTemplate, error) {
+	var t SeatMapTemplate
+	err := tx.QueryRow(ctx, `SELECT id, venue_id, name, version, admin_id, created_at FROM seat_map_templates WHERE id = $1`, id).
+		Scan(&t.Id, &t.VenueId, &t.Name, &t.Version, &t.AdminId, &t.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrSeatMapTemplateNotFound
+		}
+		return nil, err
+	}
+
+	rows, err := tx.Query(ctx, `SELECT id, name, price, currency, color, max_tickets_per_user FROM seat_map_template_sectors WHERE template_id = $1 ORDER BY id`, id)
+	if err != nil {
+		return nil, err
+	}
+	t.Sectors = make([]*SeatMapSector, 0)
+	sectorNames := make(map[int]string)
+	for rows.Next() {
+		s := SeatMapSector{Price: &Money{}}
+		if err = rows.Scan(&s.Id, &s.Name, &s.Price.Amount, &s.Price.Currency, &s.Color, &s.MaxTicketsPerUser); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		t.Sectors = append(t.Sectors, &s)
+		sectorNames[*s.Id] = *s.Name
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.Query(ctx, `SELECT s.id, s.num, s."left", s.top, s.bg_color, s.text_color,
+			COALESCE(array_agg(ss.sector_id ORDER BY ss.sector_id) FILTER (WHERE ss.sector_id IS NOT NULL), '{}')
+		FROM seat_map_template_seats s
+		LEFT JOIN seat_map_template_seat_sectors ss ON ss.seat_id = s.id
+		WHERE s.template_id = $1 GROUP BY s.id ORDER BY s.id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	t.Seats = make([]*TemplateSeat, 0)
+	for rows.Next() {
+		var s TemplateSeat
+		var sectorIds []int32
+		if err = rows.Scan(&s.Id, &s.Num, &s.Left, &s.Top, &s.BgColor, &s.TextColor, &sectorIds); err != nil {
+			return nil, err
+		}
+		s.Sectors = make([]string, 0, len(sectorIds))
+		for _, sectorId := range sectorIds {
+			s.Sectors = append(s.Sectors, sectorNames[int(sectorId)])
+		}
+		t.Seats = append(t.Seats, &s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	count := len(t.Seats)
+	t.SeatCount = &count
+	return &t, nil
+}
+
+// CreateEventDaysFromTemplate creates days of a seated event at the template
+// venue with a copy of the template layout. Sectors are sold at their
+// template price unless prices overrides them.
+func (r *SeatMapRepo) CreateEventDaysFromTemplate(eventId, templateId *int, dates []*time.Time, prices []*SectorPrice) ([]int, error) {
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	t, err := getTemplate(ctx, tx, templateId)
+	if err != nil {
+		return nil, err
+	}
+	seats, err := t.seatMap(prices)
+	if err != nil {
+		return nil, err
+	}
+	dayIds, err := createSeatMapDays(ctx, tx, eventId, t.VenueId, dates, seats, t.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return dayIds, nil
+}
+
+// seatMap turns the template into the layout an event day is created from,
+// with sectors as ticket types keyed by the sector id. A seat is listed at
+// the lowest price of its sectors.
+func (t *SeatMapTemplate) seatMap(prices []*SectorPrice) ([][]*Seat, error) {
+	types := make(map[string]*TicketType)
+	byId := make(map[int]*TicketType)
+	for _, sector := range t.Sectors {
+		price := *sector.Price
+		one := 1
+		tt := &TicketType{ID: sector.Id, Name: sector.Name, Price: &price, Amount: &one, MaxTicketsPerUser: sector.MaxTicketsPerUser}
+		types[*sector.Name] = tt
+		byId[*sector.Id] = tt
+	}
+	for _, p := range prices {
+		if p == nil || p.SectorId == nil || p.Price == nil || p.Price.Amount < 0 {
+			return nil, ErrInvalidSeatMapTemplate
+		}
+		tt, ok := byId[*p.SectorId]
+		if !ok {
+			return nil, ErrUnknownSector
+		}
+		price := *p.Price
+		tt.Price = &price
+	}
+
+	row := make([]*Seat, 0, len(t.Seats))
+	for _, s := range t.Seats {
+		seat := &Seat{Num: s.Num, Left: s.Left, Top: s.Top, BgColor: s.BgColor, TextColor: s.TextColor, Types: make([]*TicketType, 0, len(s.Sectors))}
+		for _, name := range s.Sectors {
+			tt := types[name]
+			seat.Types = append(seat.Types, tt)
+			if seat.Price == nil || tt.Price.Amount < seat.Price.Amount {
+				seat.Price = tt.Price
+			}
+		}
+		row = append(row, seat)
+	}
+	return [][]*Seat{row}, nil
+}
@@ -2,7 +2,7 @@ package internal
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"time"
@@ -13,40 +13,61 @@ type TicketRepo struct {
 }
 
 type TicketTypeNoShah struct {
-	ID         *int    `json:"id"`
-	EventDayId *int    `json:"event_day_id"`
-	Name       *string `json:"name"`
-	Price      *int    `json:"price"`
-	Amount     *int    `json:"amount"`
-	SoldCount  *int    `json:"sold_count"`
-	Version    *int    `json:"version"`
+	ID                *int         `json:"id"`
+	EventDayId        *int         `json:"event_day_id"`
+	Name              *string      `json:"name"`
+	Price             *Money       `json:"price"`
+	Amount            *int         `json:"amount"`
+	SoldCount         *int         `json:"sold_count"`
+	Version           *int         `json:"version"`
+	MaxTicketsPerUser *int         `json:"maxTicketsPerUser"`
+	Tiers             []*PriceTier `json:"tiers"`
+	CurrentPrice      *Money       `json:"currentPrice"`
+	CurrentTier       *string      `json:"currentTier"`
+	NextPriceChange   *PriceChange `json:"nextPriceChange"`
 }
 
 type DateWithTicketsNoShah struct {
-	ID      *int                `json:"id"`
-	EventId *int                `json:"event_id"`
-	Date    *time.Time          `json:"date"`
-	Types   []*TicketTypeNoShah `json:"types"`
+	ID                *int                `json:"id"`
+	EventId           *int                `json:"event_id"`
+	Date              *time.Time          `json:"date"`
+	MaxTicketsPerUser *int                `json:"maxTicketsPerUser"`
+	Types             []*TicketTypeNoShah `json:"types"`
+}
+
+// DateWithSeatsShah is a day of a seated event with its own copy of the
+// venue layout.
+type DateWithSeatsShah struct {
+	ID         *int       `json:"id"`
+	EventId    *int       `json:"event_id"`
+	VenueId    *int       `json:"venue_id"`
+	Date       *time.Time `json:"date"`
+	TemplateId *int       `json:"templateId"`
+	Seats      []*Seat    `json:"seats"`
 }
 
 type Seat struct {
-	Id        *int          `json:"id"`
-	VenueId   *int          `json:"venue_id"`
-	Num       *int          `json:"num"`
-	Left      *int          `json:"left"`
-	Top       *int          `json:"top"`
-	Price     *int          `json:"price"`
-	BgColor   *string       `json:"bgColor"`
-	TextColor *string       `json:"textColor"`
-	Types     []*TicketType `json:"types"`
-	Date      *time.Time    `json:"date"`
+	Id         *int          `json:"id"`
+	VenueId    *int          `json:"venue_id"`
+	EventDayId *int          `json:"event_day_id"`
+	Num        *int          `json:"num"`
+	Left       *int          `json:"left"`
+	Top        *int          `json:"top"`
+	Price      *Money        `json:"price"`
+	BgColor    *string       `json:"bgColor"`
+	TextColor  *string       `json:"textColor"`
+	Types      []*TicketType `json:"types"`
+	Date       *time.Time    `json:"date"`
+	IsSold     *bool         `json:"isSold"`
+	IsHeld     *bool         `json:"isHeld"`
 }
 
 type TicketType struct {
-	ID     *int    `json:"id"`
-	Name   *string `json:"name"`
-	Price  *int    `json:"price"`
-	Amount *int    `json:"amount"`
+	ID                *int    `json:"id"`
+	Name              *string `json:"name"`
+	Price             *Money  `json:"price"`
+	Amount            *int    `json:"amount"`
+	MaxTicketsPerUser *int    `json:"maxTicketsPerUser"`
 }
 
 func (r *TicketRepo) CreateTicketsNoSham(eventId, venueId *int, days []*DateWithTicketsNoShah) error {
@@ -56,18 +77,15 @@ func (r *TicketRepo) CreateTicketsNoSham(eventId, venueId *int, days []*DateWith
 	}
 	defer tx.Rollback(context.Background())
 
+	currency, err := eventCurrency(context.Background(), tx, eventId)
+	if err != nil {
+		return err
+	}
 	for _, day := range days {
-		var id int
-		err := tx.QueryRow(context.Background(), `INSERT INTO event_days_no_shah(id, event_id, venue_id, date) VALUES(default, $1, $2, $3) RETURNING id`, eventId, venueId, day.Date).Scan(&id)
+		_, err := insertDayNoShah(context.Background(), tx, eventId, venueId, nil, day, currency)
 		if err != nil {
 			return err
 		}
-		for _, t := range day.Types {
-			_, err := tx.Exec(context.Background(), `INSERT INTO ticket_types_no_shah(id, event_day_id, name, price, amount, sold_count, version) VALUES(default, $1, $2, $3, $4, $5, $6)`, id, t.Name, t.Price, t.Amount, 0, 1)
-			if err != nil {
-				return err
-			}
-		}
 	}
 
 	err = tx.Commit(context.Background())
@@ -78,66 +96,126 @@ func (r *TicketRepo) CreateTicketsNoSham(eventId, venueId *int, days []*DateWith
 
 }
 
+// insertDayNoShah creates a GA event day with its ticket types, scheduleId
+// is set for days generated by a recurrence rule.
+func insertDayNoShah(ctx context.Context, tx pgx.Tx, eventId, venueId, scheduleId *int, day *DateWithTicketsNoShah, currency string) (int, error) {
+	var id int
+	err := tx.QueryRow(ctx, `INSERT INTO event_days_no_shah(id, event_id, venue_id, date, max_tickets_per_user, schedule_id) VALUES(default, $1, $2, $3, $4, $5) RETURNING id`, eventId, venueId, day.Date, day.MaxTicketsPerUser, scheduleId).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	for _, t := range day.Types {
+		if err := checkPrice(t.Price, currency); err != nil {
+			return 0, err
+		}
+		var typeId int
+		err := tx.QueryRow(ctx, `INSERT INTO ticket_types_no_shah(id, event_day_id, name, price, amount, sold_count, version, max_tickets_per_user) VALUES(default, $1, $2, $3, $4, $5, $6, $7) RETURNING id`, id, t.Name, t.Price.Amount, t.Amount, 0, 1, t.MaxTicketsPerUser).Scan(&typeId)
+		if err != nil {
+			return 0, err
+		}
+		err = insertPriceTiers(ctx, tx, typeId, currency, t.Tiers)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
 type TicketPurchaseResult struct {
-	TicketID         int
+	TicketIDs        []int
 	PurchaseTime     time.Time
 	RemainingTickets int
 }
 
-func (r *TicketRepo) BuyTicketNoShah(ticketTypeID, userID, count *int) (*TicketPurchaseResult, error) {
+var (
+	ErrTicketTypeNotFound  = errors.New("ticket type not found")
+	ErrNoTicketsAvailable  = errors.New("no tickets available")
+	ErrInvalidTicketsCount = errors.New("invalid tickets count")
+	ErrSeatNotFound        = errors.New("seat not found")
+	ErrSeatTypeMismatch    = errors.New("ticket type is not available for seat")
+	ErrSeatAlreadySold     = errors.New("seat already sold")
+	ErrSeatHeld            = errors.New("seat is held by another buyer")
+	ErrSeatMapDateRequired = errors.New("seat map needs at least one date")
+	ErrSeatMapInUse        = errors.New("tickets were already issued for this event day")
+)
+
+// reserveTicketsNoShah takes count tickets of a type out of the pool inside tx.
+// Tickets issued for a hold stay reserved until the hold is converted. The
+// event has to be in one of statuses.
+func reserveTicketsNoShah(ctx context.Context, tx pgx.Tx, ticketTypeID, userID *int, count int, holdId *int, statuses []string) (*TicketPurchaseResult, error) {
 	var result TicketPurchaseResult
-	ctx := context.Background()
-	tx, err := r.DB.Begin(ctx)
+
+	err := lockUserPurchases(ctx, tx, userID)
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Rollback(ctx)
 
 	// Lock the ticket type row to prevent concurrent updates
-	row := tx.QueryRow(ctx, `
-		SELECT id, amount - sold_count AS remaining_tickets
-		FROM ticket_types_no_shah	
-		WHERE id = $1
-		FOR UPDATE
-	`, ticketTypeID)
-
 	var remainingTickets int
-	err = row.Scan(&result.TicketID, &remainingTickets)
+	var onSale bool
+	err = tx.QueryRow(ctx, `
+		SELECT tt.amount - tt.sold_count AS remaining_tickets, e.status = ANY($2) AND e.deleted_at IS NULL
+		FROM ticket_types_no_shah tt
+		JOIN event_days_no_shah d ON d.id = tt.event_day_id
+		JOIN events e ON e.id = d.event_id
+		WHERE tt.id = $1
+		FOR UPDATE OF tt
+	`, ticketTypeID, statuses).Scan(&remainingTickets, &onSale)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			return nil, fmt.Errorf("ticket type not found")
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrTicketTypeNotFound
 		}
 		return nil, err
 	}
+	if !onSale {
+		return nil, ErrEventNotOnSale
+	}
 
-	if remainingTickets <= 0 {
-		return nil, fmt.Errorf("no tickets available")
+	if remainingTickets < count {
+		return nil, ErrNoTicketsAvailable
+	}
+
+	// Insert all tickets at once, they share the purchase time
+	rows, err := tx.Query(ctx, `
+		INSERT INTO tickets_no_shah (ticket_type_id, user_id, is_reserved, hold_id)
+		SELECT $1, $2, $4::int IS NOT NULL, $4 FROM generate_series(1, $3)
+		RETURNING id, purchase_time
+	`, ticketTypeID, userID, count, holdId)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id, &result.PurchaseTime)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		result.TicketIDs = append(result.TicketIDs, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
 
-	// Insert the purchased ticket and get its ID and purchase time
 	err = tx.QueryRow(ctx, `
-		WITH inserted_ticket AS (
-			INSERT INTO tickets (ticket_type_id, user_id)
-			VALUES ($1, $2)
-			RETURNING id, purchase_time
-		)
-		UPDATE ticket_types
-		SET sold_count = sold_count + 1
+		UPDATE ticket_types_no_shah
+		SET sold_count = sold_count + $2, version = version + 1
 		WHERE id = $1
-		RETURNING (SELECT id FROM inserted_ticket), 
-				  (SELECT purchase_time FROM inserted_ticket), 
-				  amount - sold_count AS remaining_tickets
-	`, ticketTypeID, userID).Scan(&result.TicketID, &result.PurchaseTime, &result.RemainingTickets)
-
+		RETURNING amount - sold_count
+	`, ticketTypeID, count).Scan(&result.RemainingTickets)
 	if err != nil {
 		return nil, err
 	}
 
-	// Commit the transaction
-	if err := tx.Commit(ctx); err != nil {
+	err = checkLimitsNoShah(ctx, tx, userID, ticketTypeID)
+	if err != nil {
+		return nil, err
+	}
+	err = notifyTicketTypes(ctx, tx, []int{*ticketTypeID})
+	if err != nil {
 		return nil, err
 	}
-
 	return &result, nil
 }
 
@@ -149,7 +227,7 @@ func (r *TicketRepo) GetDatesForEventVenue(eventId, venueId *int) ([]*DateWithTi
 	}
 
 	defer tx.Rollback(context.Background())
-	rows, err := tx.Query(context.Background(), `SELECT id, date FROM event_days_no_shah WHERE event_id = $1 AND venue_id = $2`, eventId, venueId)
+	rows, err := tx.Query(context.Background(), `SELECT id, date, max_tickets_per_user FROM event_days_no_shah WHERE event_id = $1 AND venue_id = $2`, eventId, venueId)
 	if err != nil {
 		return nil, err
 	}
@@ -157,7 +235,7 @@ func (r *TicketRepo) GetDatesForEventVenue(eventId, venueId *int) ([]*DateWithTi
 	dates := make([]*DateWithTicketsNoShah, 0)
 	for rows.Next() {
 		var d DateWithTicketsNoShah
-		err = rows.Scan(&d.ID, &d.Date)
+		err = rows.Scan(&d.ID, &d.Date, &d.MaxTicketsPerUser)
 		if err != nil {
 			return nil, err
 		}
@@ -178,20 +256,37 @@ func (r *TicketRepo) GetTypesForDate(dateId *int) ([]*TicketTypeNoShah, error) {
 		return nil, err
 	}
 	defer tx.Rollback(context.Background())
-	rows, err := tx.Query(context.Background(), `SELECT id, name, price, amount, sold_count, version FROM ticket_types_no_shah WHERE event_day_id = $1`, dateId)
+	rows, err := tx.Query(context.Background(), `SELECT t.id, t.name, t.price, e.currency, t.amount, t.sold_count, t.version, t.max_tickets_per_user, d.date
+		FROM ticket_types_no_shah t
+		JOIN event_days_no_shah d ON d.id = t.event_day_id
+		JOIN events e ON e.id = d.event_id
+		WHERE t.event_day_id = $1`, dateId)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	result := make([]*TicketTypeNoShah, 0)
+	var date *time.Time
+	ids := make([]int, 0)
 	for rows.Next() {
-		var t TicketTypeNoShah
+		t := TicketTypeNoShah{Price: &Money{}}
 		t.EventDayId = dateId
-		err = rows.Scan(&t.ID, &t.Name, &t.Price, &t.Amount, &t.SoldCount, &t.Version)
+		err = rows.Scan(&t.ID, &t.Name, &t.Price.Amount, &t.Price.Currency, &t.Amount, &t.SoldCount, &t.Version, &t.MaxTicketsPerUser, &date)
 		if err != nil {
 			return nil, err
 		}
 		result = append(result, &t)
+		ids = append(ids, *t.ID)
+	}
+	rows.Close()
+
+	tiers, err := loadPriceTiers(context.Background(), tx, ids)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, t := range result {
+		t.applyPriceSchedule(tiers[*t.ID], date, now)
 	}
 	err = tx.Commit(context.Background())
 	if err != nil {
@@ -200,64 +295,148 @@ func (r *TicketRepo) GetTypesForDate(dateId *int) ([]*TicketTypeNoShah, error) {
 	return result, nil
 }
 
-func (r *TicketRepo) CreateTicketsWithSham(eventId, venueId *int, seats [][]*Seat) error {
-	tx, err := r.DB.Begin(context.Background())
+// CreateTicketsWithSham copies a seat layout into a day of the event for
+// every date, each day gets its own seats and ticket types. Uploading again
+// for an existing day replaces its layout as long as no tickets were issued
+// for it. Without dates, as uploaded before events had seated days, the
+// layout is for the day the event starts.
+func (r *TicketRepo) CreateTicketsWithSham(eventId, venueId *int, dates []*time.Time, seats [][]*Seat) ([]int, error) {
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if len(dates) == 0 {
+		var start *time.Time
+		err = tx.QueryRow(ctx, `SELECT start_time FROM events WHERE id = $1`, eventId).Scan(&start)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return nil, err
+		}
+		dates = []*time.Time{start}
 	}
-	defer tx.Rollback(context.Background())
 
-	_, err = tx.Exec(context.Background(), `DELETE FROM shah_seats WHERE venue_id = $1`, venueId)
+	dayIds, err := createSeatMapDays(ctx, tx, eventId, venueId, dates, seats, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return dayIds, nil
+}
 
-	uniqueTypes := GetUniqueTicketTypes(seats)
+// createSeatMapDays creates or replaces the event days at the dates with a
+// copy of seats and returns their ids.
+func createSeatMapDays(ctx context.Context, tx pgx.Tx, eventId, venueId *int, dates []*time.Time, seats [][]*Seat, templateId *int) ([]int, error) {
+	if len(dates) == 0 {
+		return nil, ErrSeatMapDateRequired
+	}
+	currency, err := eventCurrency(ctx, tx, eventId)
+	if err != nil {
+		return nil, err
+	}
+	dayIds := make([]int, 0, len(dates))
+	for _, date := range dates {
+		if date == nil {
+			return nil, ErrSeatMapDateRequired
+		}
+		var dayId int
+		err := tx.QueryRow(ctx, `INSERT INTO event_days_shah (event_id, venue_id, date, template_id) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (event_id, venue_id, date) DO UPDATE SET template_id = excluded.template_id RETURNING id`, eventId, venueId, date, templateId).Scan(&dayId)
+		if err != nil {
+			return nil, err
+		}
+		err = clearSeatMap(ctx, tx, dayId)
+		if err != nil {
+			return nil, err
+		}
+		err = insertSeatMap(ctx, tx, dayId, eventId, venueId, date, currency, seats)
+		if err != nil {
+			return nil, err
+		}
+		dayIds = append(dayIds, dayId)
+	}
+	return dayIds, nil
+}
 
-	for i, ticketType := range uniqueTypes {
+// clearSeatMap drops the seats and ticket types of an event day that never
+// sold a ticket.
+func clearSeatMap(ctx context.Context, tx pgx.Tx, dayId int) error {
+	var used bool
+	err := tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM tickets_shah t JOIN shah_seats s ON s.id = t.seat_id WHERE s.event_day_id = $1)`, dayId).Scan(&used)
+	if err != nil {
+		return err
+	}
+	if used {
+		return ErrSeatMapInUse
+	}
+	_, err = tx.Exec(ctx, `DELETE FROM shah_seats WHERE event_day_id = $1`, dayId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `DELETE FROM shah_ticket_types WHERE event_day_id = $1`, dayId)
+	return err
+}
+
+// insertSeatMap creates the seats of an event day. Ticket types are matched
+// by the ids the layout uses for them and stored once per day, every price
+// must be in the event currency.
+func insertSeatMap(ctx context.Context, tx pgx.Tx, dayId int, eventId, venueId *int, date *time.Time, currency string, seats [][]*Seat) error {
+	typeIds := make(map[int]int)
+	for _, ticketType := range GetUniqueTicketTypes(seats) {
+		if err := checkPrice(ticketType.Price, currency); err != nil {
+			return err
+		}
 		if ticketType.Amount == nil {
 			temp := 1
-			uniqueTypes[i].Amount = &temp
+			ticketType.Amount = &temp
 		}
-		err := tx.QueryRow(context.Background(), `INSERT INTO shah_ticket_types(id, name, price, amount) values (default, $1, $2, $3) returning id`, ticketType.Name, ticketType.Price, ticketType.Amount).Scan(&uniqueTypes[i].ID)
+		var id int
+		err := tx.QueryRow(ctx, `INSERT INTO shah_ticket_types(id, name, price, amount, max_tickets_per_user, event_day_id) values (default, $1, $2, $3, $4, $5) returning id`,
+			ticketType.Name, ticketType.Price.Amount, ticketType.Amount, ticketType.MaxTicketsPerUser, dayId).Scan(&id)
 		if err != nil {
 			return err
 		}
-	}
-
-	for _, uniqueType := range uniqueTypes {
-		for rowIndex, row := range seats {
-			for seatIndex, seat := range row {
-				for typeIndex, seatType := range seat.Types {
-					if seatType.Amount == nil {
-						seats[rowIndex][seatIndex].Types[typeIndex].Amount = uniqueType.Amount
-					}
-					if *uniqueType.Name == *seatType.Name && *uniqueType.Price == *seatType.Price && *uniqueType.Amount == *seatType.Amount {
-						seats[rowIndex][seatIndex].Types[typeIndex].ID = uniqueType.ID
-					}
-				}
-			}
-		}
+		typeIds[*ticketType.ID] = id
 	}
 
 	for _, row := range seats {
 		for _, seat := range row {
+			if seat == nil {
+				continue
+			}
+			var price *int64
+			if seat.Price != nil {
+				if err := checkPrice(seat.Price, currency); err != nil {
+					return err
+				}
+				price = &seat.Price.Amount
+			}
 			var id int
-			err := tx.QueryRow(context.Background(), `INSERT INTO shah_seats(id, venue_id, num, "left", top, price, bg_color, text_color) values (default, $1, $2, $3, $4, $5, $6, $7) returning id`, venueId, seat.Num, seat.Left, seat.Top, seat.Price, seat.BgColor, seat.TextColor).Scan(&id)
+			err := tx.QueryRow(ctx, `INSERT INTO shah_seats(id, venue_id, event_id, event_day_id, date, num, "left", top, price, bg_color, text_color) values (default, $1, $2, $3, $4, $5, $6, $7, $8, $9, $10) returning id`,
+				venueId, eventId, dayId, date, seat.Num, seat.Left, seat.Top, price, seat.BgColor, seat.TextColor).Scan(&id)
 			if err != nil {
 				return err
 			}
 
 			for _, stype := range seat.Types {
-				_, err = tx.Exec(context.Background(), `INSERT INTO shah_seat_ticket_types(seat_id, ticket_type_id) values ($1, $2)`, id, stype.ID)
+				if stype == nil || stype.ID == nil {
+					continue
+				}
+				typeId, ok := typeIds[*stype.ID]
+				if !ok {
+					continue
+				}
+				_, err = tx.Exec(ctx, `INSERT INTO shah_seat_ticket_types(seat_id, ticket_type_id) values ($1, $2) ON CONFLICT DO NOTHING`, id, typeId)
 				if err != nil {
 					return err
 				}
 			}
 		}
 	}
-	return tx.Commit(context.Background())
-
+	return nil
 }
 
 func GetUniqueTicketTypes(seats [][]*Seat) []TicketType {
@@ -298,7 +477,9 @@ func (r *TicketRepo) AddType(seatId, typeId *int) error {
 	return tx.Commit(context.Background())
 }
 
-func (r *TicketRepo) GetDatesForEventVenueShah(eventId, venueId *int) ([]*Seat, error) {
+// GetDatesForEventVenueShah returns the days of a seated event at a venue,
+// each with its own seats and availability.
+func (r *TicketRepo) GetDatesForEventVenueShah(eventId, venueId *int) ([]*DateWithSeatsShah, error) {
 
 	tx, err := r.DB.Begin(context.Background())
 	if err != nil {
@@ -306,20 +487,201 @@ func (r *TicketRepo) GetDatesForEventVenueShah(eventId, venueId *int) ([]*Seat,
 	}
 
 	defer tx.Rollback(context.Background())
-	rows, err := tx.Query(context.Background(), `SELECT id, venue_id, num, "left", top, price, bg_color, text_color, date FROM shah_seats WHERE venue_id = $1`, venueId)
+	rows, err := tx.Query(context.Background(), `SELECT id, event_id, venue_id, date, template_id FROM event_days_shah
+		WHERE event_id = $1 AND venue_id = $2 ORDER BY date`, eventId, venueId)
+	if err != nil {
+		return nil, err
+	}
+	dates := make([]*DateWithSeatsShah, 0)
+	for rows.Next() {
+		var d DateWithSeatsShah
+		err = rows.Scan(&d.ID, &d.EventId, &d.VenueId, &d.Date, &d.TemplateId)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		dates = append(dates, &d)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, d := range dates {
+		d.Seats, err = getSeatsForDay(context.Background(), tx, *d.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dates, nil
+}
+
+// GetSeatsForEventDay returns the seats of one seated event day.
+func (r *TicketRepo) GetSeatsForEventDay(dayId *int) ([]*Seat, error) {
+	tx, err := r.DB.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+	return getSeatsForDay(context.Background(), tx, *dayId)
+}
+
+func getSeatsForDay(ctx context.Context, tx pgx.Tx, dayId int) ([]*Seat, error) {
+	rows, err := tx.Query(ctx, `SELECT s.id, s.venue_id, s.event_day_id, s.num, s."left", s.top, s.price, e.currency, s.bg_color, s.text_color, s.date,
+       EXISTS(SELECT 1 FROM tickets_shah t WHERE t.seat_id = s.id AND NOT t.is_reserved AND t.refunded_at IS NULL),
+       EXISTS(SELECT 1 FROM tickets_shah t WHERE t.seat_id = s.id AND t.is_reserved)
+		FROM shah_seats s JOIN events e ON e.id = s.event_id WHERE s.event_day_id = $1 ORDER BY s.id`, dayId)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	dates := make([]*Seat, 0)
+	seats := make([]*Seat, 0)
+	seatsById := make(map[int]*Seat)
 	for rows.Next() {
 		var d Seat
-		err = rows.Scan(&d.Id, &d.VenueId, &d.Num, &d.Left, &d.Top, &d.Price, &d.BgColor, &d.TextColor, &d.Date)
+		var price *int64
+		var currency string
+		err = rows.Scan(&d.Id, &d.VenueId, &d.EventDayId, &d.Num, &d.Left, &d.Top, &price, &currency, &d.BgColor, &d.TextColor, &d.Date, &d.IsSold, &d.IsHeld)
+		if err != nil {
+			return nil, err
+		}
+		d.Price = moneyOrNil(price, currency)
+		d.Types = make([]*TicketType, 0)
+		seats = append(seats, &d)
+		seatsById[*d.Id] = &d
+	}
+	rows.Close()
+
+	rows, err = tx.Query(ctx, `SELECT st.seat_id, t.id, t.name, t.price, e.currency, t.amount, t.max_tickets_per_user
+		FROM shah_seat_ticket_types st
+		JOIN shah_ticket_types t ON t.id = st.ticket_type_id
+		JOIN shah_seats s ON s.id = st.seat_id
+		JOIN events e ON e.id = s.event_id
+		WHERE s.event_day_id = $1`, dayId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var seatId int
+		t := TicketType{Price: &Money{}}
+		err = rows.Scan(&seatId, &t.ID, &t.Name, &t.Price.Amount, &t.Price.Currency, &t.Amount, &t.MaxTicketsPerUser)
 		if err != nil {
 			return nil, err
 		}
+		if seat, ok := seatsById[seatId]; ok {
+			seat.Types = append(seat.Types, &t)
+		}
+	}
+	return seats, rows.Err()
+}
 
-		dates = append(dates, &d)
+type SeatPurchase struct {
+	SeatId       *int `json:"seatId"`
+	TicketTypeId *int `json:"ticketTypeId"`
+}
+
+type SeatPurchaseResult struct {
+	TicketIDs    []int
+	PurchaseTime time.Time
+}
+
+// reserveSeatsShah issues a ticket for every requested seat inside tx.
+// Seats issued for a hold stay reserved until the hold is converted. The
+// event has to be in one of statuses.
+func reserveSeatsShah(ctx context.Context, tx pgx.Tx, userId *int, seats []*SeatPurchase, holdId *int, statuses []string) (*SeatPurchaseResult, error) {
+	if len(seats) == 0 {
+		return nil, ErrInvalidTicketsCount
 	}
-	return dates, nil
+	seatIds := make([]int, 0, len(seats))
+	unique := make(map[int]bool)
+	for _, s := range seats {
+		if s == nil || s.SeatId == nil || s.TicketTypeId == nil || unique[*s.SeatId] {
+			return nil, ErrInvalidTicketsCount
+		}
+		unique[*s.SeatId] = true
+		seatIds = append(seatIds, *s.SeatId)
+	}
+
+	err := lockUserPurchases(ctx, tx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lock the seats in a stable order so concurrent purchases can't deadlock
+	var locked int
+	err = tx.QueryRow(ctx, `
+		SELECT count(*) FROM (
+			SELECT id FROM shah_seats WHERE id = ANY($1) ORDER BY id FOR UPDATE
+		) s
+	`, seatIds).Scan(&locked)
+	if err != nil {
+		return nil, err
+	}
+	if locked != len(seatIds) {
+		return nil, ErrSeatNotFound
+	}
+
+	var onSale bool
+	err = tx.QueryRow(ctx, `SELECT COALESCE(bool_and(e.status = ANY($2) AND e.deleted_at IS NULL), false)
+		FROM shah_seats s JOIN events e ON e.id = s.event_id WHERE s.id = ANY($1)`, seatIds, statuses).Scan(&onSale)
+	if err != nil {
+		return nil, err
+	}
+	if !onSale {
+		return nil, ErrEventNotOnSale
+	}
+
+	var sold, held bool
+	err = tx.QueryRow(ctx, `SELECT COALESCE(bool_or(NOT is_reserved), false), COALESCE(bool_or(is_reserved), false) FROM tickets_shah WHERE seat_id = ANY($1) AND refunded_at IS NULL`, seatIds).Scan(&sold, &held)
+	if err != nil {
+		return nil, err
+	}
+	if sold {
+		return nil, ErrSeatAlreadySold
+	}
+	if held {
+		return nil, ErrSeatHeld
+	}
+
+	var result SeatPurchaseResult
+	for _, s := range seats {
+		err = checkSeatTicketType(ctx, tx, s.SeatId, s.TicketTypeId)
+		if err != nil {
+			return nil, err
+		}
+		var id int
+		err = tx.QueryRow(ctx, `INSERT INTO tickets_shah (seat_id, ticket_type_id, user_id, is_reserved, hold_id) VALUES ($1, $2, $3, $4::int IS NOT NULL, $4) RETURNING id, purchase_time`, s.SeatId, s.TicketTypeId, userId, holdId).Scan(&id, &result.PurchaseTime)
+		if err != nil {
+			return nil, err
+		}
+		result.TicketIDs = append(result.TicketIDs, id)
+	}
+
+	err = checkLimitsShah(ctx, tx, userId, seatIds)
+	if err != nil {
+		return nil, err
+	}
+	state := SeatStateSold
+	if holdId != nil {
+		state = SeatStateHeld
+	}
+	err = notifySeats(ctx, tx, seatIds, state)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// checkSeatTicketType returns ErrSeatTypeMismatch when the seated ticket type
+// can't be sold for the seat.
+func checkSeatTicketType(ctx context.Context, tx pgx.Tx, seatId, ticketTypeId *int) error {
+	var allowed bool
+	err := tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM shah_seat_ticket_types WHERE seat_id = $1 AND ticket_type_id = $2)`, seatId, ticketTypeId).Scan(&allowed)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return ErrSeatTypeMismatch
+	}
+	return nil
 }
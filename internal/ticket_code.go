@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"rsc.io/qr"
+	"strconv"
+	"strings"
+)
+
+const (
+	TicketKindGA   = "ga"
+	TicketKindSeat = "seat"
+)
+
+const ticketCodeVersion = "1"
+
+var (
+	ErrTicketNotFound     = errors.New("ticket not found")
+	ErrInvalidTicketCode  = errors.New("invalid ticket code")
+	ErrInvalidTicketKind  = errors.New("invalid ticket kind")
+	ErrInvalidSigningSeed = errors.New("ticket signing seed must be 32 bytes")
+)
+
+// TicketCode identifies an issued ticket. The nonce is random per issue so a
+// code can be revoked by issuing the ticket again.
+type TicketCode struct {
+	Kind     string `json:"kind"`
+	TicketId int    `json:"ticketId"`
+	Nonce    string `json:"nonce"`
+}
+
+// TicketSigner signs ticket codes with Ed25519, door scanners only need the
+// public key to reject forged codes offline.
+type TicketSigner struct {
+	private ed25519.PrivateKey
+	Public  ed25519.PublicKey
+}
+
+// NewTicketSigner derives the key pair from a 32 byte seed, a nil seed
+// generates a new random key.
+func NewTicketSigner(seed []byte) (*TicketSigner, error) {
+	if seed == nil {
+		seed = make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, ErrInvalidSigningSeed
+	}
+	private := ed25519.NewKeyFromSeed(seed)
+	return &TicketSigner{private: private, Public: private.Public().(ed25519.PublicKey)}, nil
+}
+
+// Sign encodes the ticket as "<payload>.<signature>", both base64url without
+// padding. The payload is "1:<kind>:<ticket id>:<nonce>".
+func (s *TicketSigner) Sign(code *TicketCode) string {
+	payload := []byte(strings.Join([]string{ticketCodeVersion, code.Kind, strconv.Itoa(code.TicketId), code.Nonce}, ":"))
+	signature := ed25519.Sign(s.private, payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// VerifyTicketCode checks the signature of a code and decodes it. It doesn't
+// touch the database so it can run on scanners without a connection.
+func VerifyTicketCode(public ed25519.PublicKey, code string) (*TicketCode, error) {
+	encodedPayload, encodedSignature, ok := strings.Cut(code, ".")
+	if !ok {
+		return nil, ErrInvalidTicketCode
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, ErrInvalidTicketCode
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil || !ed25519.Verify(public, payload, signature) {
+		return nil, ErrInvalidTicketCode
+	}
+	parts := strings.Split(string(payload), ":")
+	if len(parts) != 4 || parts[0] != ticketCodeVersion {
+		return nil, ErrInvalidTicketCode
+	}
+	id, err := strconv.Atoi(parts[2])
+	if err != nil || (parts[1] != TicketKindGA && parts[1] != TicketKindSeat) {
+		return nil, ErrInvalidTicketCode
+	}
+	return &TicketCode{Kind: parts[1], TicketId: id, Nonce: parts[3]}, nil
+}
+
+// TicketTable returns the table tickets of the given kind are stored in.
+func TicketTable(kind string) (string, error) {
+	switch kind {
+	case TicketKindGA:
+		return "tickets_no_shah", nil
+	case TicketKindSeat:
+		return "tickets_shah", nil
+	}
+	return "", ErrInvalidTicketKind
+}
+
+// GetTicketCode returns the code of an issued, not refunded ticket owned by
+// the user.
+func (r *TicketRepo) GetTicketCode(kind string, ticketId, userId *int) (*TicketCode, error) {
+	table, err := TicketTable(kind)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := r.DB.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+	code := TicketCode{Kind: kind}
+	err = tx.QueryRow(context.Background(), `SELECT id, code_nonce::text FROM `+table+`
+		WHERE id = $1 AND user_id = $2 AND NOT is_reserved AND refunded_at IS NULL`, ticketId, userId).Scan(&code.TicketId, &code.Nonce)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrTicketNotFound
+		}
+		return nil, err
+	}
+	err = tx.Commit(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &code, nil
+}
+
+func TicketQRPNG(code string) ([]byte, error) {
+	c, err := qr.Encode(code, qr.M)
+	if err != nil {
+		return nil, err
+	}
+	return c.PNG(), nil
+}
+
+func TicketQRSVG(code string) ([]byte, error) {
+	c, err := qr.Encode(code, qr.M)
+	if err != nil {
+		return nil, err
+	}
+	// Keep the 4 module quiet zone the PNG has
+	const quiet = 4
+	size := c.Size + 2*quiet
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, size, size)
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.Black(x, y) {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x+quiet, y+quiet)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,213 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/go-pdf/fpdf"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"strconv"
+	"time"
+)
+
+// PrintableTicket is everything printed on an e-ticket.
+type PrintableTicket struct {
+	Kind           string     `json:"kind"`
+	TicketId       int        `json:"ticketId"`
+	Nonce          string     `json:"-"`
+	EventTitle     *string    `json:"eventTitle"`
+	VenueName      *string    `json:"venueName"`
+	VenueLocation  *string    `json:"venueLocation"`
+	Date           *time.Time `json:"date"`
+	TicketTypeName *string    `json:"ticketTypeName"`
+	Price          *Money     `json:"price"`
+	SeatNum        *int       `json:"seatNum"`
+	HolderName     *string    `json:"holderName"`
+}
+
+// GetPrintableTicket returns a single issued ticket owned by the user.
+func (r *TicketRepo) GetPrintableTicket(kind string, ticketId, userId *int) (*PrintableTicket, error) {
+	if _, err := TicketTable(kind); err != nil {
+		return nil, err
+	}
+	tickets, err := r.getPrintableTickets(kind, userId, nil, ticketId)
+	if err != nil {
+		return nil, err
+	}
+	if len(tickets) == 0 {
+		return nil, ErrTicketNotFound
+	}
+	return tickets[0], nil
+}
+
+// GetPrintableOrderTickets returns every issued, not refunded ticket of an
+// order owned by the user.
+func (r *TicketRepo) GetPrintableOrderTickets(orderId, userId *int) ([]*PrintableTicket, error) {
+	tickets, err := r.getPrintableTickets("", userId, orderId, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(tickets) == 0 {
+		return nil, ErrTicketNotFound
+	}
+	return tickets, nil
+}
+
+// getPrintableTickets loads tickets of the given kind, both kinds when kind is
+// empty, optionally narrowed to an order or a single ticket.
+func (r *TicketRepo) getPrintableTickets(kind string, userId, orderId, ticketId *int) ([]*PrintableTicket, error) {
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	tickets := make([]*PrintableTicket, 0)
+	if kind == "" || kind == TicketKindGA {
+		rows, err := tx.Query(ctx, `SELECT t.id, t.code_nonce::text, e.title, v.name, v.location, d.date, tt.name,
+			       COALESCE(i.unit_price - i.unit_discount, tt.price), e.currency, NULLIF(concat_ws(' ', a.surname, a.name, a.patronymic), '')
+			FROM tickets_no_shah t
+			JOIN ticket_types_no_shah tt ON tt.id = t.ticket_type_id
+			JOIN event_days_no_shah d ON d.id = tt.event_day_id
+			JOIN events e ON e.id = d.event_id
+			LEFT JOIN venues v ON v.id = d.venue_id
+			LEFT JOIN order_items i ON i.id = t.order_item_id
+			LEFT JOIN additional_user_data a ON a.user_id = t.user_id
+			WHERE t.user_id = $1 AND NOT t.is_reserved AND t.refunded_at IS NULL
+			  AND ($2::int IS NULL OR i.order_id = $2) AND ($3::int IS NULL OR t.id = $3)
+			ORDER BY d.date, t.id`, userId, orderId, ticketId)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			t := PrintableTicket{Kind: TicketKindGA, Price: &Money{}}
+			err = rows.Scan(&t.TicketId, &t.Nonce, &t.EventTitle, &t.VenueName, &t.VenueLocation, &t.Date, &t.TicketTypeName, &t.Price.Amount, &t.Price.Currency, &t.HolderName)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			tickets = append(tickets, &t)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if kind == "" || kind == TicketKindSeat {
+		rows, err := tx.Query(ctx, `SELECT t.id, t.code_nonce::text, e.title, v.name, v.location, s.date, tt.name,
+			       COALESCE(i.unit_price - i.unit_discount, tt.price), e.currency, s.num, NULLIF(concat_ws(' ', a.surname, a.name, a.patronymic), '')
+			FROM tickets_shah t
+			JOIN shah_seats s ON s.id = t.seat_id
+			JOIN shah_ticket_types tt ON tt.id = t.ticket_type_id
+			JOIN events e ON e.id = s.event_id
+			LEFT JOIN venues v ON v.id = s.venue_id
+			LEFT JOIN order_items i ON i.id = t.order_item_id
+			LEFT JOIN additional_user_data a ON a.user_id = t.user_id
+			WHERE t.user_id = $1 AND NOT t.is_reserved AND t.refunded_at IS NULL
+			  AND ($2::int IS NULL OR i.order_id = $2) AND ($3::int IS NULL OR t.id = $3)
+			ORDER BY s.date, s.num, t.id`, userId, orderId, ticketId)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			t := PrintableTicket{Kind: TicketKindSeat, Price: &Money{}}
+			err = rows.Scan(&t.TicketId, &t.Nonce, &t.EventTitle, &t.VenueName, &t.VenueLocation, &t.Date, &t.TicketTypeName, &t.Price.Amount, &t.Price.Currency, &t.SeatNum, &t.HolderName)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			tickets = append(tickets, &t)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tickets, nil
+}
+
+// TicketsPDF renders one A5 page per ticket with its signed QR code.
+func TicketsPDF(tickets []*PrintableTicket, signer *TicketSigner) ([]byte, error) {
+	pdf := fpdf.New("P", "mm", "A5", "")
+	// The core PDF fonts have no Cyrillic, the Go fonts do
+	pdf.AddUTF8FontFromBytes("go", "", goregular.TTF)
+	pdf.AddUTF8FontFromBytes("go", "B", gobold.TTF)
+	pdf.SetMargins(12, 12, 12)
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.SetTitle("Tickets", true)
+
+	width, _ := pdf.GetPageSize()
+	contentWidth := width - 24
+	for _, t := range tickets {
+		code := signer.Sign(&TicketCode{Kind: t.Kind, TicketId: t.TicketId, Nonce: t.Nonce})
+		png, err := TicketQRPNG(code)
+		if err != nil {
+			return nil, err
+		}
+
+		pdf.AddPage()
+		pdf.SetFont("go", "B", 18)
+		pdf.MultiCell(contentWidth, 8, stringOr(t.EventTitle, ""), "", "L", false)
+		pdf.Ln(4)
+
+		ticketField(pdf, "Площадка", venueLine(t))
+		if t.Date != nil {
+			ticketField(pdf, "Дата", t.Date.Format("02.01.2006 15:04"))
+		}
+		ticketField(pdf, "Билет", stringOr(t.TicketTypeName, ""))
+		if t.SeatNum != nil {
+			ticketField(pdf, "Место", strconv.Itoa(*t.SeatNum))
+		}
+		if t.Price != nil {
+			ticketField(pdf, "Цена", t.Price.String())
+		}
+		ticketField(pdf, "Владелец", stringOr(t.HolderName, "—"))
+		ticketField(pdf, "Номер", fmt.Sprintf("%s-%d", t.Kind, t.TicketId))
+
+		name := fmt.Sprintf("qr-%s-%d", t.Kind, t.TicketId)
+		options := fpdf.ImageOptions{ImageType: "PNG"}
+		pdf.RegisterImageOptionsReader(name, options, bytes.NewReader(png))
+		const qrSize = 70
+		pdf.ImageOptions(name, (width-qrSize)/2, pdf.GetY()+6, qrSize, qrSize, false, options, 0, "")
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func ticketField(pdf *fpdf.Fpdf, label, value string) {
+	pdf.SetFont("go", "", 9)
+	pdf.SetTextColor(110, 110, 110)
+	pdf.CellFormat(0, 5, label, "", 1, "L", false, 0, "")
+	pdf.SetFont("go", "", 12)
+	pdf.SetTextColor(0, 0, 0)
+	pdf.MultiCell(0, 6, value, "", "L", false)
+	pdf.Ln(1)
+}
+
+func venueLine(t *PrintableTicket) string {
+	venue := stringOr(t.VenueName, "")
+	if t.VenueLocation != nil && *t.VenueLocation != "" {
+		if venue != "" {
+			venue += ", "
+		}
+		venue += *t.VenueLocation
+	}
+	return venue
+}
+
+func stringOr(s *string, fallback string) string {
+	if s == nil {
+		return fallback
+	}
+	return *s
+}
@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// DefaultTransferCutoff applies to events without transfer_cutoff_hours.
+const DefaultTransferCutoff = 2 * time.Hour
+
+var (
+	ErrRecipientNotFound  = errors.New("recipient not found")
+	ErrTransferToSelf     = errors.New("can't transfer a ticket to yourself")
+	ErrTicketCheckedIn    = errors.New("ticket is already checked in")
+	ErrTransferCutoffPast = errors.New("transfers are closed for this event")
+	ErrRecipientRequired  = errors.New("recipient email or phone is required")
+)
+
+type TransferRepo struct {
+	DB *pgxpool.Pool
+}
+
+// TicketTransferRequest moves a ticket of the given kind to the user
+// registered with Email or Phone.
+type TicketTransferRequest struct {
+	Kind       string  `json:"kind"`
+	TicketId   *int    `json:"ticketId"`
+	Email      *string `json:"email"`
+	Phone      *string `json:"phone"`
+	FromUserId *int    `json:"-"`
+}
+
+type TicketTransfer struct {
+	Id           *int       `json:"id"`
+	TicketId     *int       `json:"ticketId"`
+	SeatTicketId *int       `json:"seatTicketId"`
+	FromUserId   *int       `json:"fromUserId"`
+	ToUserId     *int       `json:"toUserId"`
+	CreatedAt    *time.Time `json:"createdAt"`
+}
+
+// TransferTicket hands a ticket over to another user and issues it again, so
+// the code the previous owner holds stops working at the door. Checked in
+// tickets and tickets within the cutoff before the event can't be moved.
+func (r *TransferRepo) TransferTicket(req *TicketTransferRequest, defaultCutoff time.Duration) (*TicketTransfer, error) {
+	if (req.Email == nil || *req.Email == "") && (req.Phone == nil || *req.Phone == "") {
+		return nil, ErrRecipientRequired
+	}
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var toUserId int
+	err = tx.QueryRow(ctx, `SELECT id FROM users WHERE ($1::text IS NOT NULL AND email = $1) OR ($2::text IS NOT NULL AND phone = $2)
+		ORDER BY id LIMIT 1`, req.Email, req.Phone).Scan(&toUserId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrRecipientNotFound
+		}
+		return nil, err
+	}
+	if toUserId == *req.FromUserId {
+		return nil, ErrTransferToSelf
+	}
+
+	var query, checkInColumn string
+	switch req.Kind {
+	case TicketKindGA:
+		checkInColumn = "ticket_id"
+		query = `SELECT d.date, e.transfer_cutoff_hours
+			FROM tickets_no_shah t
+			JOIN ticket_types_no_shah tt ON tt.id = t.ticket_type_id
+			JOIN event_days_no_shah d ON d.id = tt.event_day_id
+			JOIN events e ON e.id = d.event_id
+			WHERE t.id = $1 AND t.user_id = $2 AND NOT t.is_reserved AND t.refunded_at IS NULL
+			FOR UPDATE OF t`
+	case TicketKindSeat:
+		checkInColumn = "seat_ticket_id"
+		query = `SELECT COALESCE(s.date::timestamptz, e.start_time::timestamptz), e.transfer_cutoff_hours
+			FROM tickets_shah t
+			JOIN shah_seats s ON s.id = t.seat_id
+			JOIN events e ON e.id = s.event_id
+			WHERE t.id = $1 AND t.user_id = $2 AND NOT t.is_reserved AND t.refunded_at IS NULL
+			FOR UPDATE OF t`
+	default:
+		return nil, ErrInvalidTicketKind
+	}
+	var date *time.Time
+	var cutoffHours *int
+	err = tx.QueryRow(ctx, query, req.TicketId, req.FromUserId).Scan(&date, &cutoffHours)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrTicketNotFound
+		}
+		return nil, err
+	}
+
+	var checkedIn bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM check_ins WHERE `+checkInColumn+` = $1)`, req.TicketId).Scan(&checkedIn)
+	if err != nil {
+		return nil, err
+	}
+	if checkedIn {
+		return nil, ErrTicketCheckedIn
+	}
+
+	cutoff := defaultCutoff
+	if cutoffHours != nil {
+		cutoff = time.Duration(*cutoffHours) * time.Hour
+	}
+	if date != nil && time.Now().Add(cutoff).After(*date) {
+		return nil, ErrTransferCutoffPast
+	}
+
+	table, _ := TicketTable(req.Kind)
+	_, err = tx.Exec(ctx, `UPDATE `+table+` SET user_id = $1, code_nonce = gen_random_uuid() WHERE id = $2`, toUserId, req.TicketId)
+	if err != nil {
+		return nil, err
+	}
+
+	transfer := TicketTransfer{FromUserId: req.FromUserId, ToUserId: &toUserId}
+	if req.Kind == TicketKindGA {
+		transfer.TicketId = req.TicketId
+	} else {
+		transfer.SeatTicketId = req.TicketId
+	}
+	err = tx.QueryRow(ctx, `INSERT INTO ticket_transfers (ticket_id, seat_ticket_id, from_user_id, to_user_id)
+		VALUES ($1, $2, $3, $4) RETURNING id, created_at`,
+		transfer.TicketId, transfer.SeatTicketId, transfer.FromUserId, transfer.ToUserId).Scan(&transfer.Id, &transfer.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return &transfer, nil
+}
+
+// GetTransfersByUser lists transfers the user sent or received, newest first.
+func (r *TransferRepo) GetTransfersByUser(userId *int) ([]*TicketTransfer, error) {
+	tx, err := r.DB.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+	rows, err := tx.Query(context.Background(), `SELECT id, ticket_id, seat_ticket_id, from_user_id, to_user_id, created_at
+		FROM ticket_transfers WHERE from_user_id = $1 OR to_user_id = $1 ORDER BY id DESC`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	transfers := make([]*TicketTransfer, 0)
+	for rows.Next() {
+		var t TicketTransfer
+		err = rows.Scan(&t.Id, &t.TicketId, &t.SeatTicketId, &t.FromUserId, &t.ToUserId, &t.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, &t)
+	}
+	err = tx.Commit(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return transfers, nil
+}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"context"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -21,8 +22,7 @@ func (m *VenueRepo) CreateVenue(venue *Venue) (*int, error) {
 		return nil, err
 	}
 	defer tx.Rollback(context.Background())
-	stmt := `INSERT INTO venues (id, name, location) VALUES (default, $1, $2) RETURNING id`
-	err = tx.QueryRow(context.Background(), stmt, venue.Name, venue.Location).Scan(&venue.ID)
+	err = insertVenue(context.Background(), tx, venue)
 	if err != nil {
 		return nil, err
 	}
@@ -33,6 +33,11 @@ func (m *VenueRepo) CreateVenue(venue *Venue) (*int, error) {
 	return venue.ID, nil
 }
 
+func insertVenue(ctx context.Context, tx pgx.Tx, venue *Venue) error {
+	stmt := `INSERT INTO venues (id, name, location) VALUES (default, $1, $2) RETURNING id`
+	return tx.QueryRow(ctx, stmt, venue.Name, venue.Location).Scan(&venue.ID)
+}
+
 func (m *VenueRepo) GetVenuesByEvent(eventId *int) ([]*Venue, error) {
 	tx, err := m.DB.Begin(context.Background())
 	if err != nil {
@@ -0,0 +1,429 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+// WaitlistOfferTTL is how long an offered user has to buy the inventory
+// reserved for them before it moves on to the next in line.
+const WaitlistOfferTTL = 30 * time.Minute
+
+const (
+	WaitlistStatusWaiting   = "waiting"
+	WaitlistStatusOffered   = "offered"
+	WaitlistStatusFulfilled = "fulfilled"
+	WaitlistStatusExpired   = "expired"
+	WaitlistStatusCancelled = "cancelled"
+)
+
+var (
+	ErrWaitlistTarget        = errors.New("waitlist needs exactly one of ticketTypeId and seatedEventDayId")
+	ErrTicketsStillAvailable = errors.New("tickets are still available")
+	ErrAlreadyWaitlisted     = errors.New("already on the waitlist")
+	ErrWaitlistEntryNotFound = errors.New("waitlist entry not found")
+	ErrEventDayNotFound      = errors.New("event day not found")
+)
+
+type WaitlistRepo struct {
+	DB *pgxpool.Pool
+}
+
+// WaitlistEntry is a place in line for a GA ticket type or for any seat of a
+// seated event day. An offered entry has a hold with the inventory reserved for
+// the user, it is bought by confirming that hold.
+type WaitlistEntry struct {
+	Id               *int       `json:"id"`
+	UserId           *int       `json:"userId"`
+	TicketTypeId     *int       `json:"ticketTypeId"`
+	EventId          *int       `json:"eventId"`
+	SeatedEventDayId *int       `json:"seatedEventDayId"`
+	Quantity         *int       `json:"quantity"`
+	Status           *string    `json:"status"`
+	HoldId           *int       `json:"holdId"`
+	CreatedAt        *time.Time `json:"createdAt"`
+	OfferedAt        *time.Time `json:"offeredAt"`
+	OfferExpiresAt   *time.Time `json:"offerExpiresAt"`
+	Position         *int       `json:"position"`
+}
+
+// JoinWaitlist puts the user in line once the target is sold out. Seated
+// entries wait for a single seat.
+func (r *WaitlistRepo) JoinWaitlist(userId, ticketTypeId, seatedEventDayId *int, quantity int) (*WaitlistEntry, error) {
+	if (ticketTypeId == nil) == (seatedEventDayId == nil) {
+		return nil, ErrWaitlistTarget
+	}
+	if seatedEventDayId != nil {
+		quantity = 1
+	}
+	if quantity <= 0 {
+		return nil, ErrInvalidTicketsCount
+	}
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var available bool
+	var eventId *int
+	if ticketTypeId != nil {
+		var remaining int
+		err = tx.QueryRow(ctx, `SELECT amount - sold_count FROM ticket_types_no_shah WHERE id = $1 FOR UPDATE`, ticketTypeId).Scan(&remaining)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil, ErrTicketTypeNotFound
+			}
+			return nil, err
+		}
+		available = remaining >= quantity
+	} else {
+		err = tx.QueryRow(ctx, `SELECT d.event_id, EXISTS(SELECT 1 FROM shah_seats s WHERE s.event_day_id = d.id
+			AND NOT EXISTS(SELECT 1 FROM tickets_shah t WHERE t.seat_id = s.id AND t.refunded_at IS NULL))
+			FROM event_days_shah d WHERE d.id = $1`, seatedEventDayId).Scan(&eventId, &available)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil, ErrEventDayNotFound
+			}
+			return nil, err
+		}
+	}
+	if available {
+		return nil, ErrTicketsStillAvailable
+	}
+
+	e := WaitlistEntry{UserId: userId, TicketTypeId: ticketTypeId, EventId: eventId, SeatedEventDayId: seatedEventDayId, Quantity: &quantity}
+	err = tx.QueryRow(ctx, `INSERT INTO waitlist_entries (user_id, ticket_type_id, event_id, seat_event_day_id, quantity)
+		VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING RETURNING id, status, created_at`,
+		userId, ticketTypeId, eventId, seatedEventDayId, quantity).Scan(&e.Id, &e.Status, &e.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrAlreadyWaitlisted
+		}
+		return nil, err
+	}
+	err = tx.QueryRow(ctx, `SELECT count(*) FROM waitlist_entries WHERE status = $1 AND id <= $2
+		AND ticket_type_id IS NOT DISTINCT FROM $3 AND seat_event_day_id IS NOT DISTINCT FROM $4`,
+		WaitlistStatusWaiting, e.Id, ticketTypeId, seatedEventDayId).Scan(&e.Position)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// LeaveWaitlist cancels an entry, an offer the user still had goes to the
+// next in line.
+func (r *WaitlistRepo) LeaveWaitlist(entryId, userId *int) error {
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var status string
+	var holdId *int
+	err = tx.QueryRow(ctx, `SELECT status, hold_id FROM waitlist_entries WHERE id = $1 AND user_id = $2 FOR UPDATE`, entryId, userId).Scan(&status, &holdId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrWaitlistEntryNotFound
+		}
+		return err
+	}
+	switch status {
+	case WaitlistStatusWaiting:
+	case WaitlistStatusOffered:
+		var holdStatus string
+		err = tx.QueryRow(ctx, `SELECT status FROM holds WHERE id = $1 FOR UPDATE`, holdId).Scan(&holdStatus)
+		if err != nil {
+			return err
+		}
+		if holdStatus == HoldStatusActive {
+			err = releaseHold(ctx, tx, holdId, HoldStatusReleased)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return ErrWaitlistEntryNotFound
+	}
+	_, err = tx.Exec(ctx, `UPDATE waitlist_entries SET status = $1 WHERE id = $2`, WaitlistStatusCancelled, entryId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (r *WaitlistRepo) GetWaitlistByUser(userId *int) ([]*WaitlistEntry, error) {
+	tx, err := r.DB.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+	rows, err := tx.Query(context.Background(), `SELECT w.id, w.user_id, w.ticket_type_id, w.event_id, w.seat_event_day_id, w.quantity, w.status, w.hold_id,
+			w.created_at, w.offered_at, h.expires_at,
+			CASE WHEN w.status = $2 THEN (SELECT count(*) FROM waitlist_entries a WHERE a.status = $2 AND a.id <= w.id
+				AND a.ticket_type_id IS NOT DISTINCT FROM w.ticket_type_id AND a.seat_event_day_id IS NOT DISTINCT FROM w.seat_event_day_id) END
+		FROM waitlist_entries w
+		LEFT JOIN holds h ON h.id = w.hold_id
+		WHERE w.user_id = $1 ORDER BY w.id DESC`, userId, WaitlistStatusWaiting)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]*WaitlistEntry, 0)
+	for rows.Next() {
+		var e WaitlistEntry
+		err = rows.Scan(&e.Id, &e.UserId, &e.TicketTypeId, &e.EventId, &e.SeatedEventDayId, &e.Quantity, &e.Status, &e.HoldId,
+			&e.CreatedAt, &e.OfferedAt, &e.OfferExpiresAt, &e.Position)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &e)
+	}
+	err = tx.Commit(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// offerWaitlist hands inventory that just became free to the waitlist of the
+// GA ticket types and seats, first come first served.
+func offerWaitlist(ctx context.Context, tx pgx.Tx, ticketTypeIds, seatIds []int) error {
+	for _, id := range ticketTypeIds {
+		err := offerTicketType(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+	}
+	for _, id := range seatIds {
+		err := offerSeat(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type waitlistCandidate struct {
+	id, userId, quantity int
+}
+
+func nextWaiting(ctx context.Context, tx pgx.Tx, column string, target int) (*waitlistCandidate, error) {
+	var c waitlistCandidate
+	err := tx.QueryRow(ctx, `SELECT id, user_id, quantity FROM waitlist_entries WHERE `+column+` = $1 AND status = $2
+		ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED`, target, WaitlistStatusWaiting).Scan(&c.id, &c.userId, &c.quantity)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &c, nil
+}
+
+func offerTicketType(ctx context.Context, tx pgx.Tx, ticketTypeId int) error {
+	// Freed tickets of an event off sale stay put until SetEventStatus puts
+	// it on sale again
+	var eventId int
+	err := tx.QueryRow(ctx, `SELECT d.event_id FROM ticket_types_no_shah tt
+		JOIN event_days_no_shah d ON d.id = tt.event_day_id WHERE tt.id = $1`, ticketTypeId).Scan(&eventId)
+	if err != nil {
+		return err
+	}
+	onSale, err := eventInStatus(ctx, tx, eventId, offerableEventStatuses)
+	if err != nil || !onSale {
+		return err
+	}
+	for {
+		var remaining int
+		err := tx.QueryRow(ctx, `SELECT amount - sold_count FROM ticket_types_no_shah WHERE id = $1 FOR UPDATE`, ticketTypeId).Scan(&remaining)
+		if err != nil {
+			return err
+		}
+		c, err := nextWaiting(ctx, tx, "ticket_type_id", ticketTypeId)
+		if err != nil || c == nil {
+			return err
+		}
+		// Nobody skips the line, the first entry waits until enough is free
+		if c.quantity > remaining {
+			return nil
+		}
+		locked, err := offerEntry(ctx, tx, c, func(sp pgx.Tx, holdId *int) error {
+			_, err := reserveTicketsNoShah(ctx, sp, &ticketTypeId, &c.userId, c.quantity, holdId, offerableEventStatuses)
+			return err
+		})
+		if err != nil || !locked {
+			return err
+		}
+	}
+}
+
+func offerSeat(ctx context.Context, tx pgx.Tx, seatId int) error {
+	var eventId, dayId *int
+	var free bool
+	err := tx.QueryRow(ctx, `SELECT event_id, event_day_id, NOT EXISTS(SELECT 1 FROM tickets_shah t WHERE t.seat_id = s.id AND t.refunded_at IS NULL)
+		FROM shah_seats s WHERE id = $1 FOR UPDATE`, seatId).Scan(&eventId, &dayId, &free)
+	if err != nil {
+		return err
+	}
+	if eventId == nil || dayId == nil || !free {
+		return nil
+	}
+	onSale, err := eventInStatus(ctx, tx, *eventId, offerableEventStatuses)
+	if err != nil || !onSale {
+		return err
+	}
+	// The seat is offered at its cheapest ticket type
+	var ticketTypeId int
+	err = tx.QueryRow(ctx, `SELECT t.id FROM shah_seat_ticket_types st JOIN shah_ticket_types t ON t.id = st.ticket_type_id
+		WHERE st.seat_id = $1 ORDER BY t.price, t.id LIMIT 1`, seatId).Scan(&ticketTypeId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	for {
+		c, err := nextWaiting(ctx, tx, "seat_event_day_id", *dayId)
+		if err != nil || c == nil {
+			return err
+		}
+		offered := false
+		locked, err := offerEntry(ctx, tx, c, func(sp pgx.Tx, holdId *int) error {
+			_, err := reserveSeatsShah(ctx, sp, &c.userId, []*SeatPurchase{{SeatId: &seatId, TicketTypeId: &ticketTypeId}}, holdId, offerableEventStatuses)
+			offered = err == nil
+			return err
+		})
+		if err != nil || !locked || offered {
+			return err
+		}
+	}
+}
+
+// offerEntry reserves inventory for a waiting entry under a new hold. When
+// the user can't take it, for example over the purchase limit, the entry is
+// dropped and the caller moves on to the next one.
+//
+// The caller already holds inventory row locks, so waiting for the user's
+// purchase lock could deadlock with a purchase of that user. A user busy
+// purchasing keeps their place, offerEntry reports false and the caller
+// stops, OfferWaitlists picks the inventory up later.
+func offerEntry(ctx context.Context, tx pgx.Tx, c *waitlistCandidate, reserve func(sp pgx.Tx, holdId *int) error) (bool, error) {
+	locked, err := tryLockUserPurchases(ctx, tx, &c.userId)
+	if err != nil || !locked {
+		return false, err
+	}
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer sp.Rollback(ctx)
+
+	hold, err := insertHold(ctx, sp, &c.userId, nil, WaitlistOfferTTL)
+	if err != nil {
+		return false, err
+	}
+	err = reserve(sp, hold.Id)
+	if errors.Is(err, ErrPurchaseLimitExceeded) {
+		err = sp.Rollback(ctx)
+		if err != nil {
+			return false, err
+		}
+		_, err = tx.Exec(ctx, `UPDATE waitlist_entries SET status = $1 WHERE id = $2`, WaitlistStatusCancelled, c.id)
+		return true, err
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := sp.Commit(ctx); err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(ctx, `UPDATE waitlist_entries SET status = $1, hold_id = $2, offered_at = now() WHERE id = $3`,
+		WaitlistStatusOffered, hold.Id, c.id)
+	return true, err
+}
+
+// OfferWaitlists offers free inventory that still has people waiting for it,
+// left over when an offer found the user busy purchasing.
+func (r *WaitlistRepo) OfferWaitlists() error {
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `SELECT tt.id FROM ticket_types_no_shah tt
+		WHERE tt.amount > tt.sold_count
+		AND EXISTS(SELECT 1 FROM waitlist_entries w WHERE w.ticket_type_id = tt.id AND w.status = $1)
+		ORDER BY tt.id`, WaitlistStatusWaiting)
+	if err != nil {
+		return err
+	}
+	ticketTypeIds, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return err
+	}
+	rows, err = tx.Query(ctx, `SELECT s.id FROM shah_seats s
+		WHERE EXISTS(SELECT 1 FROM waitlist_entries w WHERE w.seat_event_day_id = s.event_day_id AND w.status = $1)
+		AND NOT EXISTS(SELECT 1 FROM tickets_shah t WHERE t.seat_id = s.id AND t.refunded_at IS NULL)
+		ORDER BY s.id`, WaitlistStatusWaiting)
+	if err != nil {
+		return err
+	}
+	seatIds, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return err
+	}
+	err = offerWaitlist(ctx, tx, ticketTypeIds, seatIds)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// SetTicketTypeAmount changes the capacity of a GA ticket type. Added
+// capacity goes to the waitlist first.
+func (r *TicketRepo) SetTicketTypeAmount(ticketTypeId *int, amount int) error {
+	ctx := context.Background()
+	tx, err := r.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var sold int
+	err = tx.QueryRow(ctx, `SELECT sold_count FROM ticket_types_no_shah WHERE id = $1 FOR UPDATE`, ticketTypeId).Scan(&sold)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrTicketTypeNotFound
+		}
+		return err
+	}
+	if amount < sold {
+		return ErrInvalidTicketsCount
+	}
+	_, err = tx.Exec(ctx, `UPDATE ticket_types_no_shah SET amount = $1, version = version + 1 WHERE id = $2`, amount, ticketTypeId)
+	if err != nil {
+		return err
+	}
+	err = notifyTicketTypes(ctx, tx, []int{*ticketTypeId})
+	if err != nil {
+		return err
+	}
+	err = offerTicketType(ctx, tx, *ticketTypeId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
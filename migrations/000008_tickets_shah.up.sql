@@ -0,0 +1,10 @@
+CREATE TABLE tickets_shah (
+                         id SERIAL PRIMARY KEY,
+                         seat_id INT NOT NULL REFERENCES shah_seats(id),
+                         ticket_type_id INT NOT NULL REFERENCES shah_ticket_types(id),
+                         purchase_time TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+                         user_id INT REFERENCES users(id)
+);
+
+-- A seat can be sold only once
+CREATE UNIQUE INDEX tickets_shah_seat_id_key ON tickets_shah(seat_id);
@@ -0,0 +1,15 @@
+CREATE TABLE holds (
+                       id SERIAL PRIMARY KEY,
+                       user_id INT NOT NULL REFERENCES users(id),
+                       session_token TEXT, -- Session the hold was made from, only it can convert or release the hold
+                       status VARCHAR(16) NOT NULL DEFAULT 'active', -- active, converted, released, expired
+                       created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+                       expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX holds_active_expires_at_idx ON holds(expires_at) WHERE status = 'active';
+
+ALTER TABLE tickets_no_shah ADD COLUMN hold_id INT REFERENCES holds(id);
+
+ALTER TABLE tickets_shah ADD COLUMN is_reserved BOOLEAN DEFAULT FALSE;
+ALTER TABLE tickets_shah ADD COLUMN hold_id INT REFERENCES holds(id);
@@ -0,0 +1,32 @@
+ALTER TABLE shah_seats ADD COLUMN event_id INT REFERENCES events(id);
+
+CREATE TABLE orders (
+                        id SERIAL PRIMARY KEY,
+                        user_id INT NOT NULL REFERENCES users(id),
+                        event_id INT NOT NULL REFERENCES events(id),
+                        hold_id INT REFERENCES holds(id), -- Inventory reserved while the order is pending
+                        status VARCHAR(16) NOT NULL DEFAULT 'pending', -- pending, paid, cancelled, refunded
+                        total DECIMAL(10, 2) NOT NULL DEFAULT 0,
+                        created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+                        updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX orders_user_id_idx ON orders(user_id);
+CREATE INDEX orders_hold_id_idx ON orders(hold_id);
+
+CREATE TABLE order_items (
+                             id SERIAL PRIMARY KEY,
+                             order_id INT NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+                             ticket_type_id INT REFERENCES ticket_types_no_shah(id), -- Set for general admission items
+                             seat_id INT REFERENCES shah_seats(id), -- Set for seated items
+                             shah_ticket_type_id INT REFERENCES shah_ticket_types(id),
+                             name VARCHAR(255),
+                             quantity INT NOT NULL,
+                             unit_price DECIMAL(10, 2) NOT NULL,
+                             total DECIMAL(10, 2) NOT NULL
+);
+
+CREATE INDEX order_items_order_id_idx ON order_items(order_id);
+
+ALTER TABLE tickets_no_shah ADD COLUMN order_item_id INT REFERENCES order_items(id);
+ALTER TABLE tickets_shah ADD COLUMN order_item_id INT REFERENCES order_items(id);
@@ -0,0 +1,13 @@
+CREATE TABLE payments (
+                          id SERIAL PRIMARY KEY,
+                          order_id INT NOT NULL REFERENCES orders(id),
+                          provider VARCHAR(32) NOT NULL,
+                          intent_id VARCHAR(255) NOT NULL,
+                          amount DECIMAL(10, 2) NOT NULL,
+                          status VARCHAR(16) NOT NULL DEFAULT 'pending', -- pending, succeeded, failed, refunded
+                          created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+                          updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+                          UNIQUE (provider, intent_id)
+);
+
+CREATE INDEX payments_order_id_idx ON payments(order_id);
@@ -0,0 +1,28 @@
+-- Buyers may refund tickets until this many hours before the event day, NULL means only admins can refund
+ALTER TABLE events ADD COLUMN refund_window_hours INT;
+
+ALTER TABLE tickets_no_shah ADD COLUMN refunded_at TIMESTAMPTZ;
+ALTER TABLE tickets_shah ADD COLUMN refunded_at TIMESTAMPTZ;
+
+-- A refunded seat can be sold again
+DROP INDEX tickets_shah_seat_id_key;
+CREATE UNIQUE INDEX tickets_shah_seat_id_key ON tickets_shah(seat_id) WHERE refunded_at IS NULL;
+
+CREATE TABLE refunds (
+                         id SERIAL PRIMARY KEY,
+                         order_id INT NOT NULL REFERENCES orders(id),
+                         amount DECIMAL(10, 2) NOT NULL,
+                         reason TEXT NOT NULL,
+                         user_id INT REFERENCES users(id), -- Set when the buyer requested the refund
+                         admin_id INT REFERENCES admin_users(id), -- Set when an admin forced the refund
+                         provider_refund_id VARCHAR(255),
+                         created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX refunds_order_id_idx ON refunds(order_id);
+
+CREATE TABLE refund_tickets (
+                                refund_id INT NOT NULL REFERENCES refunds(id),
+                                ticket_id INT REFERENCES tickets_no_shah(id),
+                                seat_ticket_id INT REFERENCES tickets_shah(id)
+);
@@ -0,0 +1,3 @@
+-- Random part of the signed ticket code, changing it revokes the old code
+ALTER TABLE tickets_no_shah ADD COLUMN code_nonce UUID NOT NULL DEFAULT gen_random_uuid();
+ALTER TABLE tickets_shah ADD COLUMN code_nonce UUID NOT NULL DEFAULT gen_random_uuid();
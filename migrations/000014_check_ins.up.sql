@@ -0,0 +1,12 @@
+CREATE TABLE check_ins (
+                           id SERIAL PRIMARY KEY,
+                           ticket_id INT UNIQUE REFERENCES tickets_no_shah(id), -- A ticket can be admitted only once
+                           seat_ticket_id INT UNIQUE REFERENCES tickets_shah(id),
+                           event_id INT NOT NULL REFERENCES events(id),
+                           event_day_id INT REFERENCES event_days_no_shah(id),
+                           gate VARCHAR(64),
+                           admin_id INT REFERENCES admin_users(id),
+                           scanned_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX check_ins_event_id_idx ON check_ins(event_id);
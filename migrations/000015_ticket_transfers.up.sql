@@ -0,0 +1,14 @@
+-- Owners may transfer tickets until this many hours before the event day, NULL falls back to the app default
+ALTER TABLE events ADD COLUMN transfer_cutoff_hours INT;
+
+CREATE TABLE ticket_transfers (
+                                  id SERIAL PRIMARY KEY,
+                                  ticket_id INT REFERENCES tickets_no_shah(id),
+                                  seat_ticket_id INT REFERENCES tickets_shah(id),
+                                  from_user_id INT NOT NULL REFERENCES users(id),
+                                  to_user_id INT NOT NULL REFERENCES users(id),
+                                  created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX ticket_transfers_from_user_id_idx ON ticket_transfers(from_user_id);
+CREATE INDEX ticket_transfers_to_user_id_idx ON ticket_transfers(to_user_id);
@@ -0,0 +1,34 @@
+CREATE TABLE promo_codes (
+                             id SERIAL PRIMARY KEY,
+                             code VARCHAR(64) NOT NULL UNIQUE, -- Stored upper case, matched case-insensitively
+                             discount_type VARCHAR(16) NOT NULL CHECK (discount_type IN ('percent', 'fixed')),
+                             value INT NOT NULL CHECK (value > 0), -- Percent off, or amount off every ticket
+                             event_id INT REFERENCES events(id), -- No scope at all means the code works sitewide
+                             ticket_type_id INT REFERENCES ticket_types_no_shah(id),
+                             shah_ticket_type_id INT REFERENCES shah_ticket_types(id),
+                             max_uses INT,
+                             max_uses_per_user INT,
+                             used_count INT NOT NULL DEFAULT 0,
+                             valid_from TIMESTAMPTZ,
+                             valid_until TIMESTAMPTZ,
+                             admin_id INT REFERENCES admin_users(id),
+                             created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE promo_redemptions (
+                                   id SERIAL PRIMARY KEY,
+                                   promo_code_id INT NOT NULL REFERENCES promo_codes(id),
+                                   order_id INT NOT NULL UNIQUE REFERENCES orders(id),
+                                   user_id INT NOT NULL REFERENCES users(id),
+                                   amount DECIMAL(10, 2) NOT NULL,
+                                   created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX promo_redemptions_code_user_idx ON promo_redemptions(promo_code_id, user_id);
+
+ALTER TABLE orders ADD COLUMN promo_code_id INT REFERENCES promo_codes(id);
+ALTER TABLE orders ADD COLUMN subtotal DECIMAL(10, 2);
+ALTER TABLE orders ADD COLUMN discount DECIMAL(10, 2) NOT NULL DEFAULT 0;
+UPDATE orders SET subtotal = total;
+
+ALTER TABLE order_items ADD COLUMN unit_discount DECIMAL(10, 2) NOT NULL DEFAULT 0;
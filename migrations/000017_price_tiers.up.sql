@@ -0,0 +1,14 @@
+-- Optional price schedule of a GA ticket type. The first tier (by position) whose
+-- conditions all hold sets the price, ticket_types_no_shah.price applies otherwise.
+CREATE TABLE ticket_price_tiers (
+                                    id SERIAL PRIMARY KEY,
+                                    ticket_type_id INT NOT NULL REFERENCES ticket_types_no_shah(id) ON DELETE CASCADE,
+                                    name VARCHAR(255) NOT NULL,
+                                    price DECIMAL(10, 2) NOT NULL,
+                                    position INT NOT NULL DEFAULT 0,
+                                    valid_until TIMESTAMPTZ, -- Active before this moment, e.g. early bird
+                                    sold_below INT, -- Active while sold_count is below this, e.g. first 100 tickets
+                                    hours_before_event INT -- Active within this many hours of the event day, e.g. door price
+);
+
+CREATE INDEX ticket_price_tiers_ticket_type_id_idx ON ticket_price_tiers(ticket_type_id, position);
@@ -0,0 +1,8 @@
+-- Maximum number of live tickets one user may hold, NULL means no limit
+ALTER TABLE events ADD COLUMN max_tickets_per_user INT;
+ALTER TABLE event_days_no_shah ADD COLUMN max_tickets_per_user INT;
+ALTER TABLE ticket_types_no_shah ADD COLUMN max_tickets_per_user INT;
+ALTER TABLE shah_ticket_types ADD COLUMN max_tickets_per_user INT;
+
+CREATE INDEX tickets_no_shah_user_id_idx ON tickets_no_shah(user_id);
+CREATE INDEX tickets_shah_user_id_idx ON tickets_shah(user_id);
@@ -0,0 +1,17 @@
+CREATE TABLE waitlist_entries (
+                                  id SERIAL PRIMARY KEY,
+                                  user_id INT NOT NULL REFERENCES users(id),
+                                  ticket_type_id INT REFERENCES ticket_types_no_shah(id), -- Set for a GA ticket type
+                                  event_id INT REFERENCES events(id), -- Set for any seat of a seated event
+                                  quantity INT NOT NULL DEFAULT 1,
+                                  status VARCHAR(16) NOT NULL DEFAULT 'waiting', -- waiting, offered, fulfilled, expired, cancelled
+                                  hold_id INT REFERENCES holds(id), -- Hold reserving the offered inventory
+                                  created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+                                  offered_at TIMESTAMPTZ
+);
+
+CREATE INDEX waitlist_entries_ticket_type_idx ON waitlist_entries(ticket_type_id, id) WHERE status = 'waiting';
+CREATE INDEX waitlist_entries_event_idx ON waitlist_entries(event_id, id) WHERE status = 'waiting';
+CREATE INDEX waitlist_entries_hold_id_idx ON waitlist_entries(hold_id);
+CREATE UNIQUE INDEX waitlist_entries_user_ticket_type_key ON waitlist_entries(user_id, ticket_type_id) WHERE status IN ('waiting', 'offered');
+CREATE UNIQUE INDEX waitlist_entries_user_event_key ON waitlist_entries(user_id, event_id) WHERE status IN ('waiting', 'offered');
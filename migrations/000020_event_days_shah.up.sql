@@ -0,0 +1,90 @@
+CREATE TABLE event_days_shah (
+                            id SERIAL PRIMARY KEY,
+                            event_id INT REFERENCES events(id),
+                            venue_id INT REFERENCES venues(id),
+                            date TIMESTAMPTZ NOT NULL
+);
+
+CREATE UNIQUE INDEX event_days_shah_event_venue_date_key ON event_days_shah(event_id, venue_id, date);
+
+-- Seats and their ticket types are inventory of one event day, a venue can
+-- host any number of seated events
+ALTER TABLE shah_seats ADD COLUMN event_day_id INT REFERENCES event_days_shah(id) ON DELETE CASCADE;
+ALTER TABLE shah_ticket_types ADD COLUMN event_day_id INT REFERENCES event_days_shah(id) ON DELETE CASCADE;
+
+-- Layouts uploaded before seats were tied to an event take the event their
+-- seats were sold for, the only event seated or held at their venue, or the
+-- event at their venue on the seat's date
+UPDATE shah_seats s SET event_id = o.event_id
+FROM (
+    SELECT i.seat_id, min(o.event_id) AS event_id
+    FROM order_items i
+    JOIN orders o ON o.id = i.order_id
+    WHERE i.seat_id IS NOT NULL
+    GROUP BY i.seat_id
+) o
+WHERE o.seat_id = s.id AND s.event_id IS NULL;
+
+UPDATE shah_seats s SET event_id = v.event_id
+FROM (
+    SELECT venue_id, min(event_id) AS event_id
+    FROM shah_seats
+    WHERE event_id IS NOT NULL
+    GROUP BY venue_id
+    HAVING count(DISTINCT event_id) = 1
+) v
+WHERE v.venue_id = s.venue_id AND s.event_id IS NULL;
+
+UPDATE shah_seats s SET event_id = v.event_id
+FROM (
+    SELECT venue_id, min(event_id) AS event_id
+    FROM event_venues
+    GROUP BY venue_id
+    HAVING count(DISTINCT event_id) = 1
+) v
+WHERE v.venue_id = s.venue_id AND s.event_id IS NULL;
+
+UPDATE shah_seats s SET event_id = m.event_id
+FROM (
+    SELECT s.id, min(e.id) AS event_id
+    FROM shah_seats s
+    JOIN event_venues ev ON ev.venue_id = s.venue_id
+    JOIN events e ON e.id = ev.event_id
+    WHERE s.event_id IS NULL
+      AND s.date::date BETWEEN e.start_time::date AND COALESCE(e.end_time, e.start_time)::date
+    GROUP BY s.id
+    HAVING count(DISTINCT e.id) = 1
+) m
+WHERE m.id = s.id;
+
+-- Seats still without an event that never sold are set aside, seats with
+-- tickets stay as they are and keep their tickets valid
+CREATE TABLE shah_seats_orphaned AS
+SELECT * FROM shah_seats s
+WHERE s.event_id IS NULL AND NOT EXISTS(SELECT 1 FROM tickets_shah t WHERE t.seat_id = s.id);
+
+DELETE FROM shah_seats s
+WHERE s.event_id IS NULL AND NOT EXISTS(SELECT 1 FROM tickets_shah t WHERE t.seat_id = s.id);
+
+-- Existing layouts become days of the event they were uploaded for, one per
+-- seat date
+UPDATE shah_seats s SET date = COALESCE(e.start_time, now())
+FROM events e
+WHERE e.id = s.event_id AND s.date IS NULL;
+
+INSERT INTO event_days_shah (event_id, venue_id, date)
+SELECT DISTINCT event_id, venue_id, date
+FROM shah_seats
+WHERE event_id IS NOT NULL;
+
+UPDATE shah_seats s SET event_day_id = d.id, date = d.date
+FROM event_days_shah d
+WHERE d.event_id = s.event_id AND d.venue_id IS NOT DISTINCT FROM s.venue_id AND d.date = s.date;
+
+UPDATE shah_ticket_types t SET event_day_id = s.event_day_id
+FROM shah_seat_ticket_types st
+JOIN shah_seats s ON s.id = st.seat_id
+WHERE st.ticket_type_id = t.id;
+
+CREATE INDEX shah_seats_event_day_id_idx ON shah_seats(event_day_id);
+CREATE INDEX shah_ticket_types_event_day_id_idx ON shah_ticket_types(event_day_id);
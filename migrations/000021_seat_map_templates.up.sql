@@ -0,0 +1,40 @@
+CREATE TABLE seat_map_templates (
+                                    id SERIAL PRIMARY KEY,
+                                    venue_id INT NOT NULL REFERENCES venues(id) ON DELETE CASCADE,
+                                    name VARCHAR(255) NOT NULL,
+                                    version INT NOT NULL DEFAULT 1, -- Saving a template under an existing name adds a version
+                                    admin_id INT REFERENCES admin_users(id),
+                                    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+                                    UNIQUE (venue_id, name, version)
+);
+
+-- Sectors become the ticket types of an event day created from the template
+CREATE TABLE seat_map_template_sectors (
+                                           id SERIAL PRIMARY KEY,
+                                           template_id INT NOT NULL REFERENCES seat_map_templates(id) ON DELETE CASCADE,
+                                           name VARCHAR(255) NOT NULL,
+                                           price INT NOT NULL, -- Default price, events can override it
+                                           color VARCHAR(255),
+                                           max_tickets_per_user INT,
+                                           UNIQUE (template_id, name)
+);
+
+CREATE TABLE seat_map_template_seats (
+                                         id SERIAL PRIMARY KEY,
+                                         template_id INT NOT NULL REFERENCES seat_map_templates(id) ON DELETE CASCADE,
+                                         num INT,
+                                         "left" INT,
+                                         top INT,
+                                         bg_color VARCHAR(255),
+                                         text_color VARCHAR(255)
+);
+
+CREATE TABLE seat_map_template_seat_sectors (
+                                                seat_id INT REFERENCES seat_map_template_seats(id) ON DELETE CASCADE,
+                                                sector_id INT REFERENCES seat_map_template_sectors(id) ON DELETE CASCADE,
+                                                PRIMARY KEY (seat_id, sector_id)
+);
+
+CREATE INDEX seat_map_template_seats_template_id_idx ON seat_map_template_seats(template_id);
+
+ALTER TABLE event_days_shah ADD COLUMN template_id INT REFERENCES seat_map_templates(id);
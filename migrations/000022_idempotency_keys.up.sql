@@ -0,0 +1,12 @@
+CREATE TABLE idempotency_keys (
+                                  scope VARCHAR(64) NOT NULL, -- Who sent the request, user:<id> or admin:<id>
+                                  key VARCHAR(255) NOT NULL,
+                                  request_hash VARCHAR(64) NOT NULL, -- Method, path and body of the first request
+                                  status_code INT, -- NULL while the first request is still running
+                                  content_type VARCHAR(255),
+                                  response BYTEA,
+                                  created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+                                  PRIMARY KEY (scope, key)
+);
+
+CREATE INDEX idempotency_keys_created_at_idx ON idempotency_keys(created_at);
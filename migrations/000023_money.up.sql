@@ -0,0 +1,31 @@
+-- Amounts are kept in minor units (tiyn, kopecks, cents) of the event
+-- currency. Existing prices were whole tenge.
+ALTER TABLE events ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'KZT' CHECK (currency IN ('KZT', 'RUB', 'USD'));
+ALTER TABLE events ALTER COLUMN price TYPE BIGINT USING round(price * 100);
+
+ALTER TABLE ticket_types_no_shah ALTER COLUMN price TYPE BIGINT USING round(price * 100);
+ALTER TABLE ticket_price_tiers ALTER COLUMN price TYPE BIGINT USING round(price * 100);
+ALTER TABLE shah_seats ALTER COLUMN price TYPE BIGINT USING price::bigint * 100;
+ALTER TABLE shah_ticket_types ALTER COLUMN price TYPE BIGINT USING price::bigint * 100;
+
+ALTER TABLE seat_map_template_sectors ALTER COLUMN price TYPE BIGINT USING price::bigint * 100;
+ALTER TABLE seat_map_template_sectors ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'KZT';
+
+ALTER TABLE orders ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'KZT';
+ALTER TABLE orders ALTER COLUMN total TYPE BIGINT USING round(total * 100),
+                   ALTER COLUMN subtotal TYPE BIGINT USING round(subtotal * 100),
+                   ALTER COLUMN discount TYPE BIGINT USING round(discount * 100);
+ALTER TABLE order_items ALTER COLUMN unit_price TYPE BIGINT USING round(unit_price * 100),
+                        ALTER COLUMN unit_discount TYPE BIGINT USING round(unit_discount * 100),
+                        ALTER COLUMN total TYPE BIGINT USING round(total * 100);
+
+ALTER TABLE payments ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'KZT';
+ALTER TABLE payments ALTER COLUMN amount TYPE BIGINT USING round(amount * 100);
+ALTER TABLE refunds ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'KZT';
+ALTER TABLE refunds ALTER COLUMN amount TYPE BIGINT USING round(amount * 100);
+
+-- Fixed promo codes take an amount in their currency off every ticket
+ALTER TABLE promo_codes ADD COLUMN currency CHAR(3);
+ALTER TABLE promo_codes ALTER COLUMN value TYPE BIGINT;
+UPDATE promo_codes SET currency = 'KZT', value = value * 100 WHERE discount_type = 'fixed';
+ALTER TABLE promo_redemptions ALTER COLUMN amount TYPE BIGINT USING round(amount * 100);
@@ -0,0 +1,3 @@
+-- Soft deleted events are hidden from every listing but keep their orders
+-- and tickets
+ALTER TABLE events ADD COLUMN deleted_at TIMESTAMPTZ;
@@ -0,0 +1,8 @@
+-- draft, scheduled, published, on_sale, sold_out, postponed, cancelled, finished
+ALTER TABLE events ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'draft'
+    CHECK (status IN ('draft', 'scheduled', 'published', 'on_sale', 'sold_out', 'postponed', 'cancelled', 'finished'));
+ALTER TABLE events ADD COLUMN publish_at TIMESTAMPTZ; -- When a scheduled event is published
+-- Events created so far were listed and sold right away
+UPDATE events SET status = 'on_sale';
+CREATE INDEX events_scheduled_publish_at_idx ON events(publish_at) WHERE status = 'scheduled';
+CREATE INDEX events_status_idx ON events(status);
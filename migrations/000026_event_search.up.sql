@@ -0,0 +1,14 @@
+-- Postgres ships no Kazakh stemmer, Kazakh words are matched as they are
+-- written next to the stemmed Russian forms
+CREATE TEXT SEARCH CONFIGURATION kazakh (COPY = simple);
+
+ALTER TABLE events ADD COLUMN search_vector TSVECTOR GENERATED ALWAYS AS (
+    setweight(to_tsvector('russian', coalesce(title, '')), 'A') ||
+    setweight(to_tsvector('kazakh', coalesce(title, '')), 'A') ||
+    setweight(to_tsvector('russian', coalesce(brief_desc, '')), 'B') ||
+    setweight(to_tsvector('kazakh', coalesce(brief_desc, '')), 'B') ||
+    setweight(to_tsvector('russian', coalesce(description, '')), 'C') ||
+    setweight(to_tsvector('kazakh', coalesce(description, '')), 'C')
+) STORED;
+CREATE INDEX events_search_vector_idx ON events USING GIN (search_vector);
+CREATE INDEX events_genre_idx ON events USING GIN (genre);
@@ -0,0 +1,7 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- Autocomplete matches lowercased text by trigrams, typos included
+CREATE INDEX events_title_trgm_idx ON events USING GIN (lower(title) gin_trgm_ops);
+CREATE INDEX venues_name_trgm_idx ON venues USING GIN (lower(name) gin_trgm_ops);
+CREATE INDEX types_name_trgm_idx ON types USING GIN (lower(name) gin_trgm_ops);
+CREATE INDEX types_translated_name_trgm_idx ON types USING GIN (lower(translated_name) gin_trgm_ops);
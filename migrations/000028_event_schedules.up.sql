@@ -0,0 +1,27 @@
+CREATE TABLE event_schedules (
+                                 id SERIAL PRIMARY KEY,
+                                 event_id INT NOT NULL REFERENCES events(id),
+                                 venue_id INT NOT NULL REFERENCES venues(id),
+                                 rrule TEXT NOT NULL,
+                                 start_time TIMESTAMPTZ NOT NULL, -- First occurrence, its local time of day is the show time
+                                 timezone TEXT NOT NULL,
+                                 exdates DATE[] NOT NULL DEFAULT '{}', -- Local days the rule skips
+                                 max_tickets_per_user INT,
+                                 generated_until TIMESTAMPTZ, -- Days are created up to here
+                                 created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Ticket types copied onto every generated day
+CREATE TABLE event_schedule_ticket_types (
+                                             id SERIAL PRIMARY KEY,
+                                             schedule_id INT NOT NULL REFERENCES event_schedules(id) ON DELETE CASCADE,
+                                             name VARCHAR(255) NOT NULL,
+                                             price BIGINT NOT NULL,
+                                             amount INT NOT NULL,
+                                             max_tickets_per_user INT,
+                                             position INT NOT NULL
+);
+
+ALTER TABLE event_days_no_shah ADD COLUMN schedule_id INT REFERENCES event_schedules(id);
+CREATE UNIQUE INDEX event_days_no_shah_schedule_date_key ON event_days_no_shah(schedule_id, date);
+CREATE INDEX event_schedules_event_id_idx ON event_schedules(event_id);
@@ -0,0 +1,4 @@
+-- Money captured for orders that were no longer payable and never refunded
+UPDATE payments p SET status = 'refund_due', updated_at = now()
+FROM orders o
+WHERE o.id = p.order_id AND p.status = 'succeeded' AND o.status IN ('pending', 'cancelled');
@@ -0,0 +1,6 @@
+ALTER TABLE check_ins ADD COLUMN seat_event_day_id INT REFERENCES event_days_shah(id);
+
+UPDATE check_ins c SET seat_event_day_id = s.event_day_id
+FROM tickets_shah t
+JOIN shah_seats s ON s.id = t.seat_id
+WHERE t.id = c.seat_ticket_id;
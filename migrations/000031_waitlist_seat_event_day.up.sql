@@ -0,0 +1,28 @@
+-- Seated entries wait for a seat of one day of the event
+ALTER TABLE waitlist_entries ADD COLUMN seat_event_day_id INT REFERENCES event_days_shah(id) ON DELETE CASCADE;
+
+-- Offered entries wait for the day of the seat they hold, the rest for the
+-- only seated day of their event
+UPDATE waitlist_entries w SET seat_event_day_id = s.event_day_id
+FROM tickets_shah t
+JOIN shah_seats s ON s.id = t.seat_id
+WHERE t.hold_id = w.hold_id AND w.event_id IS NOT NULL;
+
+UPDATE waitlist_entries w SET seat_event_day_id = d.id
+FROM (
+    SELECT event_id, min(id) AS id
+    FROM event_days_shah
+    GROUP BY event_id
+    HAVING count(*) = 1
+) d
+WHERE d.event_id = w.event_id AND w.seat_event_day_id IS NULL;
+
+-- Waiting for any day of an event with several can't be told apart, those
+-- users join the line of a day again
+UPDATE waitlist_entries SET status = 'cancelled'
+WHERE event_id IS NOT NULL AND seat_event_day_id IS NULL AND status = 'waiting';
+
+DROP INDEX waitlist_entries_event_idx;
+DROP INDEX waitlist_entries_user_event_key;
+CREATE INDEX waitlist_entries_seat_event_day_idx ON waitlist_entries(seat_event_day_id, id) WHERE status = 'waiting';
+CREATE UNIQUE INDEX waitlist_entries_user_seat_event_day_key ON waitlist_entries(user_id, seat_event_day_id) WHERE status IN ('waiting', 'offered');
@@ -0,0 +1,2 @@
+-- Maximum number of live tickets one user may hold on a seated day, NULL means no limit
+ALTER TABLE event_days_shah ADD COLUMN max_tickets_per_user INT;
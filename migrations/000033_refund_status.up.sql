@@ -0,0 +1,10 @@
+-- A refund is recorded as pending before the provider is asked to send the
+-- money back, and marked succeeded once it has
+ALTER TABLE refunds ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'succeeded'; -- pending, succeeded
+ALTER TABLE refunds ADD COLUMN payment_id INT REFERENCES payments(id);
+
+UPDATE refunds r SET payment_id = p.id
+FROM payments p
+WHERE p.order_id = r.order_id AND p.status IN ('succeeded', 'refunded') AND r.amount > 0;
+
+CREATE INDEX refunds_pending_idx ON refunds(id) WHERE status = 'pending';